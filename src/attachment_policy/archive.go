@@ -0,0 +1,171 @@
+// unpack zip, 7z, tar and gzip archives within the limits against zip bombs //
+package attachment_policy
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/h2non/filetype/types"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+)
+
+var errArchiveBomb = errors.New("archive exceeds the unpacking limits")
+
+type archiveMember struct {
+	Path string
+	Data []byte
+}
+
+// keeps track of the limits while unpacking a file and all archives within it
+type inspector struct {
+	policy         *glb.AttachmentPolicy
+	entries        int
+	remainingBytes int64
+}
+
+func isArchive(kind types.Type) bool {
+	switch kind.Extension {
+	case "zip", "7z", "tar", "gz":
+		return true
+	}
+	return false
+}
+
+func (ins *inspector) addEntry() error {
+	ins.entries++
+	if ins.entries > ins.policy.MaxArchiveEntries {
+		return errArchiveBomb
+	}
+	return nil
+}
+
+// claim size bytes of the unpacking limit before allocating them
+func (ins *inspector) reserve(size uint64) error {
+	if size > uint64(ins.remainingBytes) {
+		return errArchiveBomb
+	}
+	ins.remainingBytes -= int64(size)
+	return nil
+}
+
+// read everything without exceeding the unpacking limit, the size given in archives can't be trusted
+func (ins *inspector) readAll(reader io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(reader, ins.remainingBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > ins.remainingBytes {
+		return nil, errArchiveBomb
+	}
+	ins.remainingBytes -= int64(len(data))
+	return data, nil
+}
+
+func (ins *inspector) unpack(kind types.Type, name string, data []byte) ([]archiveMember, error) {
+	switch kind.Extension {
+	case "zip":
+		return ins.unpackZip(data)
+	case "7z":
+		return ins.unpack7z(data)
+	case "tar":
+		return ins.unpackTar(data)
+	case "gz":
+		return ins.unpackGzip(name, data)
+	}
+	return nil, errors.New("unknown archive")
+}
+
+func (ins *inspector) unpackZip(data []byte) ([]archiveMember, error) {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var members []archiveMember
+	for _, file := range reader.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		if err := ins.addEntry(); err != nil {
+			return nil, err
+		}
+		if file.Flags&0x1 != 0 {
+			return nil, errors.New("archive is encrypted")
+		}
+		if file.UncompressedSize64 > uint64(ins.remainingBytes) {
+			return nil, errArchiveBomb
+		}
+		fileReader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		fileData, err := ins.readAll(fileReader)
+		fileReader.Close()
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, archiveMember{Path: file.Name, Data: fileData})
+	}
+	return members, nil
+}
+
+func (ins *inspector) unpackTar(data []byte) ([]archiveMember, error) {
+	reader := tar.NewReader(bytes.NewReader(data))
+	var members []archiveMember
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := ins.addEntry(); err != nil {
+			return nil, err
+		}
+		if header.Size > ins.remainingBytes {
+			return nil, errArchiveBomb
+		}
+		fileData, err := ins.readAll(reader)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, archiveMember{Path: header.Name, Data: fileData})
+	}
+}
+
+// a gzip contains a single file, usually a tar
+func (ins *inspector) unpackGzip(name string, data []byte) ([]archiveMember, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if err := ins.addEntry(); err != nil {
+		return nil, err
+	}
+	fileData, err := ins.readAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	// the name is optional, otherwise it is the gzip's name without extension
+	memberName := strings.TrimSpace(reader.Name)
+	if memberName == "" {
+		memberName = path.Base(name)
+		if strings.HasSuffix(strings.ToLower(memberName), ".tgz") {
+			memberName = memberName[:len(memberName)-len(".tgz")] + ".tar"
+		} else if strings.HasSuffix(strings.ToLower(memberName), ".gz") {
+			memberName = memberName[:len(memberName)-len(".gz")]
+		}
+	}
+	return []archiveMember{{Path: memberName, Data: fileData}}, nil
+}
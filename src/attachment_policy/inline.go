@@ -0,0 +1,53 @@
+// ignore signature logos and recognize files uploaded before //
+package attachment_policy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"github.com/h2non/filetype"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+func isTinyImage(filter *glb.InlineImageFilter, file glb.File) bool {
+	if !filetype.IsImage(file.Bytes) {
+		return false
+	}
+	if filter.MinBytes != 0 && int64(len(file.Bytes)) < filter.MinBytes {
+		return true
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(file.Bytes))
+	if err != nil {
+		return false
+	}
+	return (filter.MinWidth != 0 && config.Width < filter.MinWidth) || (filter.MinHeight != 0 && config.Height < filter.MinHeight)
+}
+
+// drop inline images smaller than the servicedesk's limits, all files are kept when there is no filter
+func FilterInlineImages(filter *glb.InlineImageFilter, files []glb.File) []glb.File {
+	if filter == nil {
+		return files
+	}
+	var kept []glb.File
+	for _, file := range files {
+		if file.Inline && isTinyImage(filter, file) {
+			lg.Logf("ignoring tiny inline image %s\n", file.Name)
+			continue
+		}
+		kept = append(kept, file)
+	}
+	return kept
+}
+
+// identifies the content of a file regardless of its name
+func GetFileHash(file glb.File) string {
+	hash := sha256.Sum256(file.Bytes)
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,203 @@
+// decide which files of an email get uploaded to jira //
+package attachment_policy
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/h2non/filetype"
+	"github.com/h2non/filetype/types"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+// entries beyond this aren't listed in the description
+const maxListedEntries = 50
+
+// office formats based on zip, OLE compound files and the macros within them
+var (
+	ooxmlTypes = map[string]struct{}{"zip": {}, "docx": {}, "xlsx": {}, "pptx": {}}
+	oleTypes   = map[string]struct{}{"doc": {}, "xls": {}, "ppt": {}}
+	// name of the storage holding the VBA project in OLE files, utf-16 encoded
+	oleVBAProject = utf16LE("_VBA_PROJECT")
+)
+
+func utf16LE(value string) []byte {
+	encoded := utf16.Encode([]rune(value))
+	out := make([]byte, 2*len(encoded))
+	for idx, char := range encoded {
+		binary.LittleEndian.PutUint16(out[2*idx:], char)
+	}
+	return out
+}
+
+func detectType(data []byte) types.Type {
+	kind, err := filetype.Match(data)
+	if err != nil {
+		return types.Unknown
+	}
+	return kind
+}
+
+func typeListed(list []string, kind types.Type) bool {
+	for _, listed := range list {
+		if strings.EqualFold(listed, kind.Extension) || strings.EqualFold(listed, kind.MIME.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// docm, xlsm, ... contain a vbaProject.bin, doc, xls, ... a _VBA_PROJECT storage
+func containsMacros(data []byte, kind types.Type) bool {
+	if _, found := oleTypes[kind.Extension]; found {
+		return bytes.Contains(data, oleVBAProject)
+	}
+	if _, found := ooxmlTypes[kind.Extension]; !found {
+		return false
+	}
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return false
+	}
+	for _, file := range reader.File {
+		if strings.EqualFold(path.Base(file.Name), "vbaProject.bin") {
+			return true
+		}
+	}
+	return false
+}
+
+// return all entries of inspected archives and the reason why the file is to be dropped, empty when it is allowed
+// the reason may be caused by a file within an archive, its path is returned as well
+// name is the path within the uploaded file, the uploaded file's name at the top
+func (ins *inspector) checkFile(name string, data []byte, depth int) ([]glb.ArchiveEntry, string, string) {
+	policy := ins.policy
+	kind := detectType(data)
+	if len(policy.AllowedTypes) != 0 && !typeListed(policy.AllowedTypes, kind) {
+		return nil, "", fmt.Sprintf("is of type %s, which is not allowed", kind.Extension)
+	}
+	if typeListed(policy.DeniedTypes, kind) {
+		return nil, "", fmt.Sprintf("is of type %s, which is denied", kind.Extension)
+	}
+	if policy.BlockMacros && containsMacros(data, kind) {
+		return nil, "", "contains macros"
+	}
+	if !policy.InspectArchives || !isArchive(kind) {
+		return nil, "", ""
+	}
+	if depth >= policy.MaxArchiveDepth {
+		lg.Logf("not inspecting archive %s nested deeper than %d\n", name, policy.MaxArchiveDepth)
+		if policy.DropUninspectableArchives {
+			return nil, "", fmt.Sprintf("is nested deeper than %d archives", policy.MaxArchiveDepth)
+		}
+		return nil, "", ""
+	}
+
+	members, err := ins.unpack(kind, name, data)
+	if err == errArchiveBomb {
+		return nil, "", "exceeds max_archive_entries or max_archive_unpacked_bytes when unpacked, possibly a zip bomb"
+	}
+	if err != nil {
+		lg.Logf("failed to inspect archive %s: %s\n", name, err)
+		if policy.DropUninspectableArchives {
+			return nil, "", fmt.Sprintf("can't be inspected: %s", err)
+		}
+		return nil, "", ""
+	}
+	var entries []glb.ArchiveEntry
+	for _, member := range members {
+		memberPath := member.Path
+		if depth != 0 {
+			memberPath = name + "/" + member.Path
+		}
+		entries = append(entries, glb.ArchiveEntry{Path: memberPath, Size: int64(len(member.Data))})
+		nestedEntries, offendingPath, reason := ins.checkFile(memberPath, member.Data, depth+1)
+		if reason != "" {
+			if offendingPath == "" {
+				offendingPath = memberPath
+			}
+			return nil, offendingPath, reason
+		}
+		entries = append(entries, nestedEntries...)
+	}
+	return entries, "", ""
+}
+
+// apply the servicedesk's attachment policy, all files are kept when there is none
+func ApplyPolicy(policy *glb.AttachmentPolicy, files []glb.File) *glb.AttachmentPolicyResult {
+	result := &glb.AttachmentPolicyResult{}
+	if policy == nil {
+		result.Files = files
+		return result
+	}
+	totalBytes := int64(0)
+	for _, file := range files {
+		size := int64(len(file.Bytes))
+		if policy.MaxFileBytes != 0 && size > policy.MaxFileBytes {
+			result.Dropped = append(result.Dropped, glb.DroppedFile{Name: file.Name, Reason: fmt.Sprintf("larger than %s", formatSize(policy.MaxFileBytes))})
+			continue
+		}
+		// the limits apply to every file on its own
+		ins := &inspector{policy: policy, remainingBytes: policy.MaxArchiveUnpackedBytes}
+		entries, offendingPath, reason := ins.checkFile(file.Name, file.Bytes, 0)
+		if offendingPath != "" {
+			reason = fmt.Sprintf("%s %s", offendingPath, reason)
+		}
+		if reason != "" {
+			result.Dropped = append(result.Dropped, glb.DroppedFile{Name: file.Name, Reason: reason})
+			continue
+		}
+		if policy.MaxTotalBytes != 0 && totalBytes+size > policy.MaxTotalBytes {
+			result.Dropped = append(result.Dropped, glb.DroppedFile{Name: file.Name, Reason: fmt.Sprintf("all files together are larger than %s", formatSize(policy.MaxTotalBytes))})
+			continue
+		}
+		totalBytes += size
+		result.Files = append(result.Files, file)
+		if len(entries) != 0 {
+			result.Archives = append(result.Archives, glb.ArchiveListing{Name: file.Name, Entries: entries})
+		}
+	}
+	for _, dropped := range result.Dropped {
+		lg.Logf("dropping %s: %s\n", dropped.Name, dropped.Reason)
+	}
+	return result
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
+
+// list dropped files and the content of archives below the message
+func GetAttachmentPolicyStr(result *glb.AttachmentPolicyResult) string {
+	outStr := ""
+	if len(result.Dropped) != 0 {
+		outStr += "\n\n----\nFiles not uploaded\n"
+		for _, dropped := range result.Dropped {
+			outStr += fmt.Sprintf("* %s: %s\n", dropped.Name, dropped.Reason)
+		}
+	}
+	for _, archive := range result.Archives {
+		outStr += fmt.Sprintf("\n\n----\nContent of %s\n", archive.Name)
+		for idx, entry := range archive.Entries {
+			if idx == maxListedEntries {
+				outStr += fmt.Sprintf("* ... and %d more\n", len(archive.Entries)-maxListedEntries)
+				break
+			}
+			outStr += fmt.Sprintf("* %s (%s)\n", entry.Path, formatSize(entry.Size))
+		}
+	}
+	return strings.TrimSuffix(outStr, "\n")
+}
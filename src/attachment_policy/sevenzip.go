@@ -0,0 +1,662 @@
+// read 7z archives, only folders compressed by a single copy, LZMA or LZMA2 coder are supported //
+package attachment_policy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf16"
+
+	"github.com/ulikunitz/xz/lzma"
+)
+
+const sevenZipSignature = "7z\xbc\xaf\x27\x1c"
+
+// property ids of the 7z header
+const (
+	szEnd                   = 0x00
+	szHeader                = 0x01
+	szArchiveProperties     = 0x02
+	szAdditionalStreamsInfo = 0x03
+	szMainStreamsInfo       = 0x04
+	szFilesInfo             = 0x05
+	szPackInfo              = 0x06
+	szUnpackInfo            = 0x07
+	szSubStreamsInfo        = 0x08
+	szSize                  = 0x09
+	szCRC                   = 0x0a
+	szFolderId              = 0x0b
+	szCodersUnpackSize      = 0x0c
+	szNumUnpackStream       = 0x0d
+	szEmptyStream           = 0x0e
+	szEmptyFile             = 0x0f
+	szName                  = 0x11
+	szEncodedHeader         = 0x17
+)
+
+var (
+	szCopyCoder  = []byte{0x00}
+	szLZMACoder  = []byte{0x03, 0x01, 0x01}
+	szLZMA2Coder = []byte{0x21}
+	szAESCoder   = []byte{0x06, 0xf1, 0x07, 0x01}
+)
+
+var errSevenZipTruncated = errors.New("7z header is truncated")
+
+type szReader struct {
+	data []byte
+	pos  int
+}
+
+func (reader *szReader) byte() (byte, error) {
+	if reader.pos >= len(reader.data) {
+		return 0, errSevenZipTruncated
+	}
+	reader.pos++
+	return reader.data[reader.pos-1], nil
+}
+
+func (reader *szReader) bytes(length uint64) ([]byte, error) {
+	if length > uint64(len(reader.data)-reader.pos) {
+		return nil, errSevenZipTruncated
+	}
+	value := reader.data[reader.pos : reader.pos+int(length)]
+	reader.pos += int(length)
+	return value, nil
+}
+
+// the leading one bits of the first byte tell how many bytes follow
+func (reader *szReader) number() (uint64, error) {
+	first, err := reader.byte()
+	if err != nil {
+		return 0, err
+	}
+	value := uint64(0)
+	mask := byte(0x80)
+	for idx := 0; idx < 8; idx++ {
+		if first&mask == 0 {
+			return value | uint64(first&(mask-1))<<(8*idx), nil
+		}
+		next, err := reader.byte()
+		if err != nil {
+			return 0, err
+		}
+		value |= uint64(next) << (8 * idx)
+		mask >>= 1
+	}
+	return value, nil
+}
+
+// a number of items each taking at least one byte, protects against huge allocations
+func (reader *szReader) count() (int, error) {
+	value, err := reader.number()
+	if err != nil {
+		return 0, err
+	}
+	if value > uint64(len(reader.data)) {
+		return 0, errors.New("7z header is corrupt")
+	}
+	return int(value), nil
+}
+
+func (reader *szReader) expect(id byte) error {
+	value, err := reader.byte()
+	if err != nil {
+		return err
+	}
+	if value != id {
+		return fmt.Errorf("unexpected 7z property 0x%02x", value)
+	}
+	return nil
+}
+
+func (reader *szReader) bits(length int) ([]bool, error) {
+	data, err := reader.bytes(uint64((length + 7) / 8))
+	if err != nil {
+		return nil, err
+	}
+	bits := make([]bool, length)
+	for idx := range bits {
+		bits[idx] = data[idx/8]&(0x80>>(idx%8)) != 0
+	}
+	return bits, nil
+}
+
+// return which of the length items have a crc, the crcs themselves aren't needed
+func (reader *szReader) digests(length int) ([]bool, error) {
+	allDefined, err := reader.byte()
+	if err != nil {
+		return nil, err
+	}
+	defined := make([]bool, length)
+	if allDefined == 0 {
+		if defined, err = reader.bits(length); err != nil {
+			return nil, err
+		}
+	} else {
+		for idx := range defined {
+			defined[idx] = true
+		}
+	}
+	for _, isDefined := range defined {
+		if isDefined {
+			if _, err = reader.bytes(4); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return defined, nil
+}
+
+type szCoder struct {
+	Id         []byte
+	NumOutputs int
+	Props      []byte
+}
+
+type szFolder struct {
+	Coders        []szCoder
+	NumPacked     int
+	UnpackSizes   []uint64
+	CRCDefined    bool
+	NumSubStreams int
+	SubSizes      []uint64
+}
+
+type szStreamsInfo struct {
+	PackPos   uint64
+	PackSizes []uint64
+	Folders   []*szFolder
+}
+
+func (reader *szReader) folder() (*szFolder, error) {
+	numCoders, err := reader.count()
+	if err != nil {
+		return nil, err
+	}
+	folder := &szFolder{NumSubStreams: 1}
+	numInputs, numOutputs := 0, 0
+	for idx := 0; idx < numCoders; idx++ {
+		flags, err := reader.byte()
+		if err != nil {
+			return nil, err
+		}
+		coder := szCoder{NumOutputs: 1}
+		if coder.Id, err = reader.bytes(uint64(flags & 0x0f)); err != nil {
+			return nil, err
+		}
+		coderInputs := 1
+		if flags&0x10 != 0 {
+			if coderInputs, err = reader.count(); err != nil {
+				return nil, err
+			}
+			if coder.NumOutputs, err = reader.count(); err != nil {
+				return nil, err
+			}
+		}
+		if flags&0x20 != 0 {
+			propsSize, err := reader.number()
+			if err != nil {
+				return nil, err
+			}
+			if coder.Props, err = reader.bytes(propsSize); err != nil {
+				return nil, err
+			}
+		}
+		numInputs += coderInputs
+		numOutputs += coder.NumOutputs
+		folder.Coders = append(folder.Coders, coder)
+	}
+	if numOutputs == 0 {
+		return nil, errors.New("7z folder without output")
+	}
+	// bind pairs connect coders, they don't matter as only single coders are supported
+	for idx := 0; idx < numOutputs-1; idx++ {
+		for pair := 0; pair < 2; pair++ {
+			if _, err = reader.number(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	folder.NumPacked = numInputs - (numOutputs - 1)
+	if folder.NumPacked > 1 {
+		for idx := 0; idx < folder.NumPacked; idx++ {
+			if _, err = reader.number(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return folder, nil
+}
+
+func (reader *szReader) streamsInfo() (*szStreamsInfo, error) {
+	info := &szStreamsInfo{}
+	for {
+		id, err := reader.byte()
+		if err != nil {
+			return nil, err
+		}
+		switch id {
+		case szEnd:
+			return info, nil
+		case szPackInfo:
+			if info.PackPos, err = reader.number(); err != nil {
+				return nil, err
+			}
+			numPackStreams, err := reader.count()
+			if err != nil {
+				return nil, err
+			}
+			for {
+				id, err := reader.byte()
+				if err != nil {
+					return nil, err
+				}
+				if id == szEnd {
+					break
+				}
+				switch id {
+				case szSize:
+					for idx := 0; idx < numPackStreams; idx++ {
+						size, err := reader.number()
+						if err != nil {
+							return nil, err
+						}
+						info.PackSizes = append(info.PackSizes, size)
+					}
+				case szCRC:
+					if _, err = reader.digests(numPackStreams); err != nil {
+						return nil, err
+					}
+				default:
+					return nil, fmt.Errorf("unexpected 7z property 0x%02x", id)
+				}
+			}
+		case szUnpackInfo:
+			if err = reader.expect(szFolderId); err != nil {
+				return nil, err
+			}
+			numFolders, err := reader.count()
+			if err != nil {
+				return nil, err
+			}
+			if err = reader.expect(0); err != nil {
+				return nil, errors.New("external 7z folders aren't supported")
+			}
+			for idx := 0; idx < numFolders; idx++ {
+				folder, err := reader.folder()
+				if err != nil {
+					return nil, err
+				}
+				info.Folders = append(info.Folders, folder)
+			}
+			if err = reader.expect(szCodersUnpackSize); err != nil {
+				return nil, err
+			}
+			for _, folder := range info.Folders {
+				for _, coder := range folder.Coders {
+					for idx := 0; idx < coder.NumOutputs; idx++ {
+						size, err := reader.number()
+						if err != nil {
+							return nil, err
+						}
+						folder.UnpackSizes = append(folder.UnpackSizes, size)
+					}
+				}
+			}
+			for {
+				id, err := reader.byte()
+				if err != nil {
+					return nil, err
+				}
+				if id == szEnd {
+					break
+				}
+				if id != szCRC {
+					return nil, fmt.Errorf("unexpected 7z property 0x%02x", id)
+				}
+				defined, err := reader.digests(len(info.Folders))
+				if err != nil {
+					return nil, err
+				}
+				for idx, folder := range info.Folders {
+					folder.CRCDefined = defined[idx]
+				}
+			}
+		case szSubStreamsInfo:
+			if err = reader.subStreamsInfo(info); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected 7z property 0x%02x", id)
+		}
+	}
+}
+
+func (reader *szReader) subStreamsInfo(info *szStreamsInfo) error {
+	for {
+		id, err := reader.byte()
+		if err != nil {
+			return err
+		}
+		switch id {
+		case szEnd:
+			return nil
+		case szNumUnpackStream:
+			for _, folder := range info.Folders {
+				if folder.NumSubStreams, err = reader.count(); err != nil {
+					return err
+				}
+			}
+		case szSize:
+			for _, folder := range info.Folders {
+				for idx := 0; idx < folder.NumSubStreams-1; idx++ {
+					size, err := reader.number()
+					if err != nil {
+						return err
+					}
+					folder.SubSizes = append(folder.SubSizes, size)
+				}
+			}
+		case szCRC:
+			numDigests := 0
+			for _, folder := range info.Folders {
+				if folder.NumSubStreams != 1 || !folder.CRCDefined {
+					numDigests += folder.NumSubStreams
+				}
+			}
+			if _, err = reader.digests(numDigests); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected 7z property 0x%02x", id)
+		}
+	}
+}
+
+// the dictionary never needs to be bigger than the unpacked data
+func getDictCap(dictSize uint64, unpackSize uint64) int {
+	dictCap := dictSize
+	if unpackSize < dictCap {
+		dictCap = unpackSize
+	}
+	if dictCap < lzma.MinDictCap {
+		dictCap = lzma.MinDictCap
+	}
+	return int(dictCap)
+}
+
+// unpack the folder with the given index, which starts at the pack stream with the given index
+func (ins *inspector) decodeFolder(archive []byte, info *szStreamsInfo, folderIdx int) ([]byte, error) {
+	folder := info.Folders[folderIdx]
+	if len(folder.Coders) != 1 || folder.NumPacked != 1 || len(folder.UnpackSizes) != 1 {
+		return nil, errors.New("7z filters aren't supported")
+	}
+	packStart := 32 + info.PackPos
+	packIdx := 0
+	for _, previous := range info.Folders[:folderIdx] {
+		packIdx += previous.NumPacked
+	}
+	if packIdx >= len(info.PackSizes) {
+		return nil, errSevenZipTruncated
+	}
+	for _, size := range info.PackSizes[:packIdx] {
+		packStart += size
+	}
+	packSize := info.PackSizes[packIdx]
+	if packStart > uint64(len(archive)) || packSize > uint64(len(archive))-packStart {
+		return nil, errSevenZipTruncated
+	}
+	packed := bytes.NewReader(archive[packStart : packStart+packSize])
+	unpackSize := folder.UnpackSizes[0]
+	if err := ins.reserve(unpackSize); err != nil {
+		return nil, err
+	}
+
+	var reader io.Reader
+	coder := folder.Coders[0]
+	switch {
+	case bytes.Equal(coder.Id, szCopyCoder):
+		reader = packed
+	case bytes.Equal(coder.Id, szLZMACoder):
+		if len(coder.Props) != 5 {
+			return nil, errors.New("invalid LZMA properties")
+		}
+		// classic LZMA header: properties, dictionary size and unpacked size
+		header := make([]byte, 13)
+		header[0] = coder.Props[0]
+		binary.LittleEndian.PutUint32(header[1:], uint32(getDictCap(uint64(binary.LittleEndian.Uint32(coder.Props[1:])), unpackSize)))
+		binary.LittleEndian.PutUint64(header[5:], unpackSize)
+		lzmaReader, err := lzma.NewReader(io.MultiReader(bytes.NewReader(header), packed))
+		if err != nil {
+			return nil, err
+		}
+		reader = lzmaReader
+	case bytes.Equal(coder.Id, szLZMA2Coder):
+		if len(coder.Props) != 1 || coder.Props[0] > 40 {
+			return nil, errors.New("invalid LZMA2 properties")
+		}
+		dictSize := uint64(0xffffffff)
+		if coder.Props[0] < 40 {
+			dictSize = uint64(2|coder.Props[0]&1) << (coder.Props[0]/2 + 11)
+		}
+		lzma2Reader, err := lzma.Reader2Config{DictCap: getDictCap(dictSize, unpackSize)}.NewReader2(packed)
+		if err != nil {
+			return nil, err
+		}
+		reader = lzma2Reader
+	case bytes.Equal(coder.Id, szAESCoder):
+		return nil, errors.New("archive is encrypted")
+	default:
+		return nil, fmt.Errorf("7z coder %x isn't supported", coder.Id)
+	}
+	data := make([]byte, unpackSize)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+type szFile struct {
+	Name     string
+	HasData  bool
+	IsDir    bool
+	Position int
+}
+
+func (ins *inspector) filesInfo(reader *szReader) ([]szFile, error) {
+	numFiles, err := reader.count()
+	if err != nil {
+		return nil, err
+	}
+	if numFiles > ins.policy.MaxArchiveEntries {
+		return nil, errArchiveBomb
+	}
+	files := make([]szFile, numFiles)
+	emptyStream := make([]bool, numFiles)
+	var emptyFile []bool
+	for {
+		propType, err := reader.number()
+		if err != nil {
+			return nil, err
+		}
+		if propType == szEnd {
+			break
+		}
+		size, err := reader.number()
+		if err != nil {
+			return nil, err
+		}
+		propData, err := reader.bytes(size)
+		if err != nil {
+			return nil, err
+		}
+		propReader := &szReader{data: propData}
+		switch propType {
+		case szEmptyStream:
+			if emptyStream, err = propReader.bits(numFiles); err != nil {
+				return nil, err
+			}
+		case szEmptyFile:
+			numEmpty := 0
+			for _, isEmpty := range emptyStream {
+				if isEmpty {
+					numEmpty++
+				}
+			}
+			if emptyFile, err = propReader.bits(numEmpty); err != nil {
+				return nil, err
+			}
+		case szName:
+			if len(propData) == 0 || propData[0] != 0 {
+				return nil, errors.New("external 7z names aren't supported")
+			}
+			var name []uint16
+			fileIdx := 0
+			for idx := 1; idx+1 < len(propData) && fileIdx < numFiles; idx += 2 {
+				char := binary.LittleEndian.Uint16(propData[idx:])
+				if char == 0 {
+					files[fileIdx].Name = string(utf16.Decode(name))
+					name = nil
+					fileIdx++
+					continue
+				}
+				name = append(name, char)
+			}
+		}
+	}
+	emptyIdx := 0
+	for idx := range files {
+		files[idx].HasData = !emptyStream[idx]
+		if emptyStream[idx] {
+			files[idx].IsDir = emptyIdx >= len(emptyFile) || !emptyFile[emptyIdx]
+			emptyIdx++
+		}
+	}
+	return files, nil
+}
+
+func (ins *inspector) unpack7z(archive []byte) ([]archiveMember, error) {
+	if len(archive) < 32 || string(archive[:6]) != sevenZipSignature {
+		return nil, errors.New("not a 7z archive")
+	}
+	headerOffset := 32 + binary.LittleEndian.Uint64(archive[12:])
+	headerSize := binary.LittleEndian.Uint64(archive[20:])
+	if headerOffset > uint64(len(archive)) || headerSize > uint64(len(archive))-headerOffset {
+		return nil, errSevenZipTruncated
+	}
+	reader := &szReader{data: archive[headerOffset : headerOffset+headerSize]}
+	id, err := reader.byte()
+	if err != nil {
+		return nil, err
+	}
+	// the header itself is usually compressed
+	if id == szEncodedHeader {
+		info, err := reader.streamsInfo()
+		if err != nil {
+			return nil, err
+		}
+		if len(info.Folders) == 0 {
+			return nil, errors.New("7z header is corrupt")
+		}
+		header, err := ins.decodeFolder(archive, info, 0)
+		if err != nil {
+			return nil, err
+		}
+		reader = &szReader{data: header}
+		if id, err = reader.byte(); err != nil {
+			return nil, err
+		}
+	}
+	if id != szHeader {
+		return nil, errors.New("7z header is corrupt")
+	}
+
+	info := &szStreamsInfo{}
+	var files []szFile
+	for {
+		id, err := reader.byte()
+		if err != nil {
+			return nil, err
+		}
+		if id == szEnd {
+			break
+		}
+		switch id {
+		case szArchiveProperties:
+			for {
+				propType, err := reader.byte()
+				if err != nil {
+					return nil, err
+				}
+				if propType == szEnd {
+					break
+				}
+				size, err := reader.number()
+				if err != nil {
+					return nil, err
+				}
+				if _, err = reader.bytes(size); err != nil {
+					return nil, err
+				}
+			}
+		case szAdditionalStreamsInfo:
+			if _, err = reader.streamsInfo(); err != nil {
+				return nil, err
+			}
+		case szMainStreamsInfo:
+			if info, err = reader.streamsInfo(); err != nil {
+				return nil, err
+			}
+		case szFilesInfo:
+			if files, err = ins.filesInfo(reader); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected 7z property 0x%02x", id)
+		}
+	}
+
+	// files with data are stored one after another in the folders' sub streams
+	var members []archiveMember
+	folderIdx, subIdx := 0, 0
+	var folderData []byte
+	offset := uint64(0)
+	for _, file := range files {
+		if file.IsDir {
+			continue
+		}
+		if err := ins.addEntry(); err != nil {
+			return nil, err
+		}
+		if !file.HasData {
+			members = append(members, archiveMember{Path: file.Name})
+			continue
+		}
+		for folderIdx < len(info.Folders) && subIdx >= info.Folders[folderIdx].NumSubStreams {
+			folderIdx, subIdx, folderData, offset = folderIdx+1, 0, nil, 0
+		}
+		if folderIdx >= len(info.Folders) {
+			return nil, errors.New("7z header is corrupt")
+		}
+		folder := info.Folders[folderIdx]
+		if folderData == nil {
+			if folderData, err = ins.decodeFolder(archive, info, folderIdx); err != nil {
+				return nil, err
+			}
+		}
+		size := uint64(len(folderData)) - offset
+		if subIdx < len(folder.SubSizes) {
+			size = folder.SubSizes[subIdx]
+		}
+		if size > uint64(len(folderData))-offset {
+			return nil, errors.New("7z header is corrupt")
+		}
+		members = append(members, archiveMember{Path: file.Name, Data: folderData[offset : offset+size]})
+		offset += size
+		subIdx++
+	}
+	return members, nil
+}
@@ -0,0 +1,195 @@
+// subcommands for one-off tasks instead of running the server //
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.ibmgcloud.net/dth/inbound_parser/config"
+	db "github.ibmgcloud.net/dth/inbound_parser/db"
+	"github.ibmgcloud.net/dth/inbound_parser/email"
+	"github.ibmgcloud.net/dth/inbound_parser/email_loader"
+	"github.ibmgcloud.net/dth/inbound_parser/field_mapping"
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	"github.ibmgcloud.net/dth/inbound_parser/handler"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, `usage: %s [command]
+
+without a command the server is started
+
+commands:
+  import [--dry-run] [--address ADDRESS] PATH...
+        import mbox files, .eml files or directories containing them
+  unsuppress ADDRESS...
+        send emails to addresses again that have been suppressed after bouncing
+  route [--rules PATH] DUMP...
+        show which routing rules match dumped emails and where they would go
+`, os.Args[0])
+}
+
+func importCommand(cfg *glb.Config, args []string, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only parse the emails and show where they would go")
+	address := flags.String("address", "", "envelope recipient, defaults to the Delivered-To header of each email")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		printUsage()
+		return 2
+	}
+	if !*dryRun && !cfg.ParseRequests {
+		fmt.Fprintln(os.Stderr, "importing requires parse_requests, use --dry-run to only parse the emails")
+		return 1
+	}
+
+	results, err := email_loader.ImportArchives(cfg, flags.Args(), *address, *dryRun, noticedOutOfOffice, idb)
+	if err != nil {
+		lg.LogeNoMail(err)
+		return 1
+	}
+	email_loader.PrintImportSummary(results)
+	for _, result := range results {
+		if result.Outcome == string(glb.EmailFailed) {
+			return 1
+		}
+	}
+	return 0
+}
+
+func unsuppressCommand(args []string, idb *sql.DB) int {
+	if len(args) == 0 {
+		printUsage()
+		return 2
+	}
+	exitCode := 0
+	for _, address := range args {
+		found, err := db.UnsuppressAddress(idb, address)
+		if err != nil {
+			lg.LogeNoMail(err)
+			return 1
+		}
+		if found {
+			fmt.Printf("%s is no longer suppressed\n", address)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s hasn't been suppressed\n", address)
+			exitCode = 1
+		}
+	}
+	return exitCode
+}
+
+func parseDump(cfg *glb.Config, path string) (*glb.Email, error) {
+	provider := email.GetInboundProviderFromDump(path)
+	if provider == nil {
+		return nil, fmt.Errorf("no inbound provider for dump %s", path)
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := provider.GetEnvelope(body, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return email.GetParsedEmail(envelope, cfg)
+}
+
+// priority is the one set right after creating the request
+func printRoutingResult(path string, result *glb.RoutingResult, priority string) {
+	fmt.Println(path)
+	if len(result.MatchedRules) == 0 {
+		fmt.Println("  matching rules: none")
+	} else {
+		fmt.Printf("  matching rules: %s\n", strings.Join(result.MatchedRules, ", "))
+	}
+	switch {
+	case result.Drop:
+		fmt.Println("  dropped")
+	case result.ServiceDesk != nil:
+		fmt.Printf("  to servicedesk %s\n", result.ServiceDesk.ProjectKey)
+	case result.JiraInstall != nil:
+		fmt.Printf("  to jira install %s\n", result.JiraInstall.URL)
+	default:
+		fmt.Println("  not addressed to any servicedesk or jira install")
+	}
+	if result.Drop {
+		return
+	}
+	if result.RequestTypeId != "" {
+		fmt.Printf("  request type id: %s\n", result.RequestTypeId)
+	}
+	fieldIds := make([]string, 0, len(result.FieldValues))
+	for fieldId := range result.FieldValues {
+		fieldIds = append(fieldIds, fieldId)
+	}
+	sort.Strings(fieldIds)
+	for _, fieldId := range fieldIds {
+		value, _ := json.Marshal(result.FieldValues[fieldId])
+		fmt.Printf("  %s: %s\n", fieldId, value)
+	}
+	if priority != "" {
+		fmt.Printf("  priority set after creation: %s\n", priority)
+	}
+}
+
+func routeCommand(cfg *glb.Config, args []string) int {
+	flags := flag.NewFlagSet("route", flag.ExitOnError)
+	rulesPath := flags.String("rules", "", "yaml file with a list of routing rules to test instead of the config's routing_rules")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		printUsage()
+		return 2
+	}
+	if !cfg.ParseRequests || cfg.DebugParseOnly {
+		fmt.Fprintln(os.Stderr, "routing rules require parse_requests without debug_parse_only")
+		return 1
+	}
+	rules := cfg.RoutingRules
+	if *rulesPath != "" {
+		rules = config.LoadRoutingRules(cfg, *rulesPath)
+	}
+
+	exitCode := 0
+	for _, path := range flags.Args() {
+		parsedEmail, err := parseDump(cfg, path)
+		if err != nil {
+			lg.LogeNoMail(err)
+			exitCode = 1
+			continue
+		}
+		result, _ := handler.RouteEmail(cfg, rules, parsedEmail)
+		// what creating the request would do
+		priority := ""
+		if result.ServiceDesk != nil && !result.Drop {
+			result.RequestTypeId, result.FieldValues, priority = field_mapping.GetRequestFields(result.ServiceDesk, parsedEmail, result)
+		}
+		printRoutingResult(path, result, priority)
+	}
+	return exitCode
+}
+
+// return exit code when a command has been run
+// return -1 when the server should be started
+func runCommand(cfg *glb.Config, args []string, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) int {
+	if len(args) == 0 {
+		return -1
+	}
+	switch args[0] {
+	case "import":
+		return importCommand(cfg, args[1:], noticedOutOfOffice, idb)
+	case "unsuppress":
+		return unsuppressCommand(args[1:], idb)
+	case "route":
+		return routeCommand(cfg, args[1:])
+	default:
+		printUsage()
+		return 2
+	}
+}
@@ -2,13 +2,29 @@
 package config
 
 import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"html/template"
 	"log"
+	"net"
 	"net/mail"
 	"os"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	texttemplate "text/template"
 
+	"golang.org/x/crypto/openpgp"
 	"gopkg.in/yaml.v2"
 
+	"github.ibmgcloud.net/dth/inbound_parser/field_mapping"
 	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
 	"github.ibmgcloud.net/dth/inbound_parser/jira_actor"
 	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
@@ -31,32 +47,63 @@ func validateServiceDesk(srd *glb.ServiceDesk) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	srd.SubaddressRequestTypeIds = make(map[string]string)
+	for tag, requestType := range srd.SubaddressRequestTypes {
+		if tag == "" || strings.ContainsAny(tag, "+@") {
+			log.Fatalf("subaddress_request_types of servicedesk %s contains the invalid tag '%s'\n", srd.ProjectKey, tag)
+		}
+		srd.SubaddressRequestTypeIds[strings.ToLower(tag)], err = jira_actor.GetRequestTypeId(requestType, srd.Id, srd.JiraInstall.Client)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	// RequestPostfix is optional
 
 	srd.OnlyCreateEventRequests = srd.CreateEventRequests && len(srd.JiraInstall.Emails) == 0 && len(srd.Emails) == 0
 
 	if srd.OnlyCreateEventRequests {
-		if srd.RequestPostfix != "" || srd.ReplyEmailName != "" || srd.RequestCreationEmailTextPlainPath != "" || srd.ReplyAboveThis != "" {
-			log.Fatalf("request_postfix, reply_email_name, request_creation_email_text_plain_path and reply_above_this shall not be define for servicedesk %s, which is exclusively used for event requests",
+		if srd.RequestPostfix != "" || srd.ReplyEmailName != "" || srd.RequestCreationEmailTextPlainPath != "" || srd.ReplyAboveThis != "" || srd.StripQuotedReplies {
+			log.Fatalf("request_postfix, reply_email_name, request_creation_email_text_plain_path, reply_above_this and strip_quoted_replies shall not be define for servicedesk %s, which is exclusively used for event requests",
 				srd.ProjectKey)
 		}
 		return
 	}
+	if srd.AttachStrippedReplies && !srd.StripQuotedReplies {
+		log.Fatalf("attach_stripped_replies requires strip_quoted_replies in servicedesk %s\n", srd.ProjectKey)
+	}
+	validateServiceDeskKeys(srd)
+	if srd.SenderAuthFailure != "" && srd.SenderAuthFailure != "anonymous" && srd.SenderAuthFailure != "reject" && srd.SenderAuthFailure != "warn" {
+		log.Fatalf("sender_auth_failure '%s' of servicedesk %s needs to be one of anonymous, reject or warn\n", srd.SenderAuthFailure, srd.ProjectKey)
+	}
+	// no sender would ever be authenticated
+	if srd.SenderAuthFailure != "" && !SenderAuthConfigured(srd.JiraInstall.Cfg) {
+		log.Fatalf("sender_auth_failure of servicedesk %s requires trusted_authserv_ids or verify_dkim\n", srd.ProjectKey)
+	}
+	if srd.AttachmentPolicy != nil {
+		validateAttachmentPolicy(srd)
+	}
+	if srd.InlineImageFilter != nil && (srd.InlineImageFilter.MinWidth < 0 || srd.InlineImageFilter.MinHeight < 0 || srd.InlineImageFilter.MinBytes < 0) {
+		log.Fatalf("inline_image_filter of servicedesk %s can't have negative limits\n", srd.ProjectKey)
+	}
+	if srd.DeduplicateAttachments != "" && srd.DeduplicateAttachments != "inline" && srd.DeduplicateAttachments != "all" {
+		log.Fatalf("deduplicate_attachments '%s' of servicedesk %s needs to be one of inline or all\n", srd.DeduplicateAttachments, srd.ProjectKey)
+	}
+	if srd.AttachOriginalEmail != "" && srd.AttachOriginalEmail != "public" && srd.AttachOriginalEmail != "internal" {
+		log.Fatalf("attach_original_email '%s' of servicedesk %s needs to be one of public or internal\n", srd.AttachOriginalEmail, srd.ProjectKey)
+	}
+	// the original email contains the files the policy drops
+	if srd.AttachOriginalEmail == "public" && srd.AttachmentPolicy != nil {
+		log.Fatalf("attach_original_email of servicedesk %s can only be internal with an attachment_policy\n", srd.ProjectKey)
+	}
+	validateFieldMappings(srd)
+	if srd.PriorityMapping != nil {
+		validatePriorityMapping(srd)
+	}
 
 	if len(srd.Emails) == 0 && len(srd.JiraInstall.Emails) == 0 {
 		log.Fatalf("emails needs to be defined in serviceDesk %s , which isn't used for event request creation, or in jira install %s\n", srd.ProjectKey, srd.JiraInstall.URL)
 	}
-	for _, email := range srd.Emails {
-		// check no email is used twice
-		otherServiceDesk := GetServiceDeskFromMail(srd.JiraInstall.Cfg, email)
-		if otherServiceDesk != srd {
-			log.Fatalf("email %s can't be used for both %s and %s\n", email, srd.ProjectKey, otherServiceDesk.ProjectKey)
-		}
-		otherJiraInstall := GetJiraInstallFromMail(srd.JiraInstall.Cfg, email)
-		if otherJiraInstall != nil {
-			log.Fatalf("email %s can't be used for both serviceDesk %s and jira install %s\n", email, srd.ProjectKey, otherJiraInstall.URL)
-		}
-	}
+	validateAddressOverlaps(srd.JiraInstall.Cfg, srd.Emails, &glb.AddressOwner{ServiceDesk: srd, JiraInstall: srd.JiraInstall})
 	if len(srd.Emails) == 0 {
 		srd.ReplyAddress = &mail.Address{Name: srd.ReplyEmailName, Address: srd.JiraInstall.Emails[0]}
 	} else {
@@ -78,6 +125,459 @@ func validateServiceDesk(srd *glb.ServiceDesk) {
 	// DontCommentRequestStatus is optional
 }
 
+func validateFieldMappings(srd *glb.ServiceDesk) {
+	mapped := make(map[string]struct{})
+	for _, mapping := range srd.FieldMappings {
+		if mapping.Field == "" || mapping.Template == "" {
+			log.Fatalf("field and template need to be defined for every field mapping in servicedesk %s\n", srd.ProjectKey)
+		}
+		if mapping.Field == "summary" || mapping.Field == "description" {
+			log.Fatalf("field %s of servicedesk %s is filled from the email and can't be mapped\n", mapping.Field, srd.ProjectKey)
+		}
+		if _, found := mapped[mapping.Field]; found {
+			log.Fatalf("field %s is mapped multiple times in servicedesk %s\n", mapping.Field, srd.ProjectKey)
+		}
+		mapped[mapping.Field] = struct{}{}
+		var err error
+		mapping.CompiledTemplate, err = texttemplate.New(mapping.Field).Option("missingkey=zero").Parse(mapping.Template)
+		if err != nil {
+			log.Fatalf("template of field %s in servicedesk %s is invalid: %s\n", mapping.Field, srd.ProjectKey, err)
+		}
+		if mapping.BodyRegex != "" {
+			mapping.CompiledBodyRegex, err = regexp.Compile(mapping.BodyRegex)
+			if err != nil {
+				log.Fatalf("body_regex '%s' of field %s in servicedesk %s isn't a valid regex: %s\n", mapping.BodyRegex, mapping.Field, srd.ProjectKey, err)
+			}
+		}
+		// catch references to anything templates can't refer to
+		if _, err := field_mapping.Render(mapping, &glb.Email{From: &mail.Address{}}); err != nil {
+			log.Fatalf("template of field %s in servicedesk %s fails: %s\n", mapping.Field, srd.ProjectKey, err)
+		}
+	}
+
+	// routing rules need the fields as well to convert their values
+	srd.RequestTypeFields = make(map[string]map[string]*glb.RequestTypeField)
+	getRequestTypeFields(srd, srd.RequestTypeId)
+	for tag := range srd.SubaddressRequestTypes {
+		getRequestTypeFields(srd, srd.SubaddressRequestTypeIds[strings.ToLower(tag)])
+	}
+	if len(srd.FieldMappings) == 0 {
+		return
+	}
+	validateRequestTypeFields(srd, srd.RequestTypeId, srd.RequestType, nil)
+	for tag, requestType := range srd.SubaddressRequestTypes {
+		validateRequestTypeFields(srd, srd.SubaddressRequestTypeIds[strings.ToLower(tag)], requestType, nil)
+	}
+	for _, mapping := range srd.FieldMappings {
+		found := false
+		for _, fields := range srd.RequestTypeFields {
+			if _, ok := fields[mapping.Field]; ok {
+				found = true
+			}
+		}
+		if !found {
+			log.Fatalf("field %s mapped in servicedesk %s isn't a field of any of its request types\n", mapping.Field, srd.ProjectKey)
+		}
+	}
+}
+
+// fetched once per request type
+func getRequestTypeFields(srd *glb.ServiceDesk, requestTypeId string) map[string]*glb.RequestTypeField {
+	fields, found := srd.RequestTypeFields[requestTypeId]
+	if !found {
+		var err error
+		fields, err = jira_actor.GetRequestTypeFields(srd.Id, requestTypeId, srd.JiraInstall.Client)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srd.RequestTypeFields[requestTypeId] = fields
+	}
+	return fields
+}
+
+// every required field of the request type needs to be filled by a field mapping or by providedFields of a routing rule
+// mappings that may render empty need a default
+func validateRequestTypeFields(srd *glb.ServiceDesk, requestTypeId string, requestType string, providedFields map[string]struct{}) {
+	fields := getRequestTypeFields(srd, requestTypeId)
+	satisfied := make(map[string]struct{})
+	for fieldId := range providedFields {
+		satisfied[fieldId] = struct{}{}
+	}
+	for _, mapping := range srd.FieldMappings {
+		field, found := fields[mapping.Field]
+		if !found {
+			continue
+		}
+		if mapping.Default != "" {
+			if _, ok := field_mapping.ConvertValue(field, mapping.Default); !ok {
+				log.Fatalf("default '%s' of field %s in servicedesk %s isn't allowed by request type %s\n", mapping.Default, mapping.Field, srd.ProjectKey, requestType)
+			}
+			satisfied[mapping.Field] = struct{}{}
+		}
+		if value, _ := field_mapping.Render(mapping, &glb.Email{From: &mail.Address{}}); value != "" && field_mapping.IsStatic(mapping.CompiledTemplate) {
+			if _, ok := field_mapping.ConvertValue(field, value); !ok {
+				log.Fatalf("value '%s' of field %s in servicedesk %s isn't allowed by request type %s\n", value, mapping.Field, srd.ProjectKey, requestType)
+			}
+			satisfied[mapping.Field] = struct{}{}
+		}
+	}
+	for fieldId, field := range fields {
+		if _, found := satisfied[fieldId]; !field.Required || found || fieldId == "summary" || fieldId == "description" {
+			continue
+		}
+		log.Fatalf("required field %s (%s) of request type %s in servicedesk %s needs a field mapping with a default or a static template\n", fieldId, field.Name, requestType, srd.ProjectKey)
+	}
+}
+
+func validatePriorityMapping(srd *glb.ServiceDesk) {
+	mapping := srd.PriorityMapping
+	if mapping.High == "" && mapping.Low == "" && len(mapping.Keywords) == 0 {
+		log.Fatalf("priority_mapping of servicedesk %s needs high, low or keywords\n", srd.ProjectKey)
+	}
+	priorities, err := jira_actor.GetPriorities(srd.JiraInstall.Client)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mapping.PriorityRanks = make(map[string]int)
+	for rank, priority := range priorities {
+		mapping.PriorityRanks[priority] = rank
+	}
+	// use jira's spelling
+	getPriority := func(priority string) string {
+		for _, jiraPriority := range priorities {
+			if strings.EqualFold(jiraPriority, priority) {
+				return jiraPriority
+			}
+		}
+		log.Fatalf("priority '%s' in priority_mapping of servicedesk %s doesn't exist in jira install %s\n", priority, srd.ProjectKey, srd.JiraInstall.URL)
+		return ""
+	}
+	if mapping.High != "" {
+		mapping.High = getPriority(mapping.High)
+	}
+	if mapping.Low != "" {
+		mapping.Low = getPriority(mapping.Low)
+	}
+	for keyword, priority := range mapping.Keywords {
+		if strings.TrimSpace(keyword) == "" {
+			log.Fatalf("keywords in priority_mapping of servicedesk %s can't be empty\n", srd.ProjectKey)
+		}
+		mapping.Keywords[keyword] = getPriority(priority)
+	}
+}
+
+func validateAttachmentPolicy(srd *glb.ServiceDesk) {
+	policy := srd.AttachmentPolicy
+	if policy.MaxFileBytes < 0 || policy.MaxTotalBytes < 0 {
+		log.Fatalf("max_file_bytes and max_total_bytes can't be negative in servicedesk %s\n", srd.ProjectKey)
+	}
+	if len(policy.AllowedTypes) != 0 && len(policy.DeniedTypes) != 0 {
+		log.Fatalf("only one of allowed_types and denied_types may be defined in servicedesk %s\n", srd.ProjectKey)
+	}
+	if !policy.InspectArchives {
+		if policy.MaxArchiveDepth != 0 || policy.MaxArchiveEntries != 0 || policy.MaxArchiveUnpackedBytes != 0 || policy.DropUninspectableArchives {
+			log.Fatalf("max_archive_depth, max_archive_entries, max_archive_unpacked_bytes and drop_uninspectable_archives require inspect_archives in servicedesk %s\n", srd.ProjectKey)
+		}
+		return
+	}
+	if policy.MaxArchiveDepth == 0 {
+		policy.MaxArchiveDepth = 3
+	}
+	if policy.MaxArchiveEntries == 0 {
+		policy.MaxArchiveEntries = 10000
+	}
+	if policy.MaxArchiveUnpackedBytes == 0 {
+		policy.MaxArchiveUnpackedBytes = 100 << 20
+	}
+	if policy.MaxArchiveDepth < 0 || policy.MaxArchiveEntries < 0 || policy.MaxArchiveUnpackedBytes < 0 {
+		log.Fatalf("max_archive_depth, max_archive_entries and max_archive_unpacked_bytes need to be bigger than 0 in servicedesk %s\n", srd.ProjectKey)
+	}
+}
+
+// pkcs7 only supports decryption with RSA keys
+func parseRSAPrivateKey(keyPEM []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA private key")
+	}
+	return rsaKey, nil
+}
+
+func validateServiceDeskKeys(srd *glb.ServiceDesk) {
+	if (srd.SMIMECertPath == "") != (srd.SMIMEKeyPath == "") {
+		log.Fatalf("either both smime_cert_path and smime_key_path need to be defined or neither in servicedesk %s\n", srd.ProjectKey)
+	}
+	if srd.SMIMECertPath != "" {
+		certPEM, err := os.ReadFile(srd.SMIMECertPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		block, _ := pem.Decode(certPEM)
+		if block == nil {
+			log.Fatalf("'%s' specified by smime_cert_path doesn't contain a PEM certificate for servicedesk %s\n", srd.SMIMECertPath, srd.ProjectKey)
+		}
+		srd.SMIMECert, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		keyPEM, err := os.ReadFile(srd.SMIMEKeyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srd.SMIMEKey, err = parseRSAPrivateKey(keyPEM)
+		if err != nil {
+			log.Fatalf("'%s' specified by smime_key_path isn't a valid key for servicedesk %s: %s\n", srd.SMIMEKeyPath, srd.ProjectKey, err)
+		}
+	}
+
+	if srd.PGPKeyPath == "" {
+		if srd.PGPKeyPassphrase != "" {
+			log.Fatalf("pgp_key_passphrase requires pgp_key_path in servicedesk %s\n", srd.ProjectKey)
+		}
+		return
+	}
+	keyFile, err := os.Open(srd.PGPKeyPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer keyFile.Close()
+	entities, err := openpgp.ReadArmoredKeyRing(keyFile)
+	if err != nil {
+		log.Fatalf("'%s' specified by pgp_key_path isn't an armored key for servicedesk %s: %s\n", srd.PGPKeyPath, srd.ProjectKey, err)
+	}
+	if len(entities) != 1 || entities[0].PrivateKey == nil {
+		log.Fatalf("'%s' specified by pgp_key_path needs to contain exactly one private key for servicedesk %s\n", srd.PGPKeyPath, srd.ProjectKey)
+	}
+	srd.PGPKey = entities[0]
+	// the key is decrypted once so emails can be decrypted without the passphrase
+	passphrase := []byte(srd.PGPKeyPassphrase)
+	if srd.PGPKey.PrivateKey.Encrypted {
+		if err := srd.PGPKey.PrivateKey.Decrypt(passphrase); err != nil {
+			log.Fatalf("failed to decrypt pgp key of servicedesk %s: %s\n", srd.ProjectKey, err)
+		}
+	}
+	for _, subkey := range srd.PGPKey.Subkeys {
+		if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
+			if err := subkey.PrivateKey.Decrypt(passphrase); err != nil {
+				log.Fatalf("failed to decrypt pgp subkey of servicedesk %s: %s\n", srd.ProjectKey, err)
+			}
+		}
+	}
+}
+
+// CAs and keys signatures are verified against
+func validateSignatureTrust(cfg *glb.Config) {
+	var err error
+	if cfg.SMIMECAPath == "" {
+		cfg.SMIMECAs, err = x509.SystemCertPool()
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		caPEM, err := os.ReadFile(cfg.SMIMECAPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.SMIMECAs = x509.NewCertPool()
+		if !cfg.SMIMECAs.AppendCertsFromPEM(caPEM) {
+			log.Fatalf("'%s' specified by smime_ca_path doesn't contain any PEM certificates\n", cfg.SMIMECAPath)
+		}
+	}
+
+	if cfg.PGPKeyringPath != "" {
+		keyringFile, err := os.Open(cfg.PGPKeyringPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer keyringFile.Close()
+		cfg.PGPKeyring, err = openpgp.ReadArmoredKeyRing(keyringFile)
+		if err != nil {
+			log.Fatalf("'%s' specified by pgp_keyring_path isn't an armored keyring: %s\n", cfg.PGPKeyringPath, err)
+		}
+	}
+}
+
+func getOwnerName(owner *glb.AddressOwner) string {
+	if owner.ServiceDesk != nil {
+		return "servicedesk " + owner.ServiceDesk.ProjectKey
+	}
+	return "jira install " + owner.JiraInstall.URL
+}
+
+func isSameOwner(owner *glb.AddressOwner, otherOwner *glb.AddressOwner) bool {
+	return owner.ServiceDesk == otherOwner.ServiceDesk && owner.JiraInstall == otherOwner.JiraInstall
+}
+
+// emails are either an address, a catch-all like *@example.com or a /regex/ matching the entire address
+// return the normalized address, the catch-all's domain or the compiled regex
+func parseAddressPattern(email string) (string, string, *regexp.Regexp) {
+	email = strings.TrimSpace(email)
+	if len(email) > 2 && strings.HasPrefix(email, "/") && strings.HasSuffix(email, "/") {
+		re, err := regexp.Compile("(?i)^(?:" + email[1:len(email)-1] + ")$")
+		if err != nil {
+			log.Fatalf("email '%s' isn't a valid regex: %s\n", email, err)
+		}
+		return "", "", re
+	}
+	if strings.HasPrefix(email, "*@") {
+		return "", NormalizeAddress(email[2:]), nil
+	}
+	return NormalizeAddress(email), "", nil
+}
+
+// how many alternatives of a regex's suffix are analyzed before giving up
+const maxRegexSuffixes = 64
+
+// every match of the node ends with one of the returned strings
+// exact is true when the node matches nothing but them
+func regexSuffixes(node *syntax.Regexp) ([]string, bool) {
+	switch node.Op {
+	case syntax.OpLiteral:
+		return []string{strings.ToLower(string(node.Rune))}, true
+	case syntax.OpEmptyMatch, syntax.OpBeginText, syntax.OpEndText, syntax.OpBeginLine, syntax.OpEndLine:
+		return []string{""}, true
+	case syntax.OpCapture:
+		return regexSuffixes(node.Sub[0])
+	case syntax.OpAlternate:
+		var suffixes []string
+		exact := true
+		for _, sub := range node.Sub {
+			subSuffixes, subExact := regexSuffixes(sub)
+			suffixes = append(suffixes, subSuffixes...)
+			exact = exact && subExact
+		}
+		if len(suffixes) > maxRegexSuffixes {
+			return []string{""}, false
+		}
+		return suffixes, exact
+	case syntax.OpConcat:
+		suffixes := []string{""}
+		for idx := len(node.Sub) - 1; idx >= 0; idx-- {
+			subSuffixes, subExact := regexSuffixes(node.Sub[idx])
+			if len(subSuffixes)*len(suffixes) > maxRegexSuffixes {
+				return suffixes, false
+			}
+			var joined []string
+			for _, subSuffix := range subSuffixes {
+				for _, suffix := range suffixes {
+					joined = append(joined, subSuffix+suffix)
+				}
+			}
+			suffixes = joined
+			if !subExact {
+				return suffixes, false
+			}
+		}
+		return suffixes, true
+	}
+	// anything repeated or a character class
+	return []string{""}, false
+}
+
+// return false only when no address of the domain can match the email regex
+func regexMayMatchDomain(re *regexp.Regexp, domain string) bool {
+	node, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return true
+	}
+	suffixes, _ := regexSuffixes(node.Simplify())
+	for _, suffix := range suffixes {
+		// the suffix contains the entire domain after its @
+		if at := strings.LastIndex(suffix, "@"); at != -1 {
+			if suffix[at+1:] == domain {
+				return true
+			}
+		} else if strings.HasSuffix(domain, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// index the emails of all servicedesks and jira installs, overlaps are detected when validating them
+func indexAddresses(cfg *glb.Config) {
+	cfg.AddressIndex = &glb.AddressIndex{
+		Exact:    make(map[string]*glb.AddressOwner),
+		CatchAll: make(map[string]*glb.AddressOwner),
+	}
+	addEmails := func(emails []string, owner *glb.AddressOwner) {
+		for _, email := range emails {
+			address, catchAllDomain, re := parseAddressPattern(email)
+			switch {
+			case re != nil:
+				cfg.AddressIndex.Regexes = append(cfg.AddressIndex.Regexes, &glb.AddressRegex{Regex: re, Owner: owner})
+			case catchAllDomain != "":
+				if _, found := cfg.AddressIndex.CatchAll[catchAllDomain]; !found {
+					cfg.AddressIndex.CatchAll[catchAllDomain] = owner
+				}
+			default:
+				if _, found := cfg.AddressIndex.Exact[address]; !found {
+					cfg.AddressIndex.Exact[address] = owner
+				}
+			}
+		}
+	}
+	// servicedesks take precedence as they have been looked up first before
+	for _, jiraInstall := range cfg.JiraInstalls {
+		for _, srd := range jiraInstall.ServiceDesks {
+			addEmails(srd.Emails, &glb.AddressOwner{ServiceDesk: srd, JiraInstall: jiraInstall})
+		}
+	}
+	for _, jiraInstall := range cfg.JiraInstalls {
+		addEmails(jiraInstall.Emails, &glb.AddressOwner{JiraInstall: jiraInstall})
+	}
+}
+
+// no address, catch-all or regex may be used by another servicedesk or jira install
+func validateAddressOverlaps(cfg *glb.Config, emails []string, owner *glb.AddressOwner) {
+	index := cfg.AddressIndex
+	for idx, email := range emails {
+		address, catchAllDomain, re := parseAddressPattern(email)
+		if idx == 0 && address == "" {
+			log.Fatalf("the first email of %s is used to reply, it can't be the catch-all or regex '%s'\n", getOwnerName(owner), email)
+		}
+		switch {
+		case re != nil:
+			// regexes are tried in order, an address of another one would be ambiguous
+			for exactAddress, otherOwner := range index.Exact {
+				if !isSameOwner(owner, otherOwner) && re.MatchString(exactAddress) {
+					log.Fatalf("email regex '%s' of %s also matches %s of %s\n", email, getOwnerName(owner), exactAddress, getOwnerName(otherOwner))
+				}
+			}
+			for _, otherRegex := range index.Regexes {
+				if !isSameOwner(owner, otherRegex.Owner) && otherRegex.Regex.String() == re.String() {
+					log.Fatalf("email regex '%s' can't be used for both %s and %s\n", email, getOwnerName(owner), getOwnerName(otherRegex.Owner))
+				}
+			}
+			// catch-alls are only tried when no regex matches
+			for otherDomain, otherOwner := range index.CatchAll {
+				if !isSameOwner(owner, otherOwner) && regexMayMatchDomain(re, otherDomain) {
+					log.Fatalf("email regex '%s' of %s may match addresses of the catch-all *@%s of %s\n", email, getOwnerName(owner), otherDomain, getOwnerName(otherOwner))
+				}
+			}
+		case catchAllDomain != "":
+			if otherOwner := index.CatchAll[catchAllDomain]; !isSameOwner(owner, otherOwner) {
+				log.Fatalf("email %s can't be used for both %s and %s\n", email, getOwnerName(owner), getOwnerName(otherOwner))
+			}
+		default:
+			if otherOwner := index.Exact[address]; !isSameOwner(owner, otherOwner) {
+				log.Fatalf("email %s can't be used for both %s and %s\n", email, getOwnerName(owner), getOwnerName(otherOwner))
+			}
+		}
+	}
+}
+
 func validateJiraInstall(jiraInstall *glb.JiraInstall) {
 	if jiraInstall.Token == "" {
 		log.Fatalf("token needs to be defined for every jira install\n")
@@ -100,18 +600,7 @@ func validateJiraInstall(jiraInstall *glb.JiraInstall) {
 		lg.Logf("warning: no admin token has been provided, customer creation is disabled")
 	}
 
-	for _, email := range jiraInstall.Emails {
-		// check no email is used twice
-		// this first check is redundant as the servicedesk already check for jira installs with the same address
-		otherServiceDesk := GetServiceDeskFromMail(jiraInstall.Cfg, email)
-		if otherServiceDesk != nil {
-			log.Fatalf("email %s can't be used for both %s and %s\n", email, jiraInstall.URL, otherServiceDesk.ProjectKey)
-		}
-		otherJiraInstall := GetJiraInstallFromMail(jiraInstall.Cfg, email)
-		if otherJiraInstall != jiraInstall {
-			log.Fatalf("email %s can't be used for both jira install %s and jira install %s\n", email, jiraInstall.URL, otherJiraInstall.URL)
-		}
-	}
+	validateAddressOverlaps(jiraInstall.Cfg, jiraInstall.Emails, &glb.AddressOwner{JiraInstall: jiraInstall})
 	if len(jiraInstall.Emails) != 0 {
 		// RejectedMailSubject may be left blank
 
@@ -126,6 +615,331 @@ func validateJiraInstall(jiraInstall *glb.JiraInstall) {
 		srd.JiraInstall = jiraInstall
 		validateServiceDesk(srd)
 	}
+	validateIssueKeyExtraction(jiraInstall)
+}
+
+func validateIssueKeyExtraction(jiraInstall *glb.JiraInstall) {
+	if len(jiraInstall.IssueKeyPatterns) == 0 {
+		jiraInstall.IssueKeyPatterns = []string{`[A-Z][A-Z0-9_]+-\d+`}
+	}
+	for _, pattern := range jiraInstall.IssueKeyPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Fatalf("issue_key_patterns '%s' of jira install %s isn't a valid regex: %s\n", pattern, jiraInstall.URL, err)
+		}
+		if re.NumSubexp() > 1 {
+			log.Fatalf("issue_key_patterns '%s' of jira install %s may contain at most one capture group\n", pattern, jiraInstall.URL)
+		}
+		jiraInstall.IssueKeyRegexes = append(jiraInstall.IssueKeyRegexes, re)
+	}
+	if len(jiraInstall.IssueKeyLocations) == 0 {
+		jiraInstall.IssueKeyLocations = []string{"subject"}
+	}
+	for _, location := range jiraInstall.IssueKeyLocations {
+		if strings.TrimSpace(location) == "" {
+			log.Fatalf("issue_key_locations of jira install %s may not contain empty entries\n", jiraInstall.URL)
+		}
+	}
+	// keys of other projects can't belong to a registered serviceDesk anyways
+	jiraInstall.IssueKeyProjects = make(map[string]struct{})
+	for _, srd := range jiraInstall.ServiceDesks {
+		jiraInstall.IssueKeyProjects[srd.ProjectKey] = struct{}{}
+	}
+}
+
+func validateIMAPMailbox(imapMailbox *glb.IMAPMailbox) {
+	if imapMailbox.Host == "" {
+		log.Fatal("host needs to be defined for every imap mailbox")
+	}
+	if imapMailbox.Port == 0 {
+		log.Fatalf("port needs to be defined for imap mailbox on %s\n", imapMailbox.Host)
+	}
+	if imapMailbox.Security != "tls" && imapMailbox.Security != "starttls" && imapMailbox.Security != "none" {
+		log.Fatalf("security needs to be one of tls, starttls or none for imap mailbox on %s\n", imapMailbox.Host)
+	}
+	if imapMailbox.Username == "" || imapMailbox.Password == "" {
+		log.Fatalf("username and password need to be defined for imap mailbox on %s\n", imapMailbox.Host)
+	}
+	if imapMailbox.Mailbox == "" {
+		imapMailbox.Mailbox = "INBOX"
+	}
+	// Address and the mailboxes to move to are optional
+}
+
+func isDir(path string) bool {
+	fileInfo, err := os.Stat(path)
+	return err == nil && fileInfo.IsDir()
+}
+
+func validateSpoolDir(spoolDir *glb.SpoolDir) {
+	switch spoolDir.Format {
+	case "maildir":
+		for _, subDir := range []string{"new", "cur"} {
+			if !isDir(filepath.Join(spoolDir.Path, subDir)) {
+				log.Fatalf("'%s' specified by path in spool_dirs isn't a maildir, %s/ is missing\n", spoolDir.Path, subDir)
+			}
+		}
+	case "eml":
+		if !isDir(spoolDir.Path) {
+			log.Fatalf("'%s' specified by path in spool_dirs doesn't point to a directory\n", spoolDir.Path)
+		}
+		if spoolDir.ArchiveDir == "" {
+			log.Fatalf("archive_dir needs to be defined for eml spool dir %s\n", spoolDir.Path)
+		}
+	default:
+		log.Fatalf("format needs to be one of maildir or eml for spool dir %s\n", spoolDir.Path)
+	}
+	if spoolDir.ArchiveDir != "" && !isDir(spoolDir.ArchiveDir) {
+		log.Fatalf("'%s' specified by archive_dir in spool_dirs doesn't point to a directory\n", spoolDir.ArchiveDir)
+	}
+	// Address is optional
+}
+
+func validateInboundWebhooks(cfg *glb.Config) {
+	if len(cfg.InboundWebhooks) == 0 {
+		lg.Logf("no inbound_webhooks defined, using sendgrid on /inbound")
+		cfg.InboundWebhooks = []*glb.InboundWebhook{{Provider: "sendgrid", Path: "/inbound", Token: cfg.SendgridToken}}
+		return
+	}
+	paths := make(map[string]struct{})
+	for _, webhook := range cfg.InboundWebhooks {
+		if webhook.Provider != "sendgrid" && webhook.Provider != "mailgun" && webhook.Provider != "postmark" {
+			log.Fatalf("provider '%s' of inbound webhook needs to be one of sendgrid, mailgun or postmark\n", webhook.Provider)
+		}
+		if !strings.HasPrefix(webhook.Path, "/") {
+			log.Fatalf("path of %s inbound webhook needs to start with /\n", webhook.Provider)
+		}
+		// /event and /event/<source name> are used by the event sources
+		if webhook.Path == "/event" || strings.HasPrefix(webhook.Path, "/event/") {
+			log.Fatalf("path of %s inbound webhook can't be /event or start with /event/\n", webhook.Provider)
+		}
+		if _, found := paths[webhook.Path]; found {
+			log.Fatalf("path %s is used by multiple inbound webhooks\n", webhook.Path)
+		}
+		paths[webhook.Path] = struct{}{}
+		if webhook.Token == "" {
+			log.Fatalf("token needs to be defined for %s inbound webhook on %s\n", webhook.Provider, webhook.Path)
+		}
+		if webhook.Provider != "mailgun" && (webhook.SigningKey != "" || webhook.APIKey != "") {
+			log.Fatalf("signing_key and api_key can only be defined for mailgun, not for %s inbound webhook on %s\n", webhook.Provider, webhook.Path)
+		}
+		// the api key is sent to the url in the notification
+		if webhook.APIKey != "" && webhook.SigningKey == "" {
+			log.Fatalf("api_key requires signing_key for mailgun inbound webhook on %s\n", webhook.Path)
+		}
+	}
+}
+
+// the key is shown base64 encoded in sendgrid's mail settings, PEM is accepted as well
+func parseECDSAPublicKey(encodedKey string) (*ecdsa.PublicKey, error) {
+	var der []byte
+	if block, _ := pem.Decode([]byte(encodedKey)); block != nil {
+		der = block.Bytes
+	} else {
+		var err error
+		der, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encodedKey))
+		if err != nil {
+			return nil, err
+		}
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an ECDSA public key")
+	}
+	return ecdsaKey, nil
+}
+
+func validateSendgridEventKey(cfg *glb.Config) {
+	if cfg.SendgridEventPublicKey == "" {
+		if cfg.EventTokenFallback {
+			log.Fatal("event_token_fallback requires sendgrid_event_public_key to be defined")
+		}
+		lg.Logf("no sendgrid_event_public_key defined, events are only authenticated with the token")
+		return
+	}
+	var err error
+	cfg.SendgridEventKey, err = parseECDSAPublicKey(cfg.SendgridEventPublicKey)
+	if err != nil {
+		log.Fatalf("sendgrid_event_public_key isn't a valid ECDSA public key: %s\n", err)
+	}
+	if cfg.SendgridEventMaxAgeSeconds == 0 {
+		cfg.SendgridEventMaxAgeSeconds = 300
+	}
+	if cfg.SendgridEventMaxAgeSeconds < 0 {
+		log.Fatal("sendgrid_event_max_age_seconds needs to be bigger than 0")
+	}
+}
+
+var eventSourceNameRegex = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+func validateEventSources(cfg *glb.Config) {
+	names := make(map[string]struct{})
+	for _, source := range cfg.EventSources {
+		if !eventSourceNameRegex.MatchString(source.Name) {
+			log.Fatalf("name '%s' of event source may only contain lowercase letters, digits, _ and -\n", source.Name)
+		}
+		if source.Name == glb.SendgridEventSource || source.Name == glb.LegacyEventSource {
+			log.Fatalf("name '%s' of event source is reserved\n", source.Name)
+		}
+		if _, found := names[source.Name]; found {
+			log.Fatalf("name '%s' is used by multiple event sources\n", source.Name)
+		}
+		names[source.Name] = struct{}{}
+		if source.Secret == "" {
+			log.Fatalf("secret needs to be defined for event source %s\n", source.Name)
+		}
+		if source.SignatureHeader == "" {
+			source.SignatureHeader = "X-Inbound-Parser-Signature"
+		}
+		// Token is optional
+		if source.Parser != "" && source.Parser != "sendgrid" && source.Parser != "github_monitor" && source.Parser != "jira_cve" && source.Parser != "sysdig" {
+			log.Fatalf("parser '%s' of event source %s needs to be one of sendgrid, github_monitor, jira_cve or sysdig\n", source.Parser, source.Name)
+		}
+		lg.Logf("receiving events from %s on /event/%s", source.Name, source.Name)
+	}
+}
+
+// yaml maps are decoded with interface keys, jira needs them as json objects
+func convertYAMLValue(value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{})
+		for key, nestedValue := range typedValue {
+			converted[fmt.Sprint(key)] = convertYAMLValue(nestedValue)
+		}
+		return converted
+	case []interface{}:
+		converted := make([]interface{}, len(typedValue))
+		for idx, nestedValue := range typedValue {
+			converted[idx] = convertYAMLValue(nestedValue)
+		}
+		return converted
+	}
+	return value
+}
+
+func validateRoutingRule(cfg *glb.Config, rule *glb.RoutingRule) {
+	if rule.Name == "" {
+		log.Fatal("name needs to be defined for every routing rule")
+	}
+	var err error
+	if rule.Match.Subject != "" {
+		rule.Match.SubjectRegex, err = regexp.Compile(rule.Match.Subject)
+		if err != nil {
+			log.Fatalf("subject '%s' of routing rule %s isn't a valid regex: %s\n", rule.Match.Subject, rule.Name, err)
+		}
+	}
+	if rule.Match.Body != "" {
+		rule.Match.BodyRegex, err = regexp.Compile(rule.Match.Body)
+		if err != nil {
+			log.Fatalf("body '%s' of routing rule %s isn't a valid regex: %s\n", rule.Match.Body, rule.Name, err)
+		}
+	}
+
+	actions := &rule.Actions
+	for fieldId, value := range actions.CustomFields {
+		actions.CustomFields[fieldId] = convertYAMLValue(value)
+	}
+	if actions.ServiceDesk != "" {
+		actions.Srd = GetServiceDeskFromProjectKey(cfg, actions.ServiceDesk)
+		if actions.Srd == nil {
+			log.Fatalf("servicedesk %s of routing rule %s doesn't exist or only creates event requests\n", actions.ServiceDesk, rule.Name)
+		}
+		for _, jiraInstall := range cfg.JiraInstalls {
+			for _, srd := range jiraInstall.ServiceDesks {
+				if srd.ProjectKey == actions.ServiceDesk && !srd.OnlyCreateEventRequests && srd != actions.Srd {
+					log.Fatalf("servicedesk %s of routing rule %s exists in multiple jira installs, use forward_to with one of its addresses instead\n", actions.ServiceDesk, rule.Name)
+				}
+			}
+		}
+	}
+	if actions.RequestType != "" {
+		if actions.Srd == nil {
+			log.Fatalf("request_type requires servicedesk in routing rule %s\n", rule.Name)
+		}
+		actions.RequestTypeId, err = jira_actor.GetRequestTypeId(actions.RequestType, actions.Srd.Id, actions.Srd.JiraInstall.Client)
+		if err != nil {
+			log.Fatal(err)
+		}
+		providedValues := make(map[string]interface{})
+		for fieldId, value := range actions.CustomFields {
+			providedValues[fieldId] = value
+		}
+		if actions.Priority != "" {
+			providedValues["priority"] = actions.Priority
+		}
+		if len(actions.Labels) != 0 {
+			providedValues["labels"] = actions.Labels
+		}
+		if len(actions.Components) != 0 {
+			providedValues["components"] = actions.Components
+		}
+		fields := getRequestTypeFields(actions.Srd, actions.RequestTypeId)
+		providedFields := make(map[string]struct{})
+		for fieldId, value := range providedValues {
+			field, found := fields[fieldId]
+			// the priority is set after the creation when the request type has no priority field
+			if !found && fieldId != "priority" {
+				log.Fatalf("field %s of routing rule %s isn't a field of request type %s\n", fieldId, rule.Name, actions.RequestType)
+			}
+			if _, ok := field_mapping.ConvertRoutingValue(field, value); found && !ok {
+				log.Fatalf("value '%v' of field %s in routing rule %s isn't allowed by request type %s\n", value, fieldId, rule.Name, actions.RequestType)
+			}
+			providedFields[fieldId] = struct{}{}
+		}
+		if len(actions.Srd.FieldMappings) != 0 {
+			validateRequestTypeFields(actions.Srd, actions.RequestTypeId, actions.RequestType, providedFields)
+		}
+	}
+	if actions.ForwardTo != "" {
+		if actions.Srd != nil {
+			log.Fatalf("routing rule %s can't have both servicedesk and forward_to\n", rule.Name)
+		}
+		actions.ForwardServiceDesk = GetServiceDeskFromMail(cfg, actions.ForwardTo)
+		actions.ForwardJiraInstall = GetJiraInstallFromMail(cfg, actions.ForwardTo)
+		if actions.ForwardServiceDesk != nil {
+			actions.ForwardJiraInstall = actions.ForwardServiceDesk.JiraInstall
+		}
+		if actions.ForwardJiraInstall == nil {
+			log.Fatalf("forward_to %s of routing rule %s isn't the address of any servicedesk or jira install\n", actions.ForwardTo, rule.Name)
+		}
+	}
+	if actions.Drop && (actions.Srd != nil || actions.ForwardTo != "" || actions.Priority != "" || len(actions.Labels) != 0 || len(actions.Components) != 0 || len(actions.CustomFields) != 0) {
+		log.Fatalf("routing rule %s drops emails, it can't have any other actions\n", rule.Name)
+	}
+}
+
+// rules need to be validated after the jira installs
+func validateRoutingRules(cfg *glb.Config, rules []*glb.RoutingRule) {
+	names := make(map[string]struct{})
+	for _, rule := range rules {
+		validateRoutingRule(cfg, rule)
+		if _, found := names[rule.Name]; found {
+			log.Fatalf("name '%s' is used by multiple routing rules\n", rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+	}
+}
+
+// read and validate routing rules from a file other than the config, e.g. to test them
+func LoadRoutingRules(cfg *glb.Config, path string) []*glb.RoutingRule {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		lg.LogeNoMail(err)
+		log.Fatalf("Couldn't read routing rules file '%s'\n", path)
+	}
+	var rules []*glb.RoutingRule
+	err = yaml.Unmarshal(file, &rules)
+	if err != nil {
+		lg.LogeNoMail(err)
+		log.Fatal("Failed to parse yaml routing rules file.")
+	}
+	validateRoutingRules(cfg, rules)
+	return rules
 }
 
 func validateConfig(cfg *glb.Config) {
@@ -141,13 +955,21 @@ func validateConfig(cfg *glb.Config) {
 			log.Fatal("clamav_scandir needs to be defined")
 		}
 	}
-	if fileInfo, err := os.Stat(cfg.DumpDir); err != nil || !fileInfo.IsDir() {
+	if !isDir(cfg.DumpDir) {
 		log.Fatalf("'%s' specified by dump_dir in the config doesn't point to a directory\n", cfg.DumpDir)
 	}
 
+	validateSignatureTrust(cfg)
+
 	if cfg.MaxSpamScore <= 0 {
 		log.Fatal("spam score needs to be defined and bigger than 0")
 	}
+	if cfg.MaxForwardDepth == 0 {
+		cfg.MaxForwardDepth = 3
+	}
+	if cfg.MaxForwardDepth < 0 {
+		log.Fatal("max_forward_depth needs to be bigger than 0")
+	}
 
 	if cfg.DumpRequests {
 		if cfg.Port == 0 {
@@ -157,8 +979,68 @@ func validateConfig(cfg *glb.Config) {
 			log.Fatal("domain needs to be defined")
 		}
 		// certs get checked by golang http
+		validateInboundWebhooks(cfg)
+	}
+
+	if cfg.SMTPServer {
+		if !cfg.DumpRequests {
+			log.Fatal("smtp_server requires dump_requests to be set to true")
+		}
+		if cfg.SMTPPort == 0 {
+			log.Fatal("smtp_port needs to be defined")
+		}
+		if cfg.SMTPPort == cfg.Port {
+			log.Fatal("smtp_port and port can't be the same")
+		}
+		if cfg.SMTPMaxMessageBytes <= 0 {
+			log.Fatal("smtp_max_message_bytes needs to be defined and bigger than 0")
+		}
+		// SMTPAllowedNetworks is optional, only local clients are allowed when empty
+		if len(cfg.SMTPAllowedNetworks) == 0 {
+			cfg.SMTPAllowedNetworks = []string{"127.0.0.0/8", "::1/128"}
+		}
+		for _, network := range cfg.SMTPAllowedNetworks {
+			_, ipNet, err := net.ParseCIDR(network)
+			if err != nil {
+				log.Fatalf("'%s' in smtp_allowed_networks isn't a valid CIDR network: %s\n", network, err)
+			}
+			cfg.SMTPAllowedIPNets = append(cfg.SMTPAllowedIPNets, ipNet)
+		}
+		if cfg.SMTPStartTLS {
+			cert, err := tls.LoadX509KeyPair(cfg.SSLCert, cfg.SSLKey)
+			if err != nil {
+				log.Fatalf("smtp_starttls requires ssl_cert and ssl_key to be a valid key pair: %s\n", err)
+			}
+			cfg.SMTPTLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+	}
+
+	if len(cfg.IMAPMailboxes) != 0 {
+		if !cfg.DumpRequests {
+			log.Fatal("imap_mailboxes requires dump_requests to be set to true")
+		}
+		if cfg.IMAPPollIntervalSeconds <= 0 {
+			log.Fatal("imap_poll_interval_seconds needs to be defined and bigger than 0")
+		}
+		for _, imapMailbox := range cfg.IMAPMailboxes {
+			validateIMAPMailbox(imapMailbox)
+		}
+	}
+
+	if len(cfg.SpoolDirs) != 0 {
+		if !cfg.DumpRequests {
+			log.Fatal("spool_dirs requires dump_requests to be set to true")
+		}
+		if cfg.SpoolPollIntervalSeconds <= 0 {
+			log.Fatal("spool_poll_interval_seconds needs to be defined and bigger than 0")
+		}
+		for _, spoolDir := range cfg.SpoolDirs {
+			validateSpoolDir(spoolDir)
+		}
 	}
 
+	// the smtp server needs to know the addresses even when not parsing
+	indexAddresses(cfg)
 	// ignore jira_install in debug parse mode
 	if cfg.ParseRequests && !cfg.DebugParseOnly {
 		for _, jiraInstall := range cfg.JiraInstalls {
@@ -168,6 +1050,7 @@ func validateConfig(cfg *glb.Config) {
 		if cfg.MaxParticipants == 0 {
 			log.Fatal("max_participants must be defined")
 		}
+		validateRoutingRules(cfg, cfg.RoutingRules)
 	}
 
 	if cfg.SendEmails {
@@ -195,6 +1078,8 @@ func validateConfig(cfg *glb.Config) {
 			log.Fatal("At least one servicedesk needs to have create_event_requests set\n")
 		}
 		lg.Logf("Using servicedesk %s for event request creation", cfg.HandleEventsSrd.ProjectKey)
+		validateSendgridEventKey(cfg)
+		validateEventSources(cfg)
 	}
 }
 
@@ -2,21 +2,83 @@
 package config
 
 import (
+	"net/mail"
+	"strings"
+
 	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
 )
 
+// split ilc+bug@example.com into ilc@example.com and bug
+// the tag is empty when the address has none
+func SplitSubaddress(address string) (string, string) {
+	at := strings.LastIndex(address, "@")
+	if at == -1 {
+		return address, ""
+	}
+	localPart, tag, found := strings.Cut(address[:at], "+")
+	if !found {
+		return address, ""
+	}
+	return localPart + address[at:], tag
+}
+
+func NormalizeAddress(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+// find who the address belongs to, exact addresses first, then the address without subaddress, regexes and catch-alls
+// also return the tag when the address is a subaddress that isn't configured itself
+func lookupAddress(cfg *glb.Config, address string) (*glb.AddressOwner, string) {
+	index := cfg.AddressIndex
+	if index == nil {
+		return nil, ""
+	}
+	address = NormalizeAddress(address)
+	if owner, found := index.Exact[address]; found {
+		return owner, ""
+	}
+	baseAddress, tag := SplitSubaddress(address)
+	if owner, found := index.Exact[baseAddress]; found && tag != "" {
+		return owner, tag
+	}
+	for _, addressRegex := range index.Regexes {
+		if addressRegex.Regex.MatchString(address) {
+			return addressRegex.Owner, tag
+		}
+	}
+	if owner, found := index.CatchAll[address[strings.LastIndex(address, "@")+1:]]; found {
+		return owner, tag
+	}
+	return nil, ""
+}
+
+// like lookupAddress without regexes and catch-alls
+// they would match senders and other recipients that merely share a domain with the configured addresses
+func lookupExactAddress(cfg *glb.Config, address string) *glb.AddressOwner {
+	if cfg.AddressIndex == nil {
+		return nil
+	}
+	address = NormalizeAddress(address)
+	if owner, found := cfg.AddressIndex.Exact[address]; found {
+		return owner
+	}
+	baseAddress, _ := SplitSubaddress(address)
+	return cfg.AddressIndex.Exact[baseAddress]
+}
+
+// senders can only be authenticated with trusted Authentication-Results or verify_dkim
+func SenderAuthConfigured(cfg *glb.Config) bool {
+	return len(cfg.TrustedAuthservIds) != 0 || cfg.VerifyDKIM
+}
+
 // look through the Emails field in the servicedesks to find the addressee
+// ilc+bug@example.com is addressed to ilc@example.com unless it is configured itself
 func GetServiceDeskFromMail(cfg *glb.Config, emailTo string) *glb.ServiceDesk {
-	for _, jiraInstall := range cfg.JiraInstalls {
-		for _, srd := range jiraInstall.ServiceDesks {
-			for _, srdEmail := range srd.Emails {
-				if srdEmail == emailTo {
-					return srd
-				}
-			}
-		}
+	owner, _ := lookupAddress(cfg, emailTo)
+	if owner == nil {
+		return nil
 	}
-	return nil
+	return owner.ServiceDesk
 }
 
 func GetServiceDeskFromId(cfg *glb.Config, id string) *glb.ServiceDesk {
@@ -30,14 +92,59 @@ func GetServiceDeskFromId(cfg *glb.Config, id string) *glb.ServiceDesk {
 	return nil
 }
 
-// look through the Emails field in the jira install to find the addressee
+// look through the Emails field in the jira install to find the addressee, like GetServiceDeskFromMail
 func GetJiraInstallFromMail(cfg *glb.Config, emailTo string) *glb.JiraInstall {
+	owner, _ := lookupAddress(cfg, emailTo)
+	if owner == nil || owner.ServiceDesk != nil {
+		return nil
+	}
+	return owner.JiraInstall
+}
+
+// only the exact addresses of servicedesks and their subaddresses, e.g. to detect loops
+func GetServiceDeskFromExactMail(cfg *glb.Config, address string) *glb.ServiceDesk {
+	owner := lookupExactAddress(cfg, address)
+	if owner == nil {
+		return nil
+	}
+	return owner.ServiceDesk
+}
+
+// only the exact addresses of jira installs and their subaddresses, like GetServiceDeskFromExactMail
+func GetJiraInstallFromExactMail(cfg *glb.Config, address string) *glb.JiraInstall {
+	owner := lookupExactAddress(cfg, address)
+	if owner == nil || owner.ServiceDesk != nil {
+		return nil
+	}
+	return owner.JiraInstall
+}
+
+// return nil when no servicedesk parsing emails has this project key
+func GetServiceDeskFromProjectKey(cfg *glb.Config, projectKey string) *glb.ServiceDesk {
 	for _, jiraInstall := range cfg.JiraInstalls {
-		for _, jiraInstallEmail := range jiraInstall.Emails {
-			if jiraInstallEmail == emailTo {
-				return jiraInstall
+		for _, srd := range jiraInstall.ServiceDesks {
+			if srd.ProjectKey == projectKey && !srd.OnlyCreateEventRequests {
+				return srd
 			}
 		}
 	}
 	return nil
 }
+
+// when there is a serviceDesk addressed, use that
+// otherwise check if jira installs are addressed
+// the jira install is always defined when the servicedesk is, both are nil when neither is addressed
+// also return the subaddress tag of the address that was used
+func GetAddressee(cfg *glb.Config, addresses []*mail.Address) (*glb.ServiceDesk, *glb.JiraInstall, string) {
+	for _, to := range addresses {
+		if owner, tag := lookupAddress(cfg, to.Address); owner != nil && owner.ServiceDesk != nil {
+			return owner.ServiceDesk, owner.JiraInstall, tag
+		}
+	}
+	for _, to := range addresses {
+		if owner, tag := lookupAddress(cfg, to.Address); owner != nil {
+			return nil, owner.JiraInstall, tag
+		}
+	}
+	return nil, nil, ""
+}
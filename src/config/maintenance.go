@@ -13,12 +13,11 @@ import (
 )
 
 func getTimestamp(fileName string) time.Time {
-	fileName = strings.ReplaceAll(fileName, "email_", "")
-	fileName = strings.ReplaceAll(fileName, "event_", "")
-	fileName = strings.ReplaceAll(fileName, "log_", "")
-	fileName = strings.ReplaceAll(fileName, ".json", "")
-	fileName = strings.ReplaceAll(fileName, ".dump", "")
-	fileName = strings.ReplaceAll(fileName, ".log", "")
+	fileName = strings.TrimPrefix(fileName, "email_")
+	fileName = strings.TrimPrefix(fileName, "event_")
+	fileName = strings.TrimPrefix(fileName, "log_")
+	// strip file extension, which differs by inbound provider
+	fileName, _, _ = strings.Cut(fileName, ".")
 	timestampInt, err := strconv.Atoi(fileName)
 	if err != nil {
 		lg.Logf("failed to get timestamp of %s\n", fileName)
@@ -2,9 +2,9 @@ package db
 
 import (
 	"database/sql"
-	"errors"
 	"log"
 	"os"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 
@@ -16,24 +16,18 @@ func GetDb() *sql.DB {
 	if dbPath == "" {
 		dbPath = "./inbound_parser_db.sqlite"
 	}
-	migrationNeeded := false
-	if _, err := os.Stat(dbPath); errors.Is(err, os.ErrNotExist) {
-		migrationNeeded = true
-	}
-
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if migrationNeeded {
-		migrate(db)
-	}
+	// tables added later on need to be created in existing databases as well
+	migrate(db)
 	return db
 }
 
 func migrate(db *sql.DB) {
 	sqlStmt := `
-CREATE TABLE mails (file TEXT NOT NULL PRIMARY KEY, handled INTEGER);
+CREATE TABLE IF NOT EXISTS mails (file TEXT NOT NULL PRIMARY KEY, handled INTEGER);
     `
 	_, err := db.Exec(sqlStmt)
 	if err != nil {
@@ -41,13 +35,61 @@ CREATE TABLE mails (file TEXT NOT NULL PRIMARY KEY, handled INTEGER);
 		log.Fatal("Failed to migrate database for mails.")
 	}
 	sqlStmt = `
-CREATE TABLE events (file TEXT NOT NULL PRIMARY KEY, handled INTEGER);
+CREATE TABLE IF NOT EXISTS events (file TEXT NOT NULL PRIMARY KEY, handled INTEGER);
     `
 	_, err = db.Exec(sqlStmt)
 	if err != nil {
 		lg.LogeNoMail(err)
 		log.Fatal("Failed to migrate database for events.")
 	}
+	sqlStmt = `
+CREATE TABLE IF NOT EXISTS imported_mails (message_id TEXT NOT NULL PRIMARY KEY, file TEXT);
+    `
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		lg.LogeNoMail(err)
+		log.Fatal("Failed to migrate database for imported mails.")
+	}
+	sqlStmt = `
+CREATE TABLE IF NOT EXISTS message_ids (message_id TEXT NOT NULL, jira_url TEXT NOT NULL, issue_key TEXT NOT NULL, PRIMARY KEY (message_id, jira_url));
+    `
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		lg.LogeNoMail(err)
+		log.Fatal("Failed to migrate database for message ids.")
+	}
+	sqlStmt = `
+CREATE TABLE IF NOT EXISTS suppressed_addresses (address TEXT NOT NULL PRIMARY KEY, reason TEXT, issue_key TEXT);
+    `
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		lg.LogeNoMail(err)
+		log.Fatal("Failed to migrate database for suppressed addresses.")
+	}
+	sqlStmt = `
+CREATE TABLE IF NOT EXISTS calendar_events (uid TEXT NOT NULL, jira_url TEXT NOT NULL, issue_key TEXT NOT NULL, PRIMARY KEY (uid, jira_url));
+    `
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		lg.LogeNoMail(err)
+		log.Fatal("Failed to migrate database for calendar events.")
+	}
+	sqlStmt = `
+CREATE TABLE IF NOT EXISTS attachment_hashes (hash TEXT NOT NULL, jira_url TEXT NOT NULL, issue_key TEXT NOT NULL, PRIMARY KEY (hash, jira_url, issue_key));
+    `
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		lg.LogeNoMail(err)
+		log.Fatal("Failed to migrate database for attachment hashes.")
+	}
+	sqlStmt = `
+CREATE TABLE IF NOT EXISTS imap_messages (mailbox TEXT NOT NULL, uid_validity INTEGER NOT NULL, uid INTEGER NOT NULL, outcome TEXT NOT NULL, PRIMARY KEY (mailbox, uid_validity, uid));
+    `
+	_, err = db.Exec(sqlStmt)
+	if err != nil {
+		lg.LogeNoMail(err)
+		log.Fatal("Failed to migrate database for imap messages.")
+	}
 }
 
 func UpdateEmailState(db *sql.DB, file string, handled bool) error {
@@ -121,3 +163,178 @@ SELECT file FROM events WHERE handled = 0;
 	}
 	return files, nil
 }
+
+// messages polled from IMAP mailboxes are identified by the mailbox's UIDVALIDITY and their UID
+// outcome is empty while the message is being handled
+func SetIMAPMessageOutcome(db *sql.DB, mailbox string, uidValidity uint32, uid uint32, outcome string) error {
+	sqlStmt, err := db.Prepare(`
+REPLACE INTO imap_messages(mailbox, uid_validity, uid, outcome) VALUES(?, ?, ?, ?);
+    `)
+	if err != nil {
+		return err
+	}
+	defer sqlStmt.Close()
+	_, err = sqlStmt.Exec(mailbox, uidValidity, uid, outcome)
+	return err
+}
+
+// return false when the message hasn't been handled before
+func GetIMAPMessageOutcome(db *sql.DB, mailbox string, uidValidity uint32, uid uint32) (string, bool, error) {
+	var outcome string
+	err := db.QueryRow(`
+SELECT outcome FROM imap_messages WHERE mailbox = ? AND uid_validity = ? AND uid = ?;
+    `, mailbox, uidValidity, uid).Scan(&outcome)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return outcome, err == nil, err
+}
+
+// messages imported from archives are identified by their Message-ID
+func IsImported(db *sql.DB, messageId string) (bool, error) {
+	var count int
+	err := db.QueryRow(`
+SELECT COUNT(*) FROM imported_mails WHERE message_id = ?;
+    `, messageId).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
+
+func SetImported(db *sql.DB, messageId string, file string) error {
+	sqlStmt, err := db.Prepare(`
+REPLACE INTO imported_mails(message_id, file) VALUES(?, ?);
+    `)
+	if err != nil {
+		return err
+	}
+	defer sqlStmt.Close()
+	_, err = sqlStmt.Exec(messageId, file)
+	return err
+}
+
+// remember which request the received email belongs to
+// the sender chooses the message id, the request it has first been seen with keeps it
+func AddMessageIssueKey(db *sql.DB, messageId string, jiraURL string, issueKey string) error {
+	sqlStmt, err := db.Prepare(`
+INSERT OR IGNORE INTO message_ids(message_id, jira_url, issue_key) VALUES(?, ?, ?);
+    `)
+	if err != nil {
+		return err
+	}
+	defer sqlStmt.Close()
+	_, err = sqlStmt.Exec(messageId, jiraURL, issueKey)
+	return err
+}
+
+// remember which request the sent email belongs to, only for message ids generated by the inbound_parser
+func SetMessageIssueKey(db *sql.DB, messageId string, jiraURL string, issueKey string) error {
+	sqlStmt, err := db.Prepare(`
+REPLACE INTO message_ids(message_id, jira_url, issue_key) VALUES(?, ?, ?);
+    `)
+	if err != nil {
+		return err
+	}
+	defer sqlStmt.Close()
+	_, err = sqlStmt.Exec(messageId, jiraURL, issueKey)
+	return err
+}
+
+// return empty string when the email isn't known
+func GetMessageIssueKey(db *sql.DB, messageId string, jiraURL string) (string, error) {
+	var issueKey string
+	err := db.QueryRow(`
+SELECT issue_key FROM message_ids WHERE message_id = ? AND jira_url = ?;
+    `, messageId, jiraURL).Scan(&issueKey)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return issueKey, err
+}
+
+// remember which request the meeting belongs to, updates and cancellations go to that request
+// the uid is chosen by the sender, an invite reusing it mustn't take the meeting over
+func SetCalendarEventIssueKey(db *sql.DB, uid string, jiraURL string, issueKey string) error {
+	sqlStmt, err := db.Prepare(`
+INSERT OR IGNORE INTO calendar_events(uid, jira_url, issue_key) VALUES(?, ?, ?);
+    `)
+	if err != nil {
+		return err
+	}
+	defer sqlStmt.Close()
+	_, err = sqlStmt.Exec(uid, jiraURL, issueKey)
+	return err
+}
+
+// return empty string when the meeting isn't known
+func GetCalendarEventIssueKey(db *sql.DB, uid string, jiraURL string) (string, error) {
+	var issueKey string
+	err := db.QueryRow(`
+SELECT issue_key FROM calendar_events WHERE uid = ? AND jira_url = ?;
+    `, uid, jiraURL).Scan(&issueKey)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return issueKey, err
+}
+
+// remember the content of a file uploaded to the request, it isn't uploaded again
+func SetAttachmentUploaded(db *sql.DB, hash string, jiraURL string, issueKey string) error {
+	sqlStmt, err := db.Prepare(`
+REPLACE INTO attachment_hashes(hash, jira_url, issue_key) VALUES(?, ?, ?);
+    `)
+	if err != nil {
+		return err
+	}
+	defer sqlStmt.Close()
+	_, err = sqlStmt.Exec(hash, jiraURL, issueKey)
+	return err
+}
+
+func IsAttachmentUploaded(db *sql.DB, hash string, jiraURL string, issueKey string) (bool, error) {
+	var count int
+	err := db.QueryRow(`
+SELECT COUNT(*) FROM attachment_hashes WHERE hash = ? AND jira_url = ? AND issue_key = ?;
+    `, hash, jiraURL, issueKey).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
+
+// addresses that bounced don't get any emails anymore
+func SuppressAddress(db *sql.DB, address string, reason string, issueKey string) error {
+	sqlStmt, err := db.Prepare(`
+REPLACE INTO suppressed_addresses(address, reason, issue_key) VALUES(?, ?, ?);
+    `)
+	if err != nil {
+		return err
+	}
+	defer sqlStmt.Close()
+	_, err = sqlStmt.Exec(strings.ToLower(address), reason, issueKey)
+	return err
+}
+
+// return false when the address wasn't suppressed
+func UnsuppressAddress(db *sql.DB, address string) (bool, error) {
+	result, err := db.Exec(`
+DELETE FROM suppressed_addresses WHERE address = ?;
+    `, strings.ToLower(address))
+	if err != nil {
+		return false, err
+	}
+	count, err := result.RowsAffected()
+	return count != 0, err
+}
+
+func IsSuppressed(db *sql.DB, address string) (bool, error) {
+	var count int
+	err := db.QueryRow(`
+SELECT COUNT(*) FROM suppressed_addresses WHERE address = ?;
+    `, strings.ToLower(address)).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count != 0, nil
+}
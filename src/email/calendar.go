@@ -0,0 +1,395 @@
+// parse meeting invitations, i.e. text/calendar parts //
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhillyerd/enmime/v2"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// BEGIN:... END:... block of an iCalendar file, RFC 5545
+type icsComponent struct {
+	Name       string
+	Props      []icsProperty
+	Components []*icsComponent
+}
+
+// return the first property with this name, nil when there is none
+func (component *icsComponent) get(name string) *icsProperty {
+	for idx := range component.Props {
+		if component.Props[idx].Name == name {
+			return &component.Props[idx]
+		}
+	}
+	return nil
+}
+
+func (component *icsComponent) getValue(name string) string {
+	if prop := component.get(name); prop != nil {
+		return prop.Value
+	}
+	return ""
+}
+
+func isCalendar(part *enmime.Part) bool {
+	switch strings.ToLower(part.ContentType) {
+	case "text/calendar", "application/ics":
+		return true
+	}
+	return strings.HasSuffix(strings.ToLower(part.FileName), ".ics")
+}
+
+// long lines are folded by a line break followed by a space or tab
+func unfoldICS(data string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) != 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// NAME;PARAM=value;PARAM="quoted value":value
+func parseICSLine(line string) (icsProperty, bool) {
+	prop := icsProperty{Params: make(map[string]string)}
+	quoted := false
+	start := 0
+	var fields []string
+	for idx := 0; idx < len(line); idx++ {
+		switch line[idx] {
+		case '"':
+			quoted = !quoted
+		case ';', ':':
+			if quoted {
+				continue
+			}
+			fields = append(fields, line[start:idx])
+			start = idx + 1
+			if line[idx] == ':' {
+				prop.Value = line[start:]
+				prop.Name = strings.ToUpper(fields[0])
+				for _, param := range fields[1:] {
+					key, value, _ := strings.Cut(param, "=")
+					prop.Params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+				}
+				return prop, true
+			}
+		}
+	}
+	return prop, false
+}
+
+func unescapeICSText(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+func parseICS(data string) (*icsComponent, error) {
+	root := &icsComponent{}
+	stack := []*icsComponent{root}
+	for _, line := range unfoldICS(data) {
+		prop, ok := parseICSLine(line)
+		if !ok {
+			continue
+		}
+		current := stack[len(stack)-1]
+		switch prop.Name {
+		case "BEGIN":
+			component := &icsComponent{Name: strings.ToUpper(prop.Value)}
+			current.Components = append(current.Components, component)
+			stack = append(stack, component)
+		case "END":
+			if len(stack) == 1 || current.Name != strings.ToUpper(prop.Value) {
+				return nil, fmt.Errorf("unexpected END:%s", prop.Value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			current.Props = append(current.Props, prop)
+		}
+	}
+	for _, component := range root.Components {
+		if component.Name == "VCALENDAR" {
+			return component, nil
+		}
+	}
+	return nil, errors.New("no VCALENDAR found")
+}
+
+// +0200 or +020000
+func parseUTCOffset(value string) (int, error) {
+	if len(value) != 5 && len(value) != 7 {
+		return 0, fmt.Errorf("invalid utc offset %s", value)
+	}
+	hours, err := strconv.Atoi(value[1:3])
+	if err != nil {
+		return 0, err
+	}
+	minutes, err := strconv.Atoi(value[3:5])
+	if err != nil {
+		return 0, err
+	}
+	offset := hours*3600 + minutes*60
+	if value[0] == '-' {
+		offset = -offset
+	}
+	return offset, nil
+}
+
+// the onset of a STANDARD or DAYLIGHT observance in the given year, only yearly rules by month and weekday are supported
+func getObservanceOnset(observance *icsComponent, year int) (time.Time, bool) {
+	onset, err := time.Parse("20060102T150405", observance.getValue("DTSTART"))
+	if err != nil {
+		return time.Time{}, false
+	}
+	rule := make(map[string]string)
+	for _, part := range strings.Split(observance.getValue("RRULE"), ";") {
+		key, value, _ := strings.Cut(part, "=")
+		rule[strings.ToUpper(key)] = strings.ToUpper(value)
+	}
+	if rule["FREQ"] != "YEARLY" {
+		return onset, onset.Year() <= year
+	}
+	if onset.Year() > year {
+		return time.Time{}, false
+	}
+	month, err := strconv.Atoi(rule["BYMONTH"])
+	if err != nil {
+		month = int(onset.Month())
+	}
+	byDay := rule["BYDAY"]
+	if len(byDay) < 2 {
+		return time.Date(year, time.Month(month), onset.Day(), onset.Hour(), onset.Minute(), onset.Second(), 0, time.UTC), true
+	}
+	weekday, found := icsWeekdays[byDay[len(byDay)-2:]]
+	if !found {
+		return time.Time{}, false
+	}
+	week, err := strconv.Atoi(byDay[:len(byDay)-2])
+	if err != nil {
+		week = 1
+	}
+	var day time.Time
+	if week > 0 {
+		day = time.Date(year, time.Month(month), 1, onset.Hour(), onset.Minute(), onset.Second(), 0, time.UTC)
+		day = day.AddDate(0, 0, (int(weekday)-int(day.Weekday())+7)%7+(week-1)*7)
+	} else {
+		day = time.Date(year, time.Month(month)+1, 0, onset.Hour(), onset.Minute(), onset.Second(), 0, time.UTC)
+		day = day.AddDate(0, 0, -((int(day.Weekday())-int(weekday)+7)%7)+(week+1)*7)
+	}
+	return day, true
+}
+
+// return the utc offset of a VTIMEZONE at the local time, the observance with the latest onset wins
+func getVTimezoneOffset(vtimezone *icsComponent, local time.Time) (int, error) {
+	var latestOnset time.Time
+	offset, found := 0, false
+	for _, observance := range vtimezone.Components {
+		if observance.Name != "STANDARD" && observance.Name != "DAYLIGHT" {
+			continue
+		}
+		observanceOffset, err := parseUTCOffset(observance.getValue("TZOFFSETTO"))
+		if err != nil {
+			return 0, err
+		}
+		for _, year := range []int{local.Year() - 1, local.Year()} {
+			onset, ok := getObservanceOnset(observance, year)
+			if ok && !onset.After(local) && (!found || onset.After(latestOnset)) {
+				latestOnset, offset, found = onset, observanceOffset, true
+			}
+		}
+	}
+	if !found {
+		return 0, errors.New("no matching observance")
+	}
+	return offset, nil
+}
+
+// return the time and true iff it is a date without time
+// floating times are in the sender's timezone
+func parseICSTime(prop *icsProperty, calendar *icsComponent, senderLocation *time.Location) (time.Time, bool, error) {
+	value := strings.TrimSpace(prop.Value)
+	if prop.Params["VALUE"] == "DATE" || len(value) == 8 {
+		date, err := time.ParseInLocation("20060102", value, senderLocation)
+		return date, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		utc, err := time.Parse("20060102T150405Z", value)
+		return utc, false, err
+	}
+	tzid := prop.Params["TZID"]
+	if tzid == "" {
+		local, err := time.ParseInLocation("20060102T150405", value, senderLocation)
+		return local, false, err
+	}
+	if location, err := time.LoadLocation(strings.TrimPrefix(tzid, "/")); err == nil {
+		local, err := time.ParseInLocation("20060102T150405", value, location)
+		return local, false, err
+	}
+	// Outlook uses windows names like "W. Europe Standard Time", which are defined in the calendar
+	local, err := time.Parse("20060102T150405", value)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	for _, vtimezone := range calendar.Components {
+		if vtimezone.Name != "VTIMEZONE" || vtimezone.getValue("TZID") != tzid {
+			continue
+		}
+		offset, err := getVTimezoneOffset(vtimezone, local)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		return local.Add(-time.Duration(offset) * time.Second), false, nil
+	}
+	return time.Time{}, false, fmt.Errorf("unknown timezone %s", tzid)
+}
+
+// ORGANIZER;CN=Bob:mailto:bob@example.com
+func getCalendarAddress(prop *icsProperty) string {
+	address := prop.Value
+	if strings.HasPrefix(strings.ToLower(address), "mailto:") {
+		address = address[len("mailto:"):]
+	}
+	formatted := FormatAddr(&mail.Address{Name: prop.Params["CN"], Address: address})
+	partStat := strings.ToLower(prop.Params["PARTSTAT"])
+	if partStat != "" && partStat != "needs-action" {
+		formatted += fmt.Sprintf(" (%s)", partStat)
+	}
+	return formatted
+}
+
+func parseCalendarEvent(data string, contentTypeMethod string, senderLocation *time.Location) (*glb.CalendarEvent, error) {
+	calendar, err := parseICS(data)
+	if err != nil {
+		return nil, err
+	}
+	var vevent *icsComponent
+	for _, component := range calendar.Components {
+		if component.Name == "VEVENT" {
+			vevent = component
+			break
+		}
+	}
+	if vevent == nil {
+		return nil, errors.New("no VEVENT found")
+	}
+
+	event := &glb.CalendarEvent{
+		Method:      strings.ToUpper(calendar.getValue("METHOD")),
+		UID:         vevent.getValue("UID"),
+		Summary:     unescapeICSText(vevent.getValue("SUMMARY")),
+		Location:    unescapeICSText(vevent.getValue("LOCATION")),
+		Description: strings.TrimSpace(unescapeICSText(vevent.getValue("DESCRIPTION"))),
+	}
+	if event.Method == "" {
+		event.Method = strings.ToUpper(contentTypeMethod)
+	}
+	if event.Method == "" {
+		event.Method = "PUBLISH"
+	}
+	if vevent.getValue("STATUS") == "CANCELLED" {
+		event.Method = "CANCEL"
+	}
+	if organizer := vevent.get("ORGANIZER"); organizer != nil {
+		event.Organizer = getCalendarAddress(organizer)
+	}
+	for _, prop := range vevent.Props {
+		if prop.Name == "ATTENDEE" {
+			event.Attendees = append(event.Attendees, getCalendarAddress(&prop))
+		}
+	}
+	if start := vevent.get("DTSTART"); start != nil {
+		event.Start, event.AllDay, err = parseICSTime(start, calendar, senderLocation)
+		if err != nil {
+			return nil, err
+		}
+		event.Start = event.Start.In(senderLocation)
+	}
+	if end := vevent.get("DTEND"); end != nil {
+		event.End, _, err = parseICSTime(end, calendar, senderLocation)
+		if err != nil {
+			return nil, err
+		}
+		event.End = event.End.In(senderLocation)
+	}
+	return event, nil
+}
+
+// return the first meeting invitation, nil when there is none
+func getCalendarEvent(env *enmime.Envelope, senderLocation *time.Location) *glb.CalendarEvent {
+	for _, part := range env.Root.DepthMatchAll(isCalendar) {
+		event, err := parseCalendarEvent(string(part.Content), part.ContentTypeParams["method"], senderLocation)
+		if err != nil {
+			lg.Logf("Warning: failed to parse calendar %s: %s", constructFilename(part), err)
+			continue
+		}
+		lg.Logf("found %s of meeting %s\n", event.Method, event.UID)
+		return event
+	}
+	return nil
+}
+
+// render the meeting below the message
+func GetCalendarEventStr(email *glb.Email) string {
+	event := email.CalendarEvent
+	if event == nil {
+		return ""
+	}
+	outStr := "\n\n----\n"
+	switch event.Method {
+	case "CANCEL":
+		outStr += "Meeting cancelled\n"
+	case "REPLY":
+		outStr += "Meeting response\n"
+	default:
+		outStr += "Meeting invitation\n"
+	}
+	outStr += fmt.Sprintf("Title: %s\n", event.Summary)
+	if event.Organizer != "" {
+		outStr += fmt.Sprintf("Organizer: %s\n", event.Organizer)
+	}
+	if len(event.Attendees) != 0 {
+		outStr += fmt.Sprintf("Attendees: %s\n", strings.Join(event.Attendees, ", "))
+	}
+	if event.AllDay {
+		outStr += fmt.Sprintf("Start: %s (all day)\n", event.Start.Format("02.01.2006"))
+		// the end of all day events is exclusive
+		if lastDay := event.End.AddDate(0, 0, -1); lastDay.After(event.Start) {
+			outStr += fmt.Sprintf("End: %s (all day)\n", lastDay.Format("02.01.2006"))
+		}
+	} else if !event.Start.IsZero() {
+		outStr += fmt.Sprintf("Start: %s\n", event.Start.Format("02.01.2006 15:04 (MST)"))
+		if !event.End.IsZero() {
+			outStr += fmt.Sprintf("End: %s\n", event.End.Format("02.01.2006 15:04 (MST)"))
+		}
+	}
+	if event.Location != "" {
+		outStr += fmt.Sprintf("Location: %s\n", event.Location)
+	}
+	if event.Description != "" {
+		outStr += fmt.Sprintf("{quote}\n%s\n{quote}", strings.ReplaceAll(event.Description, "{quote}", "{ quote}"))
+	}
+	return strings.TrimSuffix(outStr, "\n")
+}
@@ -0,0 +1,383 @@
+// verify and decrypt S/MIME and PGP emails //
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"go.mozilla.org/pkcs7"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+var emailAddressOID = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// encrypted emails might contain signed ones and vice versa
+const maxCryptographyLayers = 4
+
+// detached signatures and PGP's version part are never uploaded
+var cryptographyParts = map[string]struct{}{
+	"application/pkcs7-signature":   {},
+	"application/x-pkcs7-signature": {},
+	"application/pgp-signature":     {},
+	"application/pgp-encrypted":     {},
+}
+
+// return the header block and body of a MIME entity
+func splitEntity(raw []byte) ([]byte, []byte) {
+	crlf := bytes.Index(raw, []byte("\r\n\r\n"))
+	lf := bytes.Index(raw, []byte("\n\n"))
+	if crlf != -1 && (lf == -1 || crlf < lf) {
+		return raw[:crlf+2], raw[crlf+4:]
+	}
+	if lf != -1 {
+		return raw[:lf+1], raw[lf+2:]
+	}
+	return raw, nil
+}
+
+func parseEntityHeader(header []byte) (textproto.MIMEHeader, error) {
+	reader := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(header), strings.NewReader("\r\n"))))
+	return reader.ReadMIMEHeader()
+}
+
+func decodeTransferEncoding(body []byte, encoding string) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	}
+	return body, nil
+}
+
+// signatures are calculated over CRLF line endings, dumps might only contain LF
+func canonicalLineEndings(content []byte) []byte {
+	return bytes.ReplaceAll(bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+}
+
+// replace the content of the email with the entity, all other outer headers are kept
+func replaceEntity(raw []byte, entity []byte) []byte {
+	header, _ := splitEntity(raw)
+	var kept bytes.Buffer
+	keep := true
+	for _, line := range bytes.SplitAfter(header, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		// folded lines belong to the previous header
+		if line[0] != ' ' && line[0] != '\t' {
+			name := strings.ToLower(string(line[:bytes.IndexByte(append(line, ':'), ':')]))
+			keep = !strings.HasPrefix(name, "content-")
+		}
+		if keep {
+			kept.Write(line)
+		}
+	}
+	// enmime doesn't cope with mixed line endings
+	if !bytes.Contains(header, []byte("\r\n")) {
+		entity = bytes.ReplaceAll(entity, []byte("\r\n"), []byte("\n"))
+	}
+	return append(kept.Bytes(), entity...)
+}
+
+// return the raw parts of a multipart body, without the line break preceding each delimiter
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delimiter := []byte("--" + boundary)
+	var parts [][]byte
+	start := -1
+	for pos := 0; pos < len(body); {
+		next := len(body)
+		if lineEnd := bytes.IndexByte(body[pos:], '\n'); lineEnd != -1 {
+			next = pos + lineEnd + 1
+		}
+		line := bytes.TrimRight(body[pos:next], " \t\r\n")
+		if bytes.HasPrefix(line, delimiter) && (len(line) == len(delimiter) || string(line[len(delimiter):]) == "--") {
+			if start != -1 {
+				end := pos
+				if end > start && body[end-1] == '\n' {
+					end--
+				}
+				if end > start && body[end-1] == '\r' {
+					end--
+				}
+				parts = append(parts, body[start:end])
+			}
+			if len(line) != len(delimiter) {
+				break
+			}
+			start = next
+		}
+		pos = next
+	}
+	return parts
+}
+
+// decoded body of a raw part
+func getPartContent(part []byte) ([]byte, error) {
+	header, body := splitEntity(part)
+	fields, err := parseEntityHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	return decodeTransferEncoding(body, fields.Get("Content-Transfer-Encoding"))
+}
+
+func getPGPSigner(entity *openpgp.Entity) (string, []string) {
+	var names []string
+	var addresses []string
+	for name, identity := range entity.Identities {
+		if identity.SelfSignature != nil && identity.SelfSignature.IsPrimaryId != nil && *identity.SelfSignature.IsPrimaryId {
+			name = "0" + name
+		} else {
+			name = "1" + name
+		}
+		names = append(names, name)
+		if identity.UserId != nil && identity.UserId.Email != "" {
+			addresses = append(addresses, identity.UserId.Email)
+		}
+	}
+	// primary identity first
+	sort.Strings(names)
+	if len(names) == 0 {
+		return fmt.Sprintf("key %X", entity.PrimaryKey.KeyId), addresses
+	}
+	return names[0][1:], addresses
+}
+
+func verifySMIME(cfg *glb.Config, signedContent []byte, signature []byte) *glb.SignatureStatus {
+	status := &glb.SignatureStatus{Method: "S/MIME"}
+	p7, err := pkcs7.Parse(signature)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	if signedContent != nil {
+		p7.Content = signedContent
+	}
+	if signer := p7.GetOnlySigner(); signer != nil {
+		status.SignerAddresses = signer.EmailAddresses
+		// older certificates only have the address in the subject
+		for _, name := range signer.Subject.Names {
+			if address, ok := name.Value.(string); ok && name.Type.Equal(emailAddressOID) {
+				status.SignerAddresses = append(status.SignerAddresses, address)
+			}
+		}
+		status.Signer = signer.Subject.CommonName
+		if len(status.SignerAddresses) != 0 {
+			status.Signer = strings.TrimSpace(fmt.Sprintf("%s <%s>", signer.Subject.CommonName, status.SignerAddresses[0]))
+		}
+	}
+	if err := p7.VerifyWithChain(cfg.SMIMECAs); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Verified = true
+	return status
+}
+
+func verifyPGP(cfg *glb.Config, signedContent []byte, signature []byte) *glb.SignatureStatus {
+	status := &glb.SignatureStatus{Method: "PGP"}
+	signer, err := openpgp.CheckArmoredDetachedSignature(cfg.PGPKeyring, bytes.NewReader(signedContent), bytes.NewReader(signature))
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Signer, status.SignerAddresses = getPGPSigner(signer)
+	status.Verified = true
+	return status
+}
+
+// the email is encrypted for one of the servicedesks
+func decryptSMIME(cfg *glb.Config, p7 *pkcs7.PKCS7) ([]byte, error) {
+	for _, jiraInstall := range cfg.JiraInstalls {
+		for _, srd := range jiraInstall.ServiceDesks {
+			if srd.SMIMECert == nil {
+				continue
+			}
+			if content, err := p7.Decrypt(srd.SMIMECert, srd.SMIMEKey); err == nil {
+				lg.Logf("decrypted S/MIME email with key of servicedesk %s\n", srd.ProjectKey)
+				return content, nil
+			}
+		}
+	}
+	return nil, errors.New("no servicedesk key is able to decrypt the email")
+}
+
+// PGP emails can be signed within the encryption
+func decryptPGP(cfg *glb.Config, encrypted []byte) ([]byte, *glb.SignatureStatus, error) {
+	keyring := append(openpgp.EntityList{}, cfg.PGPKeyring...)
+	for _, jiraInstall := range cfg.JiraInstalls {
+		for _, srd := range jiraInstall.ServiceDesks {
+			if srd.PGPKey != nil {
+				keyring = append(keyring, srd.PGPKey)
+			}
+		}
+	}
+	block, err := armor.Decode(bytes.NewReader(encrypted))
+	if err != nil {
+		return nil, nil, err
+	}
+	details, err := openpgp.ReadMessage(block.Body, keyring, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := io.ReadAll(details.UnverifiedBody)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !details.IsSigned {
+		return content, nil, nil
+	}
+	// the signature can only be checked after everything has been read
+	signature := &glb.SignatureStatus{Method: "PGP"}
+	if details.SignedBy == nil {
+		signature.Error = fmt.Sprintf("unknown signer key %X", details.SignedByKeyId)
+	} else if details.SignatureError != nil {
+		signature.Error = details.SignatureError.Error()
+	} else {
+		signature.Signer, signature.SignerAddresses = getPGPSigner(details.SignedBy.Entity)
+		signature.Verified = true
+	}
+	return content, signature, nil
+}
+
+// decrypt the email and verify its signature
+// the returned email is the decrypted one, or the original when it isn't encrypted or decryption failed
+func unwrapCryptography(cfg *glb.Config, raw []byte) ([]byte, *glb.SignatureStatus, *glb.EncryptionStatus) {
+	var signature *glb.SignatureStatus
+	var encryption *glb.EncryptionStatus
+	for layer := 0; layer < maxCryptographyLayers; layer++ {
+		header, body := splitEntity(raw)
+		fields, err := parseEntityHeader(header)
+		if err != nil {
+			break
+		}
+		mediaType, params, err := mime.ParseMediaType(fields.Get("Content-Type"))
+		if err != nil {
+			break
+		}
+
+		switch {
+		case mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime":
+			data, err := decodeTransferEncoding(body, fields.Get("Content-Transfer-Encoding"))
+			if err != nil {
+				lg.Logf("Warning: failed to decode S/MIME part: %s", err)
+				return raw, signature, encryption
+			}
+			p7, err := pkcs7.Parse(data)
+			if err != nil {
+				lg.Logf("Warning: failed to parse S/MIME part: %s", err)
+				return raw, signature, encryption
+			}
+			// signed but not detached, the content is within the signature
+			if strings.ToLower(params["smime-type"]) == "signed-data" || len(p7.Signers) != 0 {
+				signature = verifySMIME(cfg, nil, data)
+				raw = replaceEntity(raw, p7.Content)
+				continue
+			}
+			encryption = &glb.EncryptionStatus{Method: "S/MIME"}
+			content, err := decryptSMIME(cfg, p7)
+			if err != nil {
+				encryption.Error = err.Error()
+				return raw, signature, encryption
+			}
+			encryption.Decrypted = true
+			raw = replaceEntity(raw, content)
+
+		case mediaType == "multipart/encrypted" && strings.ToLower(params["protocol"]) == "application/pgp-encrypted":
+			encryption = &glb.EncryptionStatus{Method: "PGP"}
+			parts := splitMultipart(body, params["boundary"])
+			if len(parts) != 2 {
+				encryption.Error = "expected a version and an encrypted part"
+				return raw, signature, encryption
+			}
+			encrypted, err := getPartContent(parts[1])
+			if err != nil {
+				encryption.Error = err.Error()
+				return raw, signature, encryption
+			}
+			content, innerSignature, err := decryptPGP(cfg, encrypted)
+			if err != nil {
+				encryption.Error = err.Error()
+				return raw, signature, encryption
+			}
+			encryption.Decrypted = true
+			if innerSignature != nil {
+				signature = innerSignature
+			}
+			raw = replaceEntity(raw, content)
+
+		case mediaType == "multipart/signed":
+			parts := splitMultipart(body, params["boundary"])
+			if len(parts) != 2 {
+				lg.Logf("Warning: signed email doesn't consist of content and signature")
+				return raw, signature, encryption
+			}
+			signatureContent, err := getPartContent(parts[1])
+			if err != nil {
+				lg.Logf("Warning: failed to decode signature: %s", err)
+				return raw, signature, encryption
+			}
+			switch strings.ToLower(params["protocol"]) {
+			case "application/pkcs7-signature", "application/x-pkcs7-signature":
+				signature = verifySMIME(cfg, canonicalLineEndings(parts[0]), signatureContent)
+			case "application/pgp-signature":
+				signature = verifyPGP(cfg, canonicalLineEndings(parts[0]), signatureContent)
+			default:
+				lg.Logf("Warning: unknown signature protocol %s", params["protocol"])
+				return raw, signature, encryption
+			}
+			// the signed content might be encrypted
+			raw = replaceEntity(raw, parts[0])
+
+		default:
+			return raw, signature, encryption
+		}
+	}
+	return raw, signature, encryption
+}
+
+// return true iff the signature has been made by the sender
+func signedBySender(signature *glb.SignatureStatus, sender string) bool {
+	for _, address := range signature.SignerAddresses {
+		if strings.EqualFold(address, sender) {
+			return true
+		}
+	}
+	return false
+}
+
+func getCryptographyStatsStr(email *glb.Email) string {
+	outStr := ""
+	if email.Encryption != nil {
+		if email.Encryption.Decrypted {
+			outStr += fmt.Sprintf("Encryption: %s, decrypted\n", email.Encryption.Method)
+		} else {
+			outStr += fmt.Sprintf("Encryption: %s, failed to decrypt: %s\n", email.Encryption.Method, email.Encryption.Error)
+		}
+	}
+	if email.Signature != nil {
+		if !email.Signature.Verified {
+			outStr += fmt.Sprintf("Signature: %s, verification failed: %s\n", email.Signature.Method, email.Signature.Error)
+		} else if !signedBySender(email.Signature, email.From.Address) {
+			outStr += fmt.Sprintf("Signature: %s, verified signer %s doesn't match sender\n", email.Signature.Method, email.Signature.Signer)
+		} else {
+			outStr += fmt.Sprintf("Signature: %s, verified signer %s\n", email.Signature.Method, email.Signature.Signer)
+		}
+	}
+	return outStr
+}
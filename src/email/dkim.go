@@ -0,0 +1,218 @@
+// verify DKIM signatures locally //
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+const dkimDNSTimeout = 5 * time.Second
+
+var (
+	whitespaceSequenceRegex = regexp.MustCompile(`[ \t]+`)
+	// the b tag, but not bh
+	dkimSignatureTagRegex = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+)
+
+type rawHeader struct {
+	Name string
+	// including name, folding and the final CRLF
+	Raw string
+}
+
+// split the raw header block into headers in order, all line endings are CRLF
+func splitRawHeaders(header []byte) []rawHeader {
+	var headers []rawHeader
+	for _, line := range strings.SplitAfter(string(canonicalLineEndings(header)), "\r\n") {
+		if line == "" || line == "\r\n" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) != 0 {
+			headers[len(headers)-1].Raw += line
+			continue
+		}
+		name, _, _ := strings.Cut(line, ":")
+		headers = append(headers, rawHeader{Name: strings.TrimSpace(name), Raw: line})
+	}
+	return headers
+}
+
+func parseDKIMTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		key, value, found := strings.Cut(tag, "=")
+		if !found {
+			continue
+		}
+		tags[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return tags
+}
+
+func canonicalizeHeader(header string, relaxed bool) string {
+	if !relaxed {
+		return header
+	}
+	name, value, _ := strings.Cut(header, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.TrimSpace(whitespaceSequenceRegex.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+func canonicalizeBody(body []byte, relaxed bool) []byte {
+	lines := strings.Split(string(canonicalLineEndings(body)), "\r\n")
+	if relaxed {
+		for idx, line := range lines {
+			lines[idx] = strings.TrimRight(whitespaceSequenceRegex.ReplaceAllString(line, " "), " ")
+		}
+	}
+	// trailing empty lines are ignored
+	for len(lines) != 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if relaxed {
+			return []byte{}
+		}
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func getDKIMKey(selector string, domain string) (crypto.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dkimDNSTimeout)
+	defer cancel()
+	records, err := net.DefaultResolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("no DKIM key record")
+	}
+	tags := parseDKIMTags(strings.Join(records, ""))
+	keyData, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(tags["p"]), ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(keyData) == 0 {
+		return nil, errors.New("DKIM key has been revoked")
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		if key, err := x509.ParsePKIXPublicKey(keyData); err == nil {
+			return key, nil
+		}
+		return x509.ParsePKCS1PublicKey(keyData)
+	case "ed25519":
+		if len(keyData) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid ed25519 DKIM key")
+		}
+		return ed25519.PublicKey(keyData), nil
+	}
+	return nil, fmt.Errorf("unsupported DKIM key type %s", tags["k"])
+}
+
+// return the signing domain when the signature is valid
+func verifyDKIMSignature(headers []rawHeader, signature rawHeader, body []byte) (string, error) {
+	_, value, _ := strings.Cut(signature.Raw, ":")
+	tags := parseDKIMTags(strings.ReplaceAll(value, "\r\n", ""))
+	domain := strings.ToLower(tags["d"])
+	if tags["v"] != "1" || domain == "" || tags["s"] == "" || tags["h"] == "" {
+		return domain, errors.New("malformed DKIM signature")
+	}
+	if tags["a"] != "rsa-sha256" && tags["a"] != "ed25519-sha256" {
+		return domain, fmt.Errorf("unsupported DKIM algorithm %s", tags["a"])
+	}
+	if expiry, err := strconv.ParseInt(tags["x"], 10, 64); err == nil && time.Now().Unix() > expiry {
+		return domain, errors.New("DKIM signature has expired")
+	}
+	headerCanonicalization, bodyCanonicalization, _ := strings.Cut(tags["c"], "/")
+	relaxedHeader := headerCanonicalization == "relaxed"
+	relaxedBody := bodyCanonicalization == "relaxed"
+
+	canonicalBody := canonicalizeBody(body, relaxedBody)
+	if length, err := strconv.Atoi(tags["l"]); err == nil && length < len(canonicalBody) {
+		canonicalBody = canonicalBody[:length]
+	}
+	bodyHash := sha256.Sum256(canonicalBody)
+	expectedBodyHash, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(tags["bh"]), ""))
+	if err != nil || !bytes.Equal(bodyHash[:], expectedBodyHash) {
+		return domain, errors.New("DKIM body hash doesn't match")
+	}
+
+	// signed headers are taken from the bottom up
+	var signedData strings.Builder
+	used := make(map[int]struct{})
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		for idx := len(headers) - 1; idx >= 0; idx-- {
+			if _, found := used[idx]; found || !strings.EqualFold(headers[idx].Name, name) {
+				continue
+			}
+			used[idx] = struct{}{}
+			signedData.WriteString(canonicalizeHeader(headers[idx].Raw, relaxedHeader))
+			break
+		}
+	}
+	unsigned := signature.Name + ":" + dkimSignatureTagRegex.ReplaceAllString(value, "$1$2")
+	signedData.WriteString(strings.TrimSuffix(canonicalizeHeader(unsigned, relaxedHeader), "\r\n"))
+
+	signatureBytes, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(tags["b"]), ""))
+	if err != nil {
+		return domain, err
+	}
+	key, err := getDKIMKey(tags["s"], domain)
+	if err != nil {
+		return domain, err
+	}
+	hash := sha256.Sum256([]byte(signedData.String()))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			return domain, errors.New("DKIM key doesn't match algorithm")
+		}
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signatureBytes)
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" || !ed25519.Verify(key, hash[:], signatureBytes) {
+			err = errors.New("DKIM signature is invalid")
+		}
+	default:
+		err = errors.New("unsupported DKIM key")
+	}
+	return domain, err
+}
+
+// return the domains of all valid signatures
+func verifyDKIM(raw []byte) []string {
+	header, body := splitEntity(raw)
+	headers := splitRawHeaders(header)
+	var domains []string
+	for _, signature := range headers {
+		if !strings.EqualFold(signature.Name, "DKIM-Signature") {
+			continue
+		}
+		domain, err := verifyDKIMSignature(headers, signature, body)
+		if err != nil {
+			lg.Logf("DKIM signature of %s failed: %s\n", domain, err)
+			continue
+		}
+		lg.Logf("DKIM signature of %s is valid\n", domain)
+		domains = append(domains, domain)
+	}
+	return domains
+}
@@ -0,0 +1,121 @@
+// parse delivery status notifications, i.e. bounces //
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"github.com/jhillyerd/enmime/v2"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+var blankLineRegex = regexp.MustCompile(`\r?\n[ \t]*\r?\n`)
+
+// return the value after the type, e.g. bob@example.org for 'rfc822; bob@example.org'
+func getTypedValue(field string) string {
+	if _, value, found := strings.Cut(field, ";"); found {
+		return strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(field)
+}
+
+// message/delivery-status consists of one block of per-message fields followed by one block per recipient
+func parseDeliveryStatusFields(content []byte, deliveryStatus *glb.DeliveryStatus) {
+	for idx, block := range blankLineRegex.Split(strings.TrimSpace(string(content)), -1) {
+		reader := textproto.NewReader(bufio.NewReader(strings.NewReader(block + "\r\n\r\n")))
+		fields, err := reader.ReadMIMEHeader()
+		if err != nil && len(fields) == 0 {
+			lg.Logf("Warning: failed to parse delivery status block: %s", err)
+			continue
+		}
+		if idx == 0 {
+			deliveryStatus.ReportingMTA = getTypedValue(fields.Get("Reporting-Mta"))
+			continue
+		}
+		address := getTypedValue(fields.Get("Final-Recipient"))
+		if address == "" {
+			address = getTypedValue(fields.Get("Original-Recipient"))
+		}
+		if address == "" {
+			continue
+		}
+		deliveryStatus.Recipients = append(deliveryStatus.Recipients, glb.DeliveryStatusRecipient{
+			Address:        strings.Trim(address, "<>"),
+			Action:         strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+			Status:         strings.TrimSpace(fields.Get("Status")),
+			DiagnosticCode: getTypedValue(fields.Get("Diagnostic-Code")),
+			RemoteMTA:      getTypedValue(fields.Get("Remote-Mta")),
+		})
+	}
+}
+
+// the report contains either the entire original email or only its headers
+func parseOriginalHeaders(content []byte, deliveryStatus *glb.DeliveryStatus) {
+	msg, err := mail.ReadMessage(bytes.NewReader(append(content, []byte("\r\n\r\n")...)))
+	if err != nil {
+		lg.Logf("Warning: failed to parse original email of delivery status notification: %s", err)
+		return
+	}
+	if messageIds := parseMessageIds(msg.Header.Get("Message-Id")); len(messageIds) != 0 {
+		deliveryStatus.OriginalMessageId = messageIds[0]
+	}
+	deliveryStatus.OriginalSubject = enmime.DecodeRFC2047(msg.Header.Get("Subject"))
+}
+
+func walkReportParts(part *enmime.Part, deliveryStatus *glb.DeliveryStatus) {
+	for ; part != nil; part = part.NextSibling {
+		switch strings.ToLower(part.ContentType) {
+		case "message/delivery-status", "message/global-delivery-status":
+			parseDeliveryStatusFields(part.Content, deliveryStatus)
+		case "message/rfc822", "text/rfc822-headers", "message/global", "message/global-headers":
+			parseOriginalHeaders(part.Content, deliveryStatus)
+		}
+		walkReportParts(part.FirstChild, deliveryStatus)
+	}
+}
+
+// enmime doesn't always fill ContentTypeParams for the root part
+func getReportType(part *enmime.Part) string {
+	if reportType, found := part.ContentTypeParams["report-type"]; found {
+		return strings.ToLower(reportType)
+	}
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(params["report-type"])
+}
+
+// return nil when the email isn't a delivery status notification
+func getDeliveryStatus(env *enmime.Envelope) *glb.DeliveryStatus {
+	var report *enmime.Part
+	var findReport func(part *enmime.Part)
+	findReport = func(part *enmime.Part) {
+		for ; part != nil && report == nil; part = part.NextSibling {
+			if strings.ToLower(part.ContentType) == "multipart/report" && getReportType(part) == "delivery-status" {
+				report = part
+				return
+			}
+			findReport(part.FirstChild)
+		}
+	}
+	findReport(env.Root)
+	if report == nil {
+		return nil
+	}
+
+	deliveryStatus := &glb.DeliveryStatus{}
+	walkReportParts(report.FirstChild, deliveryStatus)
+	if len(deliveryStatus.Recipients) == 0 {
+		lg.Logf("Warning: delivery status notification without any recipients")
+		return nil
+	}
+	return deliveryStatus
+}
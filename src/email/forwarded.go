@@ -0,0 +1,117 @@
+// unpack emails forwarded as attachment, i.e. message/rfc822 parts //
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/jhillyerd/enmime/v2"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+func isForwardedEmail(part *enmime.Part) bool {
+	switch strings.ToLower(part.ContentType) {
+	case "message/rfc822", "message/global":
+		return true
+	}
+	return false
+}
+
+// the original is always kept, ideally named after its subject
+func getEmlFilename(part *enmime.Part, subject string) string {
+	name := strings.TrimSpace(part.FileName)
+	if name == "" {
+		name = strings.TrimSpace(subject)
+	}
+	if name == "" {
+		name = "forwarded_email"
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ".eml") {
+		name += ".eml"
+	}
+	return name
+}
+
+func getAddressListStr(env *enmime.Envelope, header string) string {
+	addresses, err := env.AddressList(header)
+	if err != nil {
+		// show the header as is
+		return env.GetHeader(header)
+	}
+	var formatted []string
+	for _, address := range addresses {
+		formatted = append(formatted, FormatAddr(address))
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// return the forwarded email and everything forwarded within it, followed by all files to be uploaded
+// emails deeper than maxDepth are only kept as .eml
+func getForwardedEmail(part *enmime.Part, depth int, maxDepth int) ([]glb.ForwardedEmail, []glb.File) {
+	if depth > maxDepth {
+		lg.Logf("not unpacking forwarded email nested deeper than %d\n", maxDepth)
+		return nil, []glb.File{{Name: getEmlFilename(part, ""), Bytes: part.Content}}
+	}
+	env, err := enmime.ReadEnvelope(bytes.NewReader(part.Content))
+	if err != nil {
+		lg.Logf("Warning: failed to parse forwarded email: %s", err)
+		return nil, []glb.File{{Name: getEmlFilename(part, ""), Bytes: part.Content}}
+	}
+	for _, e := range env.Errors {
+		lg.Logf("Warning: enmime decoding error in forwarded email: %s", e)
+	}
+
+	date := env.GetHeader("Date")
+	if parsedDate, err := env.Date(); err == nil {
+		date = parsedDate.Format("02.01.2006 15:04:05")
+	}
+	body := strings.TrimSpace(env.Text)
+	if body == "" && env.HTML != "" {
+		if wikiBody, err := htmlToWiki(env.HTML); err == nil {
+			body = wikiBody
+		}
+	}
+
+	forwarded := []glb.ForwardedEmail{{
+		Depth:   depth,
+		From:    getAddressListStr(env, "From"),
+		To:      getAddressListStr(env, "To"),
+		Cc:      getAddressListStr(env, "Cc"),
+		Date:    date,
+		Subject: env.GetHeader("Subject"),
+		Body:    body,
+	}}
+	files := []glb.File{{Name: getEmlFilename(part, env.GetHeader("Subject")), Bytes: part.Content}}
+	nestedForwarded, nestedFiles, tnefBody := getFiles(env, depth+1, maxDepth)
+	if forwarded[0].Body == "" {
+		forwarded[0].Body = tnefBody
+	}
+	return append(forwarded, nestedForwarded...), append(files, nestedFiles...)
+}
+
+// render forwarded emails as quotes, jira can't nest quotes so they are listed one after another
+func GetForwardedEmailsStr(email *glb.Email) string {
+	outStr := ""
+	for _, forwarded := range email.Forwarded {
+		outStr += "\n\n----\n"
+		if forwarded.Depth > 1 {
+			outStr += fmt.Sprintf("Forwarded email (nested %d levels deep)\n", forwarded.Depth)
+		} else {
+			outStr += "Forwarded email\n"
+		}
+		outStr += fmt.Sprintf("From: %s\n", forwarded.From)
+		outStr += fmt.Sprintf("To: %s\n", forwarded.To)
+		if forwarded.Cc != "" {
+			outStr += fmt.Sprintf("Cc: %s\n", forwarded.Cc)
+		}
+		if forwarded.Date != "" {
+			outStr += fmt.Sprintf("At: %s\n", forwarded.Date)
+		}
+		outStr += fmt.Sprintf("Subject: %s\n", forwarded.Subject)
+		outStr += fmt.Sprintf("{quote}\n%s\n{quote}", strings.ReplaceAll(forwarded.Body, "{quote}", "{ quote}"))
+	}
+	return outStr
+}
@@ -2,13 +2,76 @@
 package email
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net/mail"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
 )
 
+var messageIdRegex = regexp.MustCompile(`<[^<>\s]+>`)
+
+// return all message ids in a Message-ID, In-Reply-To or References header, including the angle brackets
+func parseMessageIds(header string) []string {
+	return messageIdRegex.FindAllString(header, -1)
+}
+
+// unique message id in the domain of the sending address
+func generateMessageId(from *mail.Address) string {
+	domain := "inbound-parser.invalid"
+	if at := strings.LastIndex(from.Address, "@"); at != -1 {
+		domain = from.Address[at+1:]
+	}
+	randomBytes := make([]byte, 12)
+	rand.Read(randomBytes)
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), hex.EncodeToString(randomBytes), domain)
+}
+
+// headers prepended to raw emails holding what would otherwise only be known from the SMTP envelope
+const (
+	envelopeFromHeader = "X-Inbound-Parser-Envelope-From"
+	envelopeToHeader   = "X-Inbound-Parser-Envelope-To"
+	senderIPHeader     = "X-Inbound-Parser-Sender-IP"
+	spamScoreHeader    = "X-Inbound-Parser-Spam-Score"
+)
+
+// prepend the envelope to a raw email so it can be dumped and parsed later on
+// all headers are always set as they take precedence over any identically named header the sender might have added
+func AddEnvelopeHeaders(rawEmail []byte, envelopeFrom string, envelopeTo []string, senderIP string, spamScore float64) []byte {
+	var quotedTo []string
+	for _, to := range envelopeTo {
+		quotedTo = append(quotedTo, "<"+to+">")
+	}
+	// use the same line endings as the email itself
+	lineEnd := "\n"
+	if bytes.Contains(rawEmail, []byte("\r\n")) {
+		lineEnd = "\r\n"
+	}
+	headers := fmt.Sprintf("%s: <%s>%s", envelopeFromHeader, envelopeFrom, lineEnd)
+	headers += fmt.Sprintf("%s: %s%s", envelopeToHeader, strings.Join(quotedTo, ", "), lineEnd)
+	headers += fmt.Sprintf("%s: %s%s", senderIPHeader, senderIP, lineEnd)
+	headers += fmt.Sprintf("%s: %s%s", spamScoreHeader, strconv.FormatFloat(spamScore, 'f', -1, 64), lineEnd)
+	return append([]byte(headers), rawEmail...)
+}
+
+// remove the headers added by AddEnvelopeHeaders, leaving the email as the sender sent it
+func stripEnvelopeHeaders(rawEmail []byte) []byte {
+	for {
+		line, rest, found := bytes.Cut(rawEmail, []byte("\n"))
+		name, _, _ := bytes.Cut(line, []byte(":"))
+		if !found || !bytes.HasPrefix(bytes.ToLower(name), []byte("x-inbound-parser-")) {
+			return rawEmail
+		}
+		rawEmail = rest
+	}
+}
+
 func FormatAddr(address *mail.Address) string {
 	return fmt.Sprintf("%s <%s>", address.Name, address.Address)
 }
@@ -60,5 +123,7 @@ func GetEmailStatsStr(email *glb.Email) string {
 	outStr += fmt.Sprintf("Spam Score: %f\n", email.SpamScore)
 	outStr += fmt.Sprintf("Envelope From: %s\n", FormatAddr(email.OrigEnvelopeFrom))
 	outStr += fmt.Sprintf("Header From: %s\n", FormatAddr(email.OrigHeaderFrom))
+	outStr += getSenderAuthStatsStr(email)
+	outStr += getCryptographyStatsStr(email)
 	return outStr
 }
@@ -0,0 +1,320 @@
+// convert the html body of an email into jira wiki markup //
+package email
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	whitespaceRegex    = regexp.MustCompile(`[ \t\r\n\f]+`)
+	manyNewlinesRegex  = regexp.MustCompile(`\n{3,}`)
+	wikiSpecialChars   = "{}[]|*_!^~"
+	wikiBoundaryChars  = "+-#"
+	wikiBlockSeparator = "\n\n"
+)
+
+// never rendered, neither the element nor its content
+var skippedElements = map[atom.Atom]struct{}{
+	atom.Head: {}, atom.Title: {}, atom.Meta: {}, atom.Link: {}, atom.Base: {},
+	atom.Script: {}, atom.Style: {}, atom.Noscript: {}, atom.Template: {},
+	atom.Iframe: {}, atom.Frame: {}, atom.Frameset: {}, atom.Object: {}, atom.Embed: {}, atom.Applet: {},
+	atom.Form: {}, atom.Input: {}, atom.Button: {}, atom.Select: {}, atom.Textarea: {},
+	atom.Svg: {}, atom.Math: {},
+}
+
+// wrapped in a marker, e.g. *bold*
+var inlineMarkers = map[atom.Atom]string{
+	atom.B: "*", atom.Strong: "*",
+	atom.I: "_", atom.Em: "_", atom.Cite: "??",
+	atom.U: "+", atom.Ins: "+",
+	atom.S: "-", atom.Strike: "-", atom.Del: "-",
+	atom.Sup: "^", atom.Sub: "~",
+}
+
+var headings = map[atom.Atom]string{
+	atom.H1: "h1. ", atom.H2: "h2. ", atom.H3: "h3. ", atom.H4: "h4. ", atom.H5: "h5. ", atom.H6: "h6. ",
+}
+
+type wikiConverter struct {
+	// one * or # per nested list
+	listPrefix string
+	quoteDepth int
+}
+
+// backslash escape everything jira would interpret as markup
+// + - and # are only special next to whitespace
+// backslashes can't be escaped, \\ would be a line break
+func EscapeWiki(text string) string {
+	var escaped strings.Builder
+	runes := []rune(text)
+	for idx, char := range runes {
+		if strings.ContainsRune(wikiSpecialChars, char) {
+			escaped.WriteRune('\\')
+		} else if strings.ContainsRune(wikiBoundaryChars, char) {
+			before := idx == 0 || runes[idx-1] == ' '
+			after := idx == len(runes)-1 || runes[idx+1] == ' '
+			if before || after {
+				escaped.WriteRune('\\')
+			}
+		}
+		escaped.WriteRune(char)
+	}
+	return escaped.String()
+}
+
+// only allow harmless link targets
+func safeLinkTarget(href string) string {
+	link, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return ""
+	}
+	switch strings.ToLower(link.Scheme) {
+	case "http", "https", "mailto", "ftp":
+	default:
+		return ""
+	}
+	target := link.String()
+	for _, char := range []string{"|", "[", "]", " "} {
+		target = strings.ReplaceAll(target, char, url.QueryEscape(char))
+	}
+	return target
+}
+
+func getAttr(node *html.Node, key string) string {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// text of node without any markup, used for preformatted blocks
+func rawText(node *html.Node) string {
+	if node.Type == html.TextNode {
+		return node.Data
+	}
+	if node.Type == html.ElementNode && node.DataAtom == atom.Br {
+		return "\n"
+	}
+	var text strings.Builder
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		text.WriteString(rawText(child))
+	}
+	return text.String()
+}
+
+// render content of a list item or table cell on a single line
+func singleLine(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	var kept []string
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+func (converter *wikiConverter) renderChildren(node *html.Node) string {
+	var text strings.Builder
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		text.WriteString(converter.render(child))
+	}
+	return text.String()
+}
+
+// markers only work when they directly enclose non-whitespace text
+func wrapInline(marker string, content string) string {
+	trimmed := strings.TrimSpace(content)
+	if trimmed == "" || strings.Contains(trimmed, "\n") {
+		return content
+	}
+	start := content[:strings.Index(content, trimmed)]
+	end := content[len(start)+len(trimmed):]
+	return start + marker + trimmed + marker + end
+}
+
+func (converter *wikiConverter) renderList(node *html.Node, marker string) string {
+	converter.listPrefix += marker
+	defer func() { converter.listPrefix = converter.listPrefix[:len(converter.listPrefix)-1] }()
+
+	var text strings.Builder
+	text.WriteString("\n")
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type != html.ElementNode || child.DataAtom != atom.Li {
+			// text between items has no place in a list
+			if content := singleLine(converter.render(child)); content != "" {
+				text.WriteString(content + "\n")
+			}
+			continue
+		}
+		// nested lists are rendered on their own lines after the item's text
+		var itemText, nested strings.Builder
+		for grandChild := child.FirstChild; grandChild != nil; grandChild = grandChild.NextSibling {
+			if grandChild.Type == html.ElementNode && (grandChild.DataAtom == atom.Ul || grandChild.DataAtom == atom.Ol) {
+				nested.WriteString(converter.render(grandChild))
+			} else {
+				itemText.WriteString(converter.render(grandChild))
+			}
+		}
+		text.WriteString(fmt.Sprintf("%s %s\n", converter.listPrefix, singleLine(itemText.String())))
+		text.WriteString(strings.TrimLeft(nested.String(), "\n"))
+	}
+	if len(converter.listPrefix) == 1 {
+		text.WriteString("\n")
+	}
+	return text.String()
+}
+
+func (converter *wikiConverter) renderTable(node *html.Node) string {
+	var text strings.Builder
+	text.WriteString(wikiBlockSeparator)
+	var renderRows func(node *html.Node)
+	renderRows = func(node *html.Node) {
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode {
+				continue
+			}
+			switch child.DataAtom {
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				renderRows(child)
+			case atom.Tr:
+				var row strings.Builder
+				separator := ""
+				for cell := child.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.Type != html.ElementNode || (cell.DataAtom != atom.Td && cell.DataAtom != atom.Th) {
+						continue
+					}
+					separator = "|"
+					if cell.DataAtom == atom.Th {
+						separator = "||"
+					}
+					content := singleLine(converter.render(cell))
+					// empty cells would be merged by jira
+					if content == "" {
+						content = " "
+					}
+					row.WriteString(separator + content)
+				}
+				if separator != "" {
+					text.WriteString(row.String() + separator + "\n")
+				}
+			}
+		}
+	}
+	renderRows(node)
+	text.WriteString(wikiBlockSeparator)
+	return text.String()
+}
+
+func (converter *wikiConverter) render(node *html.Node) string {
+	switch node.Type {
+	case html.TextNode:
+		return EscapeWiki(whitespaceRegex.ReplaceAllString(node.Data, " "))
+	case html.DocumentNode:
+		return converter.renderChildren(node)
+	case html.ElementNode:
+	default:
+		// comments and doctypes
+		return ""
+	}
+
+	if _, skipped := skippedElements[node.DataAtom]; skipped {
+		return ""
+	}
+	if marker, found := inlineMarkers[node.DataAtom]; found {
+		return wrapInline(marker, converter.renderChildren(node))
+	}
+	if prefix, found := headings[node.DataAtom]; found {
+		return fmt.Sprintf("%s%s%s%s", wikiBlockSeparator, prefix, singleLine(converter.renderChildren(node)), wikiBlockSeparator)
+	}
+
+	switch node.DataAtom {
+	case atom.Br:
+		return "\n"
+	case atom.Hr:
+		return wikiBlockSeparator + "----" + wikiBlockSeparator
+	case atom.P:
+		return wikiBlockSeparator + converter.renderChildren(node) + wikiBlockSeparator
+	case atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Address, atom.Center:
+		return "\n" + converter.renderChildren(node) + "\n"
+	case atom.Ul:
+		return converter.renderList(node, "*")
+	case atom.Ol:
+		return converter.renderList(node, "#")
+	case atom.Li:
+		// list item outside of a list
+		return "\n" + converter.renderChildren(node) + "\n"
+	case atom.Table:
+		return converter.renderTable(node)
+	case atom.Pre:
+		code := strings.Trim(rawText(node), "\n")
+		code = strings.ReplaceAll(code, "{noformat}", "{ noformat}")
+		return fmt.Sprintf("%s{noformat}\n%s\n{noformat}%s", wikiBlockSeparator, code, wikiBlockSeparator)
+	case atom.Code, atom.Tt, atom.Kbd, atom.Samp:
+		code := singleLine(rawText(node))
+		if code == "" {
+			return ""
+		}
+		return "{{" + EscapeWiki(code) + "}}"
+	case atom.Blockquote:
+		converter.quoteDepth++
+		content := converter.renderChildren(node)
+		converter.quoteDepth--
+		// jira can't nest quotes
+		if converter.quoteDepth != 0 {
+			return "\n" + content + "\n"
+		}
+		return fmt.Sprintf("%s{quote}\n%s\n{quote}%s", wikiBlockSeparator, strings.Trim(content, "\n "), wikiBlockSeparator)
+	case atom.A:
+		content := singleLine(converter.renderChildren(node))
+		target := safeLinkTarget(getAttr(node, "href"))
+		if target == "" {
+			return content
+		}
+		if content == "" || content == EscapeWiki(target) {
+			return "[" + target + "]"
+		}
+		return "[" + content + "|" + target + "]"
+	case atom.Img:
+		// images are uploaded as attachments
+		if alt := strings.TrimSpace(getAttr(node, "alt")); alt != "" {
+			return EscapeWiki(alt)
+		}
+		return ""
+	}
+	return converter.renderChildren(node)
+}
+
+// collapse whitespace and empty lines, except within noformat blocks
+func cleanWiki(wiki string) string {
+	var lines []string
+	inNoformat := false
+	for _, line := range strings.Split(wiki, "\n") {
+		if line == "{noformat}" {
+			inNoformat = !inNoformat
+		} else if !inNoformat {
+			line = strings.Join(strings.Fields(line), " ")
+		}
+		lines = append(lines, line)
+	}
+	return strings.TrimSpace(manyNewlinesRegex.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+// return jira wiki markup for the html body of an email
+// anything that could execute or embed content is stripped
+func htmlToWiki(htmlBody string) (string, error) {
+	document, err := html.Parse(strings.NewReader(htmlBody))
+	if err != nil {
+		return "", err
+	}
+	converter := &wikiConverter{}
+	return cleanWiki(converter.render(document)), nil
+}
@@ -0,0 +1,72 @@
+package email
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHtmlToWiki(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		wiki string
+	}{
+		{"paragraphs", "<p>first</p><p>second<br>line</p>", "first\n\nsecond\nline"},
+		{"inline markers", "<b>bold</b> <i>italic</i> <u>under</u> <s>strike</s> <sup>up</sup>", "*bold* _italic_ +under+ -strike- ^up^"},
+		{"marker around whitespace", "<b> bold </b>text", "*bold* text"},
+		{"heading", "<h2>Title</h2><p>text</p>", "h2. Title\n\ntext"},
+		{"escaped markup", "<p>{code} [link|x] *not bold* a - b</p>", `\{code\} \[link\|x\] \*not bold\* a \- b`},
+		{"hyphenated words", "<p>non-urgent e-mail</p>", "non-urgent e-mail"},
+		{"nested lists", "<ul><li>one<ul><li>nested</li></ul></li><li>two</li></ul><ol><li>first</li></ol>", "* one\n** nested\n* two\n\n# first"},
+		{"table", "<table><tr><th>key</th><th>value</th></tr><tr><td>a</td><td></td></tr></table>", "||key||value||\n|a| |"},
+		{"link", `<a href="https://example.com/a b">example</a>`, "[example|https://example.com/a%20b]"},
+		{"link without text", `<a href="https://example.com">https://example.com</a>`, "[https://example.com]"},
+		{"unsafe link", `<a href="javascript:alert(1)">click</a>`, "click"},
+		{"skipped elements", "<head><title>t</title><style>p {}</style></head><script>alert(1)</script><p>text</p><iframe src=x></iframe>", "text"},
+		{"preformatted", "<pre>a  *b*\n{noformat}</pre>", "{noformat}\na  *b*\n{ noformat}\n{noformat}"},
+		{"code", "<code>a*b</code>", `{{a\*b}}`},
+		{"nested quotes", "<blockquote>outer<blockquote>inner</blockquote></blockquote>", "{quote}\nouter\ninner\n{quote}"},
+		{"image alt", `<img src="cid:1" alt="logo!">`, `logo\!`},
+		{"whitespace", "<div>  many \n\n spaces  </div>\n\n\n<div>next</div>", "many spaces\n\nnext"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wiki, err := htmlToWiki(test.html)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wiki != test.wiki {
+				t.Errorf("got:\n%s\n\nexpected:\n%s", wiki, test.wiki)
+			}
+		})
+	}
+}
+
+func TestEscapeWiki(t *testing.T) {
+	tests := map[string]string{
+		"##- Please type your reply above this line -##": `\##\- Please type your reply above this line \-#\#`,
+		"plain text":  "plain text",
+		"-start end-": `\-start end\-`,
+		"a|b":         `a\|b`,
+		"1 + 1 # 2":   `1 \+ 1 \# 2`,
+		"C:\\path":    "C:\\path",
+		"{quote}text": `\{quote\}text`,
+	}
+	for text, expected := range tests {
+		if escaped := EscapeWiki(text); escaped != expected {
+			t.Errorf("EscapeWiki(%q) = %q, expected %q", text, escaped, expected)
+		}
+	}
+}
+
+// the marker has to be found in the converted body to cut the reply off
+func TestHtmlToWikiKeepsEscapedMarker(t *testing.T) {
+	marker := "##- Please type your reply above this line -##"
+	wiki, err := htmlToWiki("<p>my reply</p><p>" + marker + "</p><p>old <b>text</b></p>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(wiki, EscapeWiki(marker)) {
+		t.Errorf("escaped marker not found in:\n%s", wiki)
+	}
+}
@@ -1,16 +1,12 @@
-// turn raw email from sendgrid into parsed Email //
+// turn raw email from any inbound provider into parsed Email //
 package email
 
 import (
 	"bytes"
-	"encoding/json"
-	"math"
 	"mime"
-	"strconv"
 	"strings"
 	"time"
 
-	"net/http"
 	"net/mail"
 
 	"github.com/h2non/filetype"
@@ -38,43 +34,6 @@ func isAutoReply(env *enmime.Envelope) bool {
 	return false
 }
 
-func getSendgridFields(body []byte) (map[string][]string, error) {
-	fakeReq, err := http.NewRequest(http.MethodPost, "", bytes.NewReader(body))
-	if err != nil {
-		return nil, err
-	}
-	fakeReq.Header.Set("Content-Type", "multipart/form-data; boundary=xYzZY")
-	fakeReq.Header.Set("User-Agent", "Twilio-SendGrid")
-
-	err = fakeReq.ParseMultipartForm(1000000000)
-	if err != nil {
-		return nil, err
-	}
-
-	return fakeReq.MultipartForm.Value, nil
-}
-
-func getDeliveryStatusNotification(rawEmail string) (string, error) {
-	fakeReq, err := http.NewRequest(http.MethodPost, "", strings.NewReader(rawEmail))
-	if err != nil {
-		return "", err
-	}
-	fakeReq.Header.Set("Content-Type", "multipart/form-data; boundary=xYzZY")
-	fakeReq.Header.Set("User-Agent", "Twilio-SendGrid")
-
-	err = fakeReq.ParseMultipartForm(1000000000)
-	if err != nil {
-		return "", err
-	}
-
-	for thing := range fakeReq.MultipartForm.Value {
-		if strings.Contains(thing, "Content-Type: message/delivery-status") {
-			return thing, nil
-		}
-	}
-	return "", nil
-}
-
 // constructFilename interprets the mime part as an (inline) attachment and returns its filename
 // If no filename is given it guesses a sensible filename for it based on the filetype.
 func constructFilename(part *enmime.Part) string {
@@ -102,73 +61,89 @@ func constructFilename(part *enmime.Part) string {
 	return filenameWOExtension + fileExtension
 }
 
-func getFiles(env *enmime.Envelope) []glb.File {
-	files := make([]glb.File, len(env.Inlines)+len(env.Attachments)+len(env.OtherParts))
-
-	// get inlines
-	for idx, file := range env.Inlines {
-		files[idx] = glb.File{Name: constructFilename(file), Bytes: file.Content}
-	}
+// return all forwarded emails and files, forwarded emails and TNEF are unpacked
+// the body of a TNEF is returned as well, empty when there is none
+// depth is 1 for the received email
+func getFiles(env *enmime.Envelope, depth int, maxForwardDepth int) ([]glb.ForwardedEmail, []glb.File, string) {
+	var forwarded []glb.ForwardedEmail
+	var files []glb.File
+	tnefBody := ""
 
-	// get attachments
-	for idx, file := range env.Attachments {
-		files[len(env.Inlines)+idx] = glb.File{Name: constructFilename(file), Bytes: file.Content}
+	// everything but attachments is embedded into the body
+	attachments := make(map[*enmime.Part]struct{})
+	for _, file := range env.Attachments {
+		attachments[file] = struct{}{}
 	}
 
-	// get other parts (mostly multipart/related files, these are for example embedded images in an html mail)
-	for idx, file := range env.OtherParts {
-		files[len(env.Inlines)+len(env.Attachments)+idx] = glb.File{Name: constructFilename(file), Bytes: file.Content}
+	// inlines, attachments and other parts (mostly multipart/related files, these are for example embedded images in an html mail)
+	for _, file := range append(append(append([]*enmime.Part{}, env.Inlines...), env.Attachments...), env.OtherParts...) {
+		if _, found := cryptographyParts[strings.ToLower(file.ContentType)]; found {
+			continue
+		}
+		if isForwardedEmail(file) {
+			nestedForwarded, nestedFiles := getForwardedEmail(file, depth, maxForwardDepth)
+			forwarded = append(forwarded, nestedForwarded...)
+			files = append(files, nestedFiles...)
+			continue
+		}
+		if isTNEF(file) {
+			content, err := decodeTNEF(file.Content)
+			if err == nil {
+				lg.Logf("unpacked %d files from TNEF %s\n", len(content.Files), constructFilename(file))
+				files = append(files, content.Files...)
+				if tnefBody == "" {
+					tnefBody = content.Body
+				}
+				continue
+			}
+			// upload the blob as is
+			lg.Logf("Warning: failed to decode TNEF: %s", err)
+		}
+		_, isAttachment := attachments[file]
+		files = append(files, glb.File{Name: constructFilename(file), Bytes: file.Content, Inline: !isAttachment})
 	}
-	return files
+	return forwarded, files, tnefBody
 }
 
-func GetParsedEmail(body []byte, cfg *glb.Config) (*glb.Email, error) {
+// turn the raw email and envelope received from any inbound provider into a parsed Email
+func GetParsedEmail(envelope *glb.InboundEnvelope, cfg *glb.Config) (*glb.Email, error) {
+	rawEmail, signature, encryption := unwrapCryptography(cfg, envelope.RawEmail)
+
 	lg.Logf("parsing email with enmime")
-	// sendgrid stuff
-	sendgridFields, err := getSendgridFields(body)
+	env, err := enmime.ReadEnvelope(bytes.NewReader(rawEmail))
+	// hard parsing error
 	if err != nil {
-		lg.Logf("failed to parse sendgrid fields")
+		lg.Logf("failed to get enmime envelope")
 		return nil, err
 	}
+	// soft parsing error, we can continue even with such an error
+	// TODO: log errors to database
+	for _, e := range env.Errors {
+		lg.Logf("Warning: enmime decoding error: %s", e)
+	}
 
-	rawEmail := sendgridFields["email"][0]
-	subject := sendgridFields["subject"][0]
-	var to []*mail.Address
-	to, err = mail.ParseAddressList(sendgridFields["to"][0])
+	to, err := env.AddressList("To")
 	if err != nil {
-		lg.Logf("error to be ignored in sendgrid to field: %s", err.Error())
+		lg.Logf("error to be ignored in to header: %s", err.Error())
+		to = make([]*mail.Address, 0)
 	}
-	// there is a bug in sendgrid
-	// sendgrid doesn't escape commas and the like with " when the address is encoded using b64
-	// therefore this call will fail in such cases
-	headerFrom, err := mail.ParseAddress(sendgridFields["from"][0])
+	headerFrom := &mail.Address{Name: "", Address: ""}
+	allHeaderFrom, err := env.AddressList("From")
 	if err != nil {
-		lg.Logf("error to be ignored in sendgrid from field: %s", err.Error())
 		// envelope address will be used instead
-		headerFrom = &mail.Address{Name: "", Address: ""}
-	}
-	senderIP := sendgridFields["sender_ip"][0]
-	spamScore, err := strconv.ParseFloat(sendgridFields["spam_score"][0], 64)
-	if err != nil {
-		lg.Logf("failed to get spam score")
-		return nil, err
+		lg.Logf("error to be ignored in from header: %s", err.Error())
+	} else if len(allHeaderFrom) != 0 {
+		headerFrom = allHeaderFrom[0]
 	}
 
-	// when the email got to the inbound_parser via bcc, the bcc address will be in this to address
-	type Envelope struct {
-		To   []string `json:"to"`
-		From string   `json:"from"`
-	}
-	var envelope *Envelope
-	err = json.Unmarshal([]byte(sendgridFields["envelope"][0]), &envelope)
-	if err != nil {
-		lg.Logf("failed to get sendgrid mail envelope")
-		return nil, err
-	}
-	EnvelopeTo, err := mail.ParseAddress(envelope.To[0])
-	if err != nil {
-		lg.Logf("failed to parse to addresses")
-		return nil, err
+	// when the email got to the inbound_parser via bcc, the bcc address will only be in the envelope
+	for _, envelopeTo := range envelope.To {
+		envelopeToAddress, err := mail.ParseAddress(envelopeTo)
+		if err != nil {
+			lg.Logf("failed to parse envelope to address %s", envelopeTo)
+			return nil, err
+		}
+		to = append(to, envelopeToAddress)
 	}
 	// use truest from email address -> better against phishing
 	envelopeFrom, err := mail.ParseAddress(envelope.From)
@@ -185,21 +160,30 @@ func GetParsedEmail(body []byte, cfg *glb.Config) (*glb.Email, error) {
 	if envelopeFrom.Address != headerFrom.Address {
 		lg.Logf("Warning: envelope from address: %s, header from address: %s", envelopeFrom.Address, headerFrom.Address)
 	}
+	senderAuth := getSenderAuthentication(cfg, envelope.RawEmail, env.Root.Header, from.Address, envelopeFrom.Address)
 
-	env, err := enmime.ReadEnvelope(strings.NewReader(rawEmail))
-	// soft parsing error, we can continue even with such an error
-	// TODO: log errors to database
-	for _, e := range env.Errors {
-		lg.Logf("Warning: enmime decoding error: %s", e)
-	}
-	// hard parsing error
-	if err != nil {
-		lg.Logf("failed to get enmime envelope")
-		return nil, err
+	messageId := ""
+	if messageIds := parseMessageIds(env.GetHeader("Message-ID")); len(messageIds) != 0 {
+		messageId = messageIds[0]
 	}
 
-	emailBody := strings.TrimSpace(env.Text[:int(math.Min(float64(len(env.Text)), 32767))])
-	files := getFiles(env)
+	// bodies exceeding jira's limit are cut and attached in full later on
+	emailBody := strings.TrimSpace(env.Text)
+	wikiBody := ""
+	if env.HTML != "" {
+		wikiBody, err = htmlToWiki(env.HTML)
+		if err != nil {
+			// the text body is good enough
+			lg.Logf("Warning: failed to convert html body: %s", err)
+			wikiBody = ""
+		}
+	}
+	forwarded, files, tnefBody := getFiles(env, 1, cfg.MaxForwardDepth)
+	// Outlook might only send the body within the TNEF
+	if emailBody == "" && tnefBody != "" {
+		lg.Logf("using body of TNEF")
+		emailBody = tnefBody
+	}
 
 	cc, err := env.AddressList("Cc")
 	if err != nil {
@@ -262,17 +246,29 @@ func GetParsedEmail(body []byte, cfg *glb.Config) (*glb.Email, error) {
 		From:             from,
 		OrigHeaderFrom:   headerFrom,
 		OrigEnvelopeFrom: envelopeFrom,
-		To:               append(to, EnvelopeTo),
+		To:               to,
 		ReplyTo:          replyTo,
 		Cc:               cc,
 		Bcc:              bcc,
-		Subject:          subject,
-		SenderIP:         senderIP,
-		SpamScore:        spamScore,
+		Subject:          env.GetHeader("Subject"),
+		SenderIP:         envelope.SenderIP,
+		SpamScore:        envelope.SpamScore,
+		Headers:          mail.Header(env.Root.Header),
+		MessageId:        messageId,
+		InReplyTo:        parseMessageIds(env.GetHeader("In-Reply-To")),
+		References:       parseMessageIds(env.GetHeader("References")),
 		TextBody:         emailBody,
+		WikiBody:         wikiBody,
+		Forwarded:        forwarded,
 		Files:            files,
 		IsAutoReply:      isAutoReply(env),
 		IsMalware:        isMalware,
+		DeliveryStatus:   getDeliveryStatus(env),
+		Signature:        signature,
+		Encryption:       encryption,
+		SenderAuth:       senderAuth,
+		CalendarEvent:    getCalendarEvent(env, date.Location()),
+		RawEmail:         stripEnvelopeHeaders(envelope.RawEmail),
 	}
 	return &mail, nil
 }
@@ -0,0 +1,162 @@
+// abstraction over the different ways emails reach the inbound_parser //
+package email
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+// an email vendor or other source handing received emails to the inbound_parser
+type InboundProvider interface {
+	// dumps with this file extension are parsed with this provider
+	DumpExtension() string
+	// check provider specific authentication of a webhook request, the token has already been checked
+	Authenticate(webhook *glb.InboundWebhook, request *http.Request, body []byte) error
+	// turn an authenticated webhook request's body into what gets dumped
+	PrepareDump(webhook *glb.InboundWebhook, body []byte) ([]byte, error)
+	// extract raw email and envelope from a dump
+	GetEnvelope(body []byte, cfg *glb.Config) (*glb.InboundEnvelope, error)
+}
+
+var inboundProviders = map[string]InboundProvider{
+	"sendgrid": sendgridProvider{},
+	"mailgun":  mailgunProvider{},
+	"postmark": postmarkProvider{},
+	"raw":      rawProvider{},
+}
+
+// return nil when there is no provider with that name
+func GetInboundProvider(name string) InboundProvider {
+	return inboundProviders[name]
+}
+
+// return nil when no provider dumps files like this
+func GetInboundProviderFromDump(dumpFile string) InboundProvider {
+	for _, provider := range inboundProviders {
+		if strings.HasSuffix(dumpFile, provider.DumpExtension()) {
+			return provider
+		}
+	}
+	return nil
+}
+
+// parse multipart/form-data body, the boundary is taken from the body's first line
+func getMultipartFields(body []byte) (map[string][]string, error) {
+	firstLine, _, _ := bytes.Cut(body, []byte("\n"))
+	boundary := strings.TrimPrefix(strings.TrimSpace(string(firstLine)), "--")
+	if boundary == "" {
+		return nil, errors.New("multipart body doesn't start with a boundary")
+	}
+	fakeReq, err := http.NewRequest(http.MethodPost, "", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	fakeReq.Header.Set("Content-Type", "multipart/form-data; boundary="+boundary)
+
+	err = fakeReq.ParseMultipartForm(1000000000)
+	if err != nil {
+		return nil, err
+	}
+
+	return fakeReq.MultipartForm.Value, nil
+}
+
+// first value of a form field, empty when not present
+func getField(fields map[string][]string, name string) string {
+	if len(fields[name]) == 0 {
+		return ""
+	}
+	return fields[name][0]
+}
+
+// the receiving mail server notes the connecting ip in the Received-SPF header like 'client-ip=1.2.3.4;'
+func getSenderIPFromReceivedSPF(header mail.Header) string {
+	for _, receivedSPF := range header["Received-Spf"] {
+		for _, field := range strings.FieldsFunc(receivedSPF, func(r rune) bool { return r == ';' || r == ' ' }) {
+			if strings.HasPrefix(strings.ToLower(field), "client-ip=") {
+				return field[len("client-ip="):]
+			}
+		}
+	}
+	return ""
+}
+
+// return 0 when the spam score header is missing
+func parseSpamScore(spamScore string) (float64, error) {
+	if strings.TrimSpace(spamScore) == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(strings.TrimSpace(spamScore), 64)
+}
+
+// score of the relaying MTA's spam filter, SpamAssassin's X-Spam-Score or rspamd's X-Rspamd-Score
+// the topmost header has been added by the relaying MTA, 0 when there is none
+func GetSpamScoreFromHeaders(rawEmail []byte) float64 {
+	msg, err := mail.ReadMessage(bytes.NewReader(rawEmail))
+	if err != nil {
+		return 0
+	}
+	for _, header := range []string{"X-Spam-Score", "X-Rspamd-Score"} {
+		fields := strings.Fields(msg.Header.Get(header))
+		if len(fields) == 0 {
+			continue
+		}
+		spamScore, err := parseSpamScore(fields[0])
+		if err != nil {
+			lg.Logf("failed to parse %s '%s'\n", header, fields[0])
+			continue
+		}
+		return spamScore
+	}
+	return 0
+}
+
+// raw emails dumped by the SMTP server or IMAP poller, the envelope is in the headers added by AddEnvelopeHeaders
+type rawProvider struct{}
+
+func (rawProvider) DumpExtension() string {
+	return ".eml"
+}
+
+func (rawProvider) Authenticate(webhook *glb.InboundWebhook, request *http.Request, body []byte) error {
+	return errors.New("raw emails aren't received via webhook")
+}
+
+func (rawProvider) PrepareDump(webhook *glb.InboundWebhook, body []byte) ([]byte, error) {
+	return body, nil
+}
+
+func (rawProvider) GetEnvelope(body []byte, cfg *glb.Config) (*glb.InboundEnvelope, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	envelope := &glb.InboundEnvelope{
+		RawEmail: body,
+		SenderIP: msg.Header.Get(senderIPHeader),
+	}
+	if envelopeFrom, err := mail.ParseAddress(msg.Header.Get(envelopeFromHeader)); err == nil {
+		envelope.From = envelopeFrom.Address
+	}
+	if strings.TrimSpace(msg.Header.Get(envelopeToHeader)) != "" {
+		envelopeTo, err := mail.ParseAddressList(msg.Header.Get(envelopeToHeader))
+		if err != nil {
+			return nil, err
+		}
+		for _, to := range envelopeTo {
+			envelope.To = append(envelope.To, to.Address)
+		}
+	}
+	envelope.SpamScore, err = parseSpamScore(msg.Header.Get(spamScoreHeader))
+	if err != nil {
+		return nil, err
+	}
+	return envelope, nil
+}
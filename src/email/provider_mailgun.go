@@ -0,0 +1,212 @@
+// mailgun's inbound routes, either forwarding the raw MIME or using store and notify //
+package email
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+type mailgunProvider struct{}
+
+// signed requests older than this are rejected as replays
+const maxMailgunSignatureAge = 5 * time.Minute
+
+// tokens of signed requests within maxMailgunSignatureAge, each may only be used once
+// older ones are rejected by their timestamp anyway
+var (
+	usedMailgunTokens      = make(map[string]time.Time)
+	usedMailgunTokensMutex sync.Mutex
+)
+
+func useMailgunToken(token string, timestamp time.Time) error {
+	usedMailgunTokensMutex.Lock()
+	defer usedMailgunTokensMutex.Unlock()
+	for usedToken, usedTimestamp := range usedMailgunTokens {
+		if time.Since(usedTimestamp) > maxMailgunSignatureAge {
+			delete(usedMailgunTokens, usedToken)
+		}
+	}
+	if _, found := usedMailgunTokens[token]; found {
+		return errors.New("mailgun token has already been used")
+	}
+	usedMailgunTokens[token] = timestamp
+	return nil
+}
+
+func (mailgunProvider) DumpExtension() string {
+	return ".mailgun"
+}
+
+// mailgun signs the timestamp and token with the webhook signing key
+func (mailgunProvider) Authenticate(webhook *glb.InboundWebhook, request *http.Request, body []byte) error {
+	if webhook.SigningKey == "" {
+		return nil
+	}
+	mailgunFields, err := getMultipartFields(body)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, []byte(webhook.SigningKey))
+	mac.Write([]byte(getField(mailgunFields, "timestamp") + getField(mailgunFields, "token")))
+	expectedSignature := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expectedSignature), []byte(getField(mailgunFields, "signature"))) {
+		return errors.New("invalid mailgun signature")
+	}
+	unixTimestamp, err := strconv.ParseInt(getField(mailgunFields, "timestamp"), 10, 64)
+	if err != nil {
+		return errors.New("invalid mailgun timestamp")
+	}
+	timestamp := time.Unix(unixTimestamp, 0)
+	if age := time.Since(timestamp); age > maxMailgunSignatureAge || age < -maxMailgunSignatureAge {
+		return fmt.Errorf("mailgun timestamp is off by %s", age.Round(time.Second))
+	}
+	return useMailgunToken(getField(mailgunFields, "token"), timestamp)
+}
+
+// stored messages are only retrieved from mailgun's api, nobody else may get the api key
+func isMailgunStorageURL(messageURL string) bool {
+	parsedURL, err := url.Parse(messageURL)
+	if err != nil || parsedURL.Scheme != "https" || parsedURL.Port() != "" || parsedURL.User != nil {
+		return false
+	}
+	host := strings.ToLower(parsedURL.Hostname())
+	for _, apiHost := range []string{"api.mailgun.net", "api.eu.mailgun.net"} {
+		if host == apiHost || strings.HasSuffix(host, "."+apiHost) {
+			return true
+		}
+	}
+	return false
+}
+
+// with store and notify mailgun only sends a link to the stored message
+func fetchMailgunMessage(messageURL string, apiKey string) ([]byte, error) {
+	if apiKey == "" {
+		return nil, errors.New("api_key needs to be defined for the mailgun inbound webhook to retrieve stored messages")
+	}
+	if !isMailgunStorageURL(messageURL) {
+		return nil, fmt.Errorf("message-url %s doesn't point to mailgun's api", messageURL)
+	}
+
+	lg.Logf("retrieving stored message from %s\n", messageURL)
+	request, err := http.NewRequest(http.MethodGet, messageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.SetBasicAuth("api", apiKey)
+	request.Header.Set("Accept", "message/rfc2822")
+	client := &http.Client{
+		Timeout: time.Minute,
+		// don't follow redirects with the api key
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to retrieve stored mailgun message, status %s", response.Status)
+	}
+
+	type StoredMessage struct {
+		BodyMime string `json:"body-mime"`
+	}
+	var storedMessage StoredMessage
+	if err := json.NewDecoder(response.Body).Decode(&storedMessage); err != nil {
+		return nil, err
+	}
+	return []byte(storedMessage.BodyMime), nil
+}
+
+// retrieve stored messages with the api key of the webhook that received the notification
+// the message is put into body-mime, like mailgun does when forwarding the raw MIME
+func (mailgunProvider) PrepareDump(webhook *glb.InboundWebhook, body []byte) ([]byte, error) {
+	mailgunFields, err := getMultipartFields(body)
+	if err != nil {
+		return nil, err
+	}
+	if getField(mailgunFields, "body-mime") != "" {
+		return body, nil
+	}
+	messageURL := getField(mailgunFields, "message-url")
+	if messageURL == "" {
+		return nil, errors.New("mailgun webhook contains neither body-mime nor message-url")
+	}
+	rawEmail, err := fetchMailgunMessage(messageURL, webhook.APIKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var dump bytes.Buffer
+	writer := multipart.NewWriter(&dump)
+	for name, values := range mailgunFields {
+		if name == "message-url" {
+			continue
+		}
+		for _, value := range values {
+			if err := writer.WriteField(name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := writer.WriteField("body-mime", string(rawEmail)); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return dump.Bytes(), nil
+}
+
+func (mailgunProvider) GetEnvelope(body []byte, cfg *glb.Config) (*glb.InboundEnvelope, error) {
+	mailgunFields, err := getMultipartFields(body)
+	if err != nil {
+		lg.Logf("failed to parse mailgun fields")
+		return nil, err
+	}
+
+	// stored messages have been retrieved before dumping
+	rawEmail := []byte(getField(mailgunFields, "body-mime"))
+	if len(rawEmail) == 0 {
+		return nil, errors.New("mailgun dump doesn't contain body-mime")
+	}
+
+	spamScore, err := parseSpamScore(getField(mailgunFields, "X-Mailgun-Sscore"))
+	if err != nil {
+		lg.Logf("failed to get spam score")
+		return nil, err
+	}
+
+	envelope := &glb.InboundEnvelope{
+		RawEmail:  rawEmail,
+		From:      getField(mailgunFields, "sender"),
+		SpamScore: spamScore,
+	}
+	for _, recipient := range strings.Split(getField(mailgunFields, "recipient"), ",") {
+		if strings.TrimSpace(recipient) != "" {
+			envelope.To = append(envelope.To, strings.TrimSpace(recipient))
+		}
+	}
+	if msg, err := mail.ReadMessage(bytes.NewReader(rawEmail)); err == nil {
+		envelope.SenderIP = getSenderIPFromReceivedSPF(msg.Header)
+	}
+	return envelope, nil
+}
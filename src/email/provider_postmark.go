@@ -0,0 +1,81 @@
+// postmark's inbound webhook with 'Include raw email content in JSON payload' enabled //
+package email
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+type postmarkProvider struct{}
+
+func (postmarkProvider) DumpExtension() string {
+	return ".postmark"
+}
+
+// postmark's inbound webhook only supports the token
+func (postmarkProvider) Authenticate(webhook *glb.InboundWebhook, request *http.Request, body []byte) error {
+	return nil
+}
+
+func (postmarkProvider) PrepareDump(webhook *glb.InboundWebhook, body []byte) ([]byte, error) {
+	return body, nil
+}
+
+func (postmarkProvider) GetEnvelope(body []byte, cfg *glb.Config) (*glb.InboundEnvelope, error) {
+	type PostmarkHeader struct {
+		Name  string `json:"Name"`
+		Value string `json:"Value"`
+	}
+	type PostmarkInbound struct {
+		OriginalRecipient string           `json:"OriginalRecipient"`
+		Headers           []PostmarkHeader `json:"Headers"`
+		RawEmail          string           `json:"RawEmail"`
+	}
+	var postmarkInbound PostmarkInbound
+	err := json.Unmarshal(body, &postmarkInbound)
+	if err != nil {
+		lg.Logf("failed to parse postmark json")
+		return nil, err
+	}
+	if postmarkInbound.RawEmail == "" {
+		return nil, errors.New("postmark webhook doesn't contain the raw email, enable 'Include raw email content in JSON payload'")
+	}
+
+	envelope := &glb.InboundEnvelope{
+		RawEmail: []byte(postmarkInbound.RawEmail),
+	}
+	if postmarkInbound.OriginalRecipient != "" {
+		envelope.To = []string{postmarkInbound.OriginalRecipient}
+	}
+	// postmark prepends its headers, later ones might have been added by the sender
+	foundSpamScore, foundReturnPath := false, false
+	for _, header := range postmarkInbound.Headers {
+		switch {
+		case header.Name == "X-Spam-Score" && !foundSpamScore:
+			foundSpamScore = true
+			envelope.SpamScore, err = parseSpamScore(header.Value)
+			if err != nil {
+				lg.Logf("failed to get spam score")
+				return nil, err
+			}
+		case header.Name == "Return-Path" && !foundReturnPath:
+			foundReturnPath = true
+			if returnPath, err := mail.ParseAddress(header.Value); err == nil {
+				envelope.From = returnPath.Address
+			}
+		}
+		if foundSpamScore && foundReturnPath {
+			break
+		}
+	}
+	if msg, err := mail.ReadMessage(bytes.NewReader(envelope.RawEmail)); err == nil {
+		envelope.SenderIP = getSenderIPFromReceivedSPF(msg.Header)
+	}
+	return envelope, nil
+}
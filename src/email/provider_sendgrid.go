@@ -0,0 +1,101 @@
+// sendgrid's inbound parse webhook with 'Send Raw' and 'Spam Check' enabled //
+package email
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+const (
+	sendgridEventSignatureHeader = "X-Twilio-Email-Event-Webhook-Signature"
+	sendgridEventTimestampHeader = "X-Twilio-Email-Event-Webhook-Timestamp"
+)
+
+type sendgridProvider struct{}
+
+func (sendgridProvider) DumpExtension() string {
+	return ".dump"
+}
+
+// sendgrid's inbound parse webhook only supports the token
+func (sendgridProvider) Authenticate(webhook *glb.InboundWebhook, request *http.Request, body []byte) error {
+	return nil
+}
+
+func (sendgridProvider) PrepareDump(webhook *glb.InboundWebhook, body []byte) ([]byte, error) {
+	return body, nil
+}
+
+func (sendgridProvider) GetEnvelope(body []byte, cfg *glb.Config) (*glb.InboundEnvelope, error) {
+	sendgridFields, err := getMultipartFields(body)
+	if err != nil {
+		lg.Logf("failed to parse sendgrid fields")
+		return nil, err
+	}
+
+	spamScore, err := strconv.ParseFloat(getField(sendgridFields, "spam_score"), 64)
+	if err != nil {
+		lg.Logf("failed to get spam score")
+		return nil, err
+	}
+
+	// when the email got to the inbound_parser via bcc, the bcc address will be in this to address
+	type Envelope struct {
+		To   []string `json:"to"`
+		From string   `json:"from"`
+	}
+	var envelope *Envelope
+	err = json.Unmarshal([]byte(getField(sendgridFields, "envelope")), &envelope)
+	if err != nil {
+		lg.Logf("failed to get sendgrid mail envelope")
+		return nil, err
+	}
+
+	return &glb.InboundEnvelope{
+		RawEmail:  []byte(getField(sendgridFields, "email")),
+		From:      envelope.From,
+		To:        envelope.To,
+		SenderIP:  getField(sendgridFields, "sender_ip"),
+		SpamScore: spamScore,
+	}, nil
+}
+
+// true when the request claims to come from sendgrid's signed event webhook
+func IsSignedSendgridEvent(request *http.Request) bool {
+	return request.Header.Get(sendgridEventSignatureHeader) != "" || request.Header.Get(sendgridEventTimestampHeader) != ""
+}
+
+// sendgrid signs the timestamp followed by the raw body with ECDSA
+// events with a timestamp older than sendgrid_event_max_age_seconds are rejected to prevent replays
+func VerifySendgridEvent(cfg *glb.Config, request *http.Request, body []byte) error {
+	timestampStr := request.Header.Get(sendgridEventTimestampHeader)
+	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid sendgrid event timestamp '%s'", timestampStr)
+	}
+	age := time.Since(time.Unix(timestamp, 0))
+	maxAge := time.Duration(cfg.SendgridEventMaxAgeSeconds) * time.Second
+	if age > maxAge || age < -maxAge {
+		return fmt.Errorf("stale sendgrid event, timestamp is %s old", age.Round(time.Second))
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(request.Header.Get(sendgridEventSignatureHeader))
+	if err != nil {
+		return errors.New("sendgrid event signature isn't base64 encoded")
+	}
+	hash := sha256.Sum256(append([]byte(timestampStr), body...))
+	if !ecdsa.VerifyASN1(cfg.SendgridEventKey, hash[:], signature) {
+		return errors.New("invalid sendgrid event signature")
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// cut quoted replies and signatures from email bodies //
+package email
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// Outlook's header block of the quoted email, starts with the From line
+	outlookFromRegex   = regexp.MustCompile(`(?i)^(from|von|de|van|da):\s*\S`)
+	outlookHeaderRegex = regexp.MustCompile(`(?i)^(sent|gesendet|date|datum|to|an|cc|subject|betreff):\s*`)
+	originalMessage    = regexp.MustCompile(`(?i)^-{2,}\s*(original message|ursprüngliche nachricht|original nachricht)\s*-*$`)
+	// everything below belongs to the forwarded email, none of it is a quote
+	forwardedMessage = regexp.MustCompile(`(?i)^(-{2,}\s*(forwarded message|weitergeleitete nachricht)\s*-*|begin forwarded message:|anfang der weitergeleiteten nachricht:)$`)
+	forwardSubject   = regexp.MustCompile(`(?i)^\s*(fwd?|wg|tr|rv|doorst)\s*:`)
+	// Gmail and Apple Mail, the line might be wrapped
+	onWroteRegex   = regexp.MustCompile(`(?i)^(on|am) .+ (wrote|schrieb)( .+)?:$`)
+	wroteOnRegex   = regexp.MustCompile(`(?i)^.+ (schrieb am|wrote on) .+:$`)
+	signatureRegex = regexp.MustCompile(`^--\s*$`)
+	// Outlook's plain text separator above the From line
+	separatorRegex   = regexp.MustCompile(`^_{10,}$`)
+	mobileDevices    = `(iphone|ipad|android|samsung|galaxy|huawei|xiaomi|blackberry|smartphone|handy|tablet|mobile|outlook|mail|yahoo)`
+	mobileSignatures = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)^(sent|gesendet) (from|von|with|mit|via) .{0,30}` + mobileDevices + `.{0,20}$`),
+		regexp.MustCompile(`(?i)^von meine(m|n)? .{0,30}` + mobileDevices + `.{0,20} gesendet\.?$`),
+		// plain text bodies keep the link, e.g. Get Outlook for iOS<https://aka.ms/o0ukef>
+		regexp.MustCompile(`(?i)^(get|holen sie sich) outlook (for|für) (ios|android)\.?\s*(<[^>]*>)?$`),
+	}
+)
+
+// remove jira wiki markup a line converted from html might contain, e.g. *From:* or \-\-
+func normalizeReplyLine(line string) string {
+	line = strings.ReplaceAll(line, "\\", "")
+	line = strings.ReplaceAll(line, "*", "")
+	line = strings.ReplaceAll(line, "{quote}", "")
+	return strings.TrimSpace(line)
+}
+
+func isQuotedLine(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), ">")
+}
+
+// return true iff the quote header of another email starts at lines[idx]
+func isQuoteHeader(lines []string, idx int) bool {
+	line := normalizeReplyLine(lines[idx])
+	if originalMessage.MatchString(line) || onWroteRegex.MatchString(line) || wroteOnRegex.MatchString(line) {
+		return true
+	}
+	// wrapped On ... wrote: line
+	if idx+1 < len(lines) {
+		joined := line + " " + normalizeReplyLine(lines[idx+1])
+		if strings.HasPrefix(strings.ToLower(line), "on ") || strings.HasPrefix(strings.ToLower(line), "am ") {
+			if onWroteRegex.MatchString(joined) {
+				return true
+			}
+		}
+	}
+	// Outlook's From: needs to be followed by other headers
+	if outlookFromRegex.MatchString(line) {
+		for next := idx + 1; next < len(lines) && next <= idx+4; next++ {
+			if outlookHeaderRegex.MatchString(normalizeReplyLine(lines[next])) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isSignatureStart(line string) bool {
+	// converted html bodies lose the trailing space of the delimiter
+	if signatureRegex.MatchString(line) || normalizeReplyLine(line) == "--" {
+		return true
+	}
+	normalized := normalizeReplyLine(line)
+	for _, mobileSignature := range mobileSignatures {
+		if mobileSignature.MatchString(normalized) {
+			return true
+		}
+	}
+	return false
+}
+
+// return true iff only quoted or empty lines follow lines[idx]
+func onlyQuotedLinesFollow(lines []string, idx int) bool {
+	for _, line := range lines[idx:] {
+		if strings.TrimSpace(line) != "" && !isQuotedLine(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// forwarded emails would lose their content, Outlook doesn't mark them in the body
+func IsForwardSubject(subject string) bool {
+	return forwardSubject.MatchString(subject)
+}
+
+// the header lines of some webmailers precede the From line, e.g. GMX's Gesendet:
+// Outlook puts a separator above them
+func headerStart(lines []string, idx int) int {
+	for idx > 0 && outlookHeaderRegex.MatchString(normalizeReplyLine(lines[idx-1])) {
+		idx--
+	}
+	if idx > 0 && separatorRegex.MatchString(normalizeReplyLine(lines[idx-1])) {
+		idx--
+	}
+	return idx
+}
+
+// split the body into the actual reply and the stripped quoted thread and signature
+// the remainder is empty when nothing has been stripped
+// when nothing but quotes would be left the body is returned unchanged
+// nothing after the marker of a forwarded email is stripped
+func StripQuotedReply(body string) (string, string) {
+	lines := strings.Split(body, "\n")
+	cut := len(lines)
+	for idx, line := range lines {
+		if forwardedMessage.MatchString(normalizeReplyLine(line)) {
+			break
+		}
+		if isQuoteHeader(lines, idx) {
+			cut = headerStart(lines, idx)
+			break
+		}
+		if isSignatureStart(line) {
+			cut = idx
+			break
+		}
+		// top posting above a quoted thread
+		if isQuotedLine(line) && onlyQuotedLinesFollow(lines, idx) {
+			cut = idx
+			break
+		}
+	}
+
+	reply := strings.TrimSpace(strings.Join(lines[:cut], "\n"))
+	remainder := strings.TrimSpace(strings.Join(lines[cut:], "\n"))
+	if reply == "" {
+		return body, ""
+	}
+	// don't leave an unclosed quote behind
+	if strings.Count(reply, "{quote}")%2 != 0 {
+		reply += "\n{quote}"
+	}
+	return reply, remainder
+}
@@ -0,0 +1,77 @@
+package email
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// every testdata/reply_extraction/<name>.body.txt is stripped and compared with <name>.reply.txt
+// <name>.body.html is converted to jira wiki markup first, like html bodies are
+func TestStripQuotedReply(t *testing.T) {
+	bodyPaths, err := filepath.Glob(filepath.Join("testdata", "reply_extraction", "*.body.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bodyPaths) == 0 {
+		t.Fatal("no reply extraction testdata found")
+	}
+	for _, bodyPath := range bodyPaths {
+		name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(bodyPath), filepath.Ext(bodyPath)), ".body")
+		t.Run(name, func(t *testing.T) {
+			content, err := os.ReadFile(bodyPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := string(content)
+			if filepath.Ext(bodyPath) == ".html" {
+				body, err = htmlToWiki(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := os.ReadFile(filepath.Join("testdata", "reply_extraction", name+".reply.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply, remainder := StripQuotedReply(body)
+			// the body is returned unchanged when nothing is left
+			reply = strings.TrimSpace(reply)
+			if reply != strings.TrimSpace(string(expected)) {
+				t.Errorf("unexpected reply:\n%s\n\nexpected:\n%s", reply, expected)
+			}
+			// nothing must get lost
+			if !strings.Contains(body, remainder) {
+				t.Errorf("remainder isn't part of the body:\n%s", remainder)
+			}
+			if reply == strings.TrimSpace(body) && remainder != "" {
+				t.Errorf("nothing has been stripped but the remainder isn't empty:\n%s", remainder)
+			}
+		})
+	}
+}
+
+func TestIsForwardSubject(t *testing.T) {
+	subjects := map[string]bool{
+		"Fwd: Login fails":         true,
+		"FW: [ILC-1] Printer":      true,
+		"WG: Druckerstörung":       true,
+		"RE: Fwd: Login fails":     false,
+		"AW: [ILC-1] Printer":      false,
+		"Forward planning meeting": false,
+	}
+	for subject, expected := range subjects {
+		if IsForwardSubject(subject) != expected {
+			t.Errorf("IsForwardSubject(%q) isn't %t", subject, expected)
+		}
+	}
+}
+
+func TestStripQuotedReplyClosesQuote(t *testing.T) {
+	body := "{quote}\nquoted in the reply\n\nOn Mon, Oct 5, 2026 at 10:00 AM Alice <alice@example.com> wrote:\nold\n{quote}"
+	reply, _ := StripQuotedReply(body)
+	if strings.Count(reply, "{quote}") != 2 {
+		t.Errorf("quote hasn't been closed:\n%s", reply)
+	}
+}
@@ -0,0 +1,200 @@
+// decompress and convert rtf bodies, used for TNEF //
+package email
+
+import (
+	"encoding/binary"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+const (
+	rtfCompressed   = 0x75465a4c // LZFu
+	rtfUncompressed = 0x414c454d // MELA
+	rtfDictSize     = 4096
+	// the dictionary starts out with this, see MS-OXRTFCP
+	rtfPrebuf = "{\\rtf1\\ansi\\mac\\deff0\\deftab720{\\fonttbl;}{\\f0\\fnil \\froman \\fswiss \\fmodern \\fscript \\fdecor MS Sans SerifSymbolArialTimes New RomanCourier{\\colortbl\\red0\\green0\\blue0\r\n\\par \\pard\\plain\\f0\\fs20\\b\\i\\u\\tab\\tx"
+)
+
+// rtf destinations that don't contain any text of the body
+var rtfSkippedDestinations = map[string]struct{}{
+	"fonttbl": {}, "colortbl": {}, "stylesheet": {}, "info": {}, "pict": {}, "object": {},
+	"header": {}, "headerl": {}, "headerr": {}, "headerf": {}, "footer": {}, "footerl": {}, "footerr": {}, "footerf": {},
+	"footnote": {}, "themedata": {}, "colorschememapping": {}, "datastore": {}, "latentstyles": {},
+	"listtable": {}, "listoverridetable": {}, "rsidtbl": {}, "generator": {}, "xmlnstbl": {}, "fldinst": {},
+}
+
+var rtfControlWordRegex = regexp.MustCompile(`^([a-zA-Z]+)(-?\d+)? ?`)
+
+// decompress PR_RTF_COMPRESSED
+func decompressRTF(data []byte) ([]byte, error) {
+	if len(data) < 16 {
+		return nil, errors.New("compressed rtf is truncated")
+	}
+	rawSize := binary.LittleEndian.Uint32(data[4:])
+	compType := binary.LittleEndian.Uint32(data[8:])
+	input := data[16:]
+	if compType == rtfUncompressed {
+		return input, nil
+	}
+	if compType != rtfCompressed {
+		return nil, errors.New("unknown rtf compression")
+	}
+
+	dict := make([]byte, rtfDictSize)
+	copy(dict, rtfPrebuf)
+	writePos := len(rtfPrebuf)
+	// rawSize is given by the sender, a reference of 2 bytes expands to at most 17 bytes
+	capacity := int64(rawSize)
+	if capacity > int64(len(input))*9 {
+		capacity = int64(len(input)) * 9
+	}
+	output := make([]byte, 0, capacity)
+	pos := 0
+	for pos < len(input) {
+		control := input[pos]
+		pos++
+		for bit := 0; bit < 8 && pos < len(input); bit++ {
+			if control&(1<<bit) == 0 {
+				dict[writePos] = input[pos]
+				writePos = (writePos + 1) % rtfDictSize
+				output = append(output, input[pos])
+				pos++
+				continue
+			}
+			if pos+1 >= len(input) {
+				return nil, errors.New("compressed rtf is truncated")
+			}
+			reference := int(binary.BigEndian.Uint16(input[pos:]))
+			pos += 2
+			offset := reference >> 4
+			// reaching the write position marks the end
+			if offset == writePos {
+				return output, nil
+			}
+			for idx := 0; idx < reference&0xf+2; idx++ {
+				char := dict[(offset+idx)%rtfDictSize]
+				dict[writePos] = char
+				writePos = (writePos + 1) % rtfDictSize
+				output = append(output, char)
+			}
+		}
+	}
+	return output, nil
+}
+
+type rtfGroupState struct {
+	skip    bool
+	htmlrtf bool
+	ucSkip  int
+}
+
+// return the text of an rtf document, including html encapsulated in rtf by Outlook
+// formatting is dropped, only line breaks are kept
+func rtfToText(rtf []byte) string {
+	var text strings.Builder
+	state := rtfGroupState{ucSkip: 1}
+	var stack []rtfGroupState
+	// characters still to be skipped after a \u
+	pendingSkip := 0
+	// the first control word of a group decides if it is a destination
+	groupStart := false
+
+	write := func(char rune) {
+		if pendingSkip > 0 {
+			pendingSkip--
+			return
+		}
+		if !state.skip && !state.htmlrtf {
+			text.WriteRune(char)
+		}
+	}
+
+	for pos := 0; pos < len(rtf); pos++ {
+		char := rtf[pos]
+		switch char {
+		case '{':
+			stack = append(stack, state)
+			groupStart = true
+			continue
+		case '}':
+			if len(stack) != 0 {
+				state = stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+			}
+			groupStart = false
+			continue
+		case '\r', '\n':
+			continue
+		case '\\':
+		default:
+			groupStart = false
+			write(rune(char))
+			continue
+		}
+
+		// control symbol or word
+		if pos+1 >= len(rtf) {
+			break
+		}
+		next := rtf[pos+1]
+		if !(next >= 'a' && next <= 'z' || next >= 'A' && next <= 'Z') {
+			pos++
+			switch next {
+			case '\\', '{', '}':
+				write(rune(next))
+			case '\'':
+				if pos+2 < len(rtf) {
+					if value, err := strconv.ParseUint(string(rtf[pos+1:pos+3]), 16, 8); err == nil {
+						write(charmap.Windows1252.DecodeByte(byte(value)))
+					}
+					pos += 2
+				}
+			case '*':
+				// ignorable destination
+				state.skip = true
+			case '~':
+				write(' ')
+			case '\r', '\n':
+				write('\n')
+			}
+			groupStart = false
+			continue
+		}
+
+		match := rtfControlWordRegex.FindSubmatch(rtf[pos+1:])
+		pos += len(match[0])
+		word := string(match[1])
+		param, hasParam := 0, len(match[2]) != 0
+		if hasParam {
+			param, _ = strconv.Atoi(string(match[2]))
+		}
+		if _, found := rtfSkippedDestinations[word]; found && groupStart {
+			state.skip = true
+		}
+		groupStart = false
+		switch word {
+		case "par", "line", "row":
+			// html encapsulated by Outlook hides its line breaks behind \htmlrtf
+			if !state.skip {
+				text.WriteRune('\n')
+			}
+		case "tab", "cell":
+			write('\t')
+		case "htmlrtf":
+			state.htmlrtf = !hasParam || param != 0
+		case "uc":
+			state.ucSkip = param
+		case "u":
+			if param < 0 {
+				param += 65536
+			}
+			write(rune(param))
+			pendingSkip = state.ucSkip
+		}
+	}
+	return manyNewlinesRegex.ReplaceAllString(text.String(), "\n\n")
+}
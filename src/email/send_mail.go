@@ -3,49 +3,72 @@ package email
 
 import (
 	"bytes"
+	"database/sql"
 	"fmt"
 	"html/template"
 	"net/mail"
+	"strings"
 
 	"gopkg.in/gomail.v2"
 
+	db "github.ibmgcloud.net/dth/inbound_parser/db"
 	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
 	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
 )
 
-func sendMail(cfg *glb.Config, from *mail.Address, to *mail.Address, subject string, body string) error {
+// inReplyTo is the email being answered, its message ids keep the thread together
+// return the message id of the sent email
+func sendMail(cfg *glb.Config, from *mail.Address, to *mail.Address, subject string, body string, inReplyTo *glb.Email) (string, error) {
+	messageId := generateMessageId(from)
 	m := gomail.NewMessage()
 	m.SetAddressHeader("From", from.Address, from.Name)
 	m.SetAddressHeader("To", to.Address, to.Name)
 	m.SetHeader("Subject", subject)
 	m.SetHeader("Auto-Submitted", "auto-generated")
+	m.SetHeader("Message-ID", messageId)
+	if inReplyTo != nil && inReplyTo.MessageId != "" {
+		references := inReplyTo.References
+		if len(references) == 0 {
+			references = inReplyTo.InReplyTo
+		}
+		m.SetHeader("In-Reply-To", inReplyTo.MessageId)
+		m.SetHeader("References", strings.Join(append(append([]string{}, references...), inReplyTo.MessageId), " "))
+	}
 
 	m.AddAlternative("text/plain", body)
 
 	dialer := gomail.NewPlainDialer(cfg.SendEMailHost, cfg.SendEMailPort, "", "")
 	lg.Logf("sending mail at %s from %s: %s\n", FormatAddr(to), FormatAddr(from), subject)
 	if err := dialer.DialAndSend(m); err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	return messageId, nil
 }
 
-func sendReplyEmail(cfg *glb.Config, email *glb.Email, template *template.Template, templateData any, subject string, from *mail.Address) error {
-	var buffer bytes.Buffer
-	err := template.Execute(&buffer, templateData)
+// return the message id of the sent email
+// return an empty message id when the recipient is suppressed
+func sendReplyEmail(cfg *glb.Config, email *glb.Email, template *template.Template, templateData any, subject string, from *mail.Address, idb *sql.DB) (string, error) {
+	suppressed, err := db.IsSuppressed(idb, email.From.Address)
 	if err != nil {
-		return err
+		return "", err
+	}
+	if suppressed {
+		lg.Logf("don't send emails to %s, it bounced before\n", FormatAddr(email.From))
+		return "", nil
 	}
 
-	body := buffer.String() + "\n" + getQuotedTextBody(email)
-	err = sendMail(cfg, from, email.From, subject, body)
+	var buffer bytes.Buffer
+	err = template.Execute(&buffer, templateData)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+
+	body := buffer.String() + "\n" + getQuotedTextBody(email)
+	return sendMail(cfg, from, email.From, subject, body, email)
 }
 
-func SendRequestCreatedEmail(srd *glb.ServiceDesk, email *glb.Email, request *glb.Request) error {
+// replies to this email are assigned to the request even when the subject gets changed
+func SendRequestCreatedEmail(srd *glb.ServiceDesk, email *glb.Email, request *glb.Request, idb *sql.DB) error {
 	if !srd.JiraInstall.Cfg.SendEmails {
 		lg.Logf("don't send emails when send_emails is disabled")
 		return nil
@@ -61,11 +84,16 @@ func SendRequestCreatedEmail(srd *glb.ServiceDesk, email *glb.Email, request *gl
 	}
 	subject := fmt.Sprintf("%s %s", request.IssueKey, email.Subject)
 	template := srd.RequestCreationEmailTextPlainTemplate
-	sendReplyEmail(srd.JiraInstall.Cfg, email, template, &templateData, subject, srd.ReplyAddress)
+	messageId, err := sendReplyEmail(srd.JiraInstall.Cfg, email, template, &templateData, subject, srd.ReplyAddress, idb)
+	if err == nil && messageId != "" {
+		if err := db.SetMessageIssueKey(idb, messageId, srd.JiraInstall.URL, request.IssueKey); err != nil {
+			lg.LogeNoMail(err)
+		}
+	}
 	return nil
 }
 
-func SendWrongAddressErrorEmail(jiraInstall *glb.JiraInstall, email *glb.Email) error {
+func SendWrongAddressErrorEmail(jiraInstall *glb.JiraInstall, email *glb.Email, idb *sql.DB) error {
 	if !jiraInstall.Cfg.SendEmails {
 		lg.Logf("don't send emails when send_emails is disabled")
 		return nil
@@ -79,6 +107,6 @@ func SendWrongAddressErrorEmail(jiraInstall *glb.JiraInstall, email *glb.Email)
 	}
 	subject := fmt.Sprintf("%s %s", jiraInstall.RejectedMailSubject, email.Subject)
 	template := jiraInstall.RejectedMailTemplate
-	sendReplyEmail(jiraInstall.Cfg, email, template, &templateData, subject, jiraInstall.ReplyAddress)
+	sendReplyEmail(jiraInstall.Cfg, email, template, &templateData, subject, jiraInstall.ReplyAddress, idb)
 	return nil
 }
@@ -0,0 +1,265 @@
+// evaluate SPF, DKIM and DMARC to find out whether the header from address is genuine //
+package email
+
+import (
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+// one method's result within an Authentication-Results header, RFC 8601
+type authResult struct {
+	Method string
+	Result string
+	// ptype.property, e.g. smtp.mailfrom or header.d
+	Props map[string]string
+}
+
+func getDomain(address string) string {
+	return strings.ToLower(strings.TrimSpace(address[strings.LastIndex(address, "@")+1:]))
+}
+
+// relaxed alignment, one domain is the other or a subdomain of it
+func domainsAligned(domain string, otherDomain string) bool {
+	if domain == "" || otherDomain == "" {
+		return false
+	}
+	return domain == otherDomain || strings.HasSuffix(domain, "."+otherDomain) || strings.HasSuffix(otherDomain, "."+domain)
+}
+
+// remove (comments), they may be nested but not within quotes
+func stripHeaderComments(value string) string {
+	var stripped strings.Builder
+	depth := 0
+	quoted := false
+	for idx := 0; idx < len(value); idx++ {
+		char := value[idx]
+		switch {
+		case char == '\\' && idx+1 < len(value):
+			if depth == 0 {
+				stripped.WriteByte(char)
+				stripped.WriteByte(value[idx+1])
+			}
+			idx++
+			continue
+		case char == '"' && depth == 0:
+			quoted = !quoted
+		case char == '(' && !quoted:
+			depth++
+			continue
+		case char == ')' && !quoted && depth > 0:
+			depth--
+			continue
+		}
+		if depth == 0 {
+			stripped.WriteByte(char)
+		}
+	}
+	return stripped.String()
+}
+
+// return the authserv-id and the results of an Authentication-Results header
+func parseAuthResults(value string) (string, []authResult) {
+	parts := strings.Split(stripHeaderComments(value), ";")
+	fields := strings.Fields(parts[0])
+	if len(fields) == 0 {
+		return "", nil
+	}
+	authservId := strings.ToLower(fields[0])
+	var results []authResult
+	for _, part := range parts[1:] {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		method, result, found := strings.Cut(fields[0], "=")
+		if !found {
+			// e.g. none
+			continue
+		}
+		method, _, _ = strings.Cut(method, "/")
+		parsed := authResult{Method: strings.ToLower(method), Result: strings.ToLower(result), Props: make(map[string]string)}
+		for _, field := range fields[1:] {
+			prop, propValue, found := strings.Cut(field, "=")
+			if found && strings.Contains(prop, ".") {
+				parsed.Props[strings.ToLower(prop)] = strings.Trim(propValue, `"`)
+			}
+		}
+		results = append(results, parsed)
+	}
+	return authservId, results
+}
+
+func containsFold(values []string, value string) bool {
+	for _, other := range values {
+		if strings.EqualFold(other, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// results of all Authentication-Results headers added by trusted mail servers, topmost first
+// none are trusted without trusted_authserv_ids, senders can add the header themselves
+func getTrustedAuthResults(cfg *glb.Config, header textproto.MIMEHeader) []authResult {
+	var trustedResults []authResult
+	for _, value := range header.Values("Authentication-Results") {
+		authservId, results := parseAuthResults(value)
+		if containsFold(cfg.TrustedAuthservIds, authservId) {
+			trustedResults = append(trustedResults, results...)
+		} else {
+			lg.Logf("ignoring Authentication-Results of untrusted %s\n", authservId)
+		}
+	}
+	return trustedResults
+}
+
+// results of the latest ARC set, only when sealed by a trusted forwarder
+func getTrustedARCResults(cfg *glb.Config, header textproto.MIMEHeader) []authResult {
+	latestInstance := 0
+	var latestResults []authResult
+	for _, value := range header.Values("ARC-Authentication-Results") {
+		// starts with the instance, i.e. i=1; authserv-id; ...
+		instanceTag, rest, _ := strings.Cut(value, ";")
+		_, instanceStr, _ := strings.Cut(instanceTag, "=")
+		instance, err := strconv.Atoi(strings.TrimSpace(instanceStr))
+		if err != nil || instance <= latestInstance {
+			continue
+		}
+		authservId, results := parseAuthResults(rest)
+		if !containsFold(cfg.TrustedARCAuthservIds, authservId) {
+			lg.Logf("ignoring ARC-Authentication-Results of untrusted %s\n", authservId)
+			continue
+		}
+		latestInstance = instance
+		latestResults = results
+	}
+	return latestResults
+}
+
+// evaluate the results together with the domains of locally verified DKIM signatures
+func evaluateAuthResults(results []authResult, localDKIMDomains []string, fromDomain string, envelopeFromDomain string) *glb.SenderAuthentication {
+	senderAuth := &glb.SenderAuthentication{DKIMDomains: append([]string{}, localDKIMDomains...)}
+	for _, result := range results {
+		switch result.Method {
+		case "spf":
+			senderAuth.SPF = result.Result
+			senderAuth.SPFDomain = getDomain(result.Props["smtp.mailfrom"])
+			if senderAuth.SPFDomain == "" {
+				senderAuth.SPFDomain = envelopeFromDomain
+			}
+		case "dkim":
+			// one passing signature is enough
+			if senderAuth.DKIM != "pass" {
+				senderAuth.DKIM = result.Result
+			}
+			if result.Result != "pass" {
+				continue
+			}
+			domain := strings.ToLower(result.Props["header.d"])
+			if domain == "" && result.Props["header.i"] != "" {
+				domain = getDomain(result.Props["header.i"])
+			}
+			if domain != "" && !containsFold(senderAuth.DKIMDomains, domain) {
+				senderAuth.DKIMDomains = append(senderAuth.DKIMDomains, domain)
+			}
+		case "dmarc":
+			senderAuth.DMARC = result.Result
+		}
+	}
+	if len(localDKIMDomains) != 0 {
+		senderAuth.DKIM = "pass"
+	}
+
+	switch senderAuth.DMARC {
+	case "pass":
+		senderAuth.Aligned = true
+	case "fail":
+		senderAuth.Aligned = false
+	default:
+		for _, domain := range senderAuth.DKIMDomains {
+			if domainsAligned(domain, fromDomain) {
+				senderAuth.Aligned = true
+			}
+		}
+		if senderAuth.SPF == "pass" && domainsAligned(senderAuth.SPFDomain, fromDomain) {
+			senderAuth.Aligned = true
+		}
+	}
+	return senderAuth
+}
+
+// rawEmail is the email as received, signatures break once anything got unwrapped
+func getSenderAuthentication(cfg *glb.Config, rawEmail []byte, header textproto.MIMEHeader, fromAddress string, envelopeFromAddress string) *glb.SenderAuthentication {
+	fromDomain := getDomain(fromAddress)
+	envelopeFromDomain := getDomain(envelopeFromAddress)
+	var localDKIMDomains []string
+	if cfg.VerifyDKIM {
+		localDKIMDomains = verifyDKIM(rawEmail)
+	}
+
+	results := getTrustedAuthResults(cfg, header)
+	senderAuth := evaluateAuthResults(results, localDKIMDomains, fromDomain, envelopeFromDomain)
+	if senderAuth.Aligned || len(cfg.TrustedARCAuthservIds) == 0 {
+		return senderAuth
+	}
+
+	// forwarders like mailing lists break SPF and DKIM, their ARC seal keeps the original results
+	arcPassed := false
+	for _, result := range results {
+		if result.Method == "arc" && result.Result == "pass" {
+			arcPassed = true
+		}
+	}
+	if !arcPassed {
+		return senderAuth
+	}
+	arcResults := getTrustedARCResults(cfg, header)
+	if len(arcResults) == 0 {
+		return senderAuth
+	}
+	arcSenderAuth := evaluateAuthResults(arcResults, localDKIMDomains, fromDomain, envelopeFromDomain)
+	if !arcSenderAuth.Aligned {
+		return senderAuth
+	}
+	lg.Logf("sender is authenticated by the ARC-Authentication-Results of a trusted forwarder")
+	arcSenderAuth.ViaARC = true
+	return arcSenderAuth
+}
+
+func getSenderAuthStatsStr(email *glb.Email) string {
+	senderAuth := email.SenderAuth
+	if senderAuth == nil {
+		return ""
+	}
+	var results []string
+	if senderAuth.SPF != "" {
+		results = append(results, fmt.Sprintf("SPF %s", senderAuth.SPF))
+	}
+	if senderAuth.DKIM != "" {
+		if len(senderAuth.DKIMDomains) != 0 {
+			results = append(results, fmt.Sprintf("DKIM %s (%s)", senderAuth.DKIM, strings.Join(senderAuth.DKIMDomains, ", ")))
+		} else {
+			results = append(results, fmt.Sprintf("DKIM %s", senderAuth.DKIM))
+		}
+	}
+	if senderAuth.DMARC != "" {
+		results = append(results, fmt.Sprintf("DMARC %s", senderAuth.DMARC))
+	}
+	if len(results) == 0 {
+		results = append(results, "no results")
+	}
+	if senderAuth.ViaARC {
+		results = append(results, "via ARC")
+	}
+	if senderAuth.Aligned {
+		results = append(results, "sender authenticated")
+	} else {
+		results = append(results, "sender not authenticated")
+	}
+	return fmt.Sprintf("Sender Authentication: %s\n", strings.Join(results, ", "))
+}
@@ -0,0 +1,347 @@
+// decode TNEF attachments, i.e. Outlook's winmail.dat //
+package email
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/jhillyerd/enmime/v2"
+	"golang.org/x/text/encoding/charmap"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+const tnefSignature = 0x223e9f78
+
+// lower 16 bits of the TNEF attribute ids
+const (
+	tnefAttBody           = 0x800c
+	tnefAttAttachData     = 0x800f
+	tnefAttAttachTitle    = 0x8010
+	tnefAttAttachRendData = 0x9002
+	tnefAttMsgProps       = 0x9003
+	tnefAttAttachment     = 0x9005
+)
+
+// MAPI property ids
+const (
+	mapiBody              = 0x1000
+	mapiRTFCompressed     = 0x1009
+	mapiAttachDataBin     = 0x3701
+	mapiAttachFilename    = 0x3704
+	mapiAttachLongFilname = 0x3707
+)
+
+// MAPI property types
+const (
+	mapiTypeMultiValue = 0x1000
+	mapiTypeObject     = 0x000d
+	mapiTypeString8    = 0x001e
+	mapiTypeUnicode    = 0x001f
+	mapiTypeBinary     = 0x0102
+)
+
+var errTNEFTruncated = errors.New("TNEF data is truncated")
+
+type tnefReader struct {
+	data []byte
+	pos  int
+}
+
+func (reader *tnefReader) remaining() int {
+	return len(reader.data) - reader.pos
+}
+
+func (reader *tnefReader) bytes(length int) ([]byte, error) {
+	if length < 0 || length > reader.remaining() {
+		return nil, errTNEFTruncated
+	}
+	value := reader.data[reader.pos : reader.pos+length]
+	reader.pos += length
+	return value, nil
+}
+
+func (reader *tnefReader) uint16() (uint16, error) {
+	value, err := reader.bytes(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(value), nil
+}
+
+func (reader *tnefReader) uint32() (uint32, error) {
+	value, err := reader.bytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(value), nil
+}
+
+// values are padded to a multiple of 4 bytes
+func padded(length uint32) int {
+	return int((length + 3) &^ 3)
+}
+
+type mapiProp struct {
+	Id     uint16
+	Type   uint16
+	Values [][]byte
+}
+
+func getMapiValueSize(propType uint16) (int, error) {
+	switch propType {
+	// short and boolean are padded
+	case 0x0001, 0x0002, 0x0003, 0x0004, 0x000a, 0x000b:
+		return 4, nil
+	case 0x0005, 0x0006, 0x0007, 0x0014, 0x0040:
+		return 8, nil
+	case 0x0048:
+		return 16, nil
+	}
+	return 0, fmt.Errorf("unknown MAPI property type 0x%04x", propType)
+}
+
+func parseMapiProps(data []byte) ([]mapiProp, error) {
+	reader := &tnefReader{data: data}
+	count, err := reader.uint32()
+	if err != nil {
+		return nil, err
+	}
+	var props []mapiProp
+	for idx := uint32(0); idx < count; idx++ {
+		prop := mapiProp{}
+		if prop.Type, err = reader.uint16(); err != nil {
+			return nil, err
+		}
+		if prop.Id, err = reader.uint16(); err != nil {
+			return nil, err
+		}
+		// named properties are followed by their guid and name
+		if prop.Id >= 0x8000 {
+			if _, err = reader.bytes(16); err != nil {
+				return nil, err
+			}
+			kind, err := reader.uint32()
+			if err != nil {
+				return nil, err
+			}
+			nameLength := uint32(4)
+			if kind != 0 {
+				if nameLength, err = reader.uint32(); err != nil {
+					return nil, err
+				}
+			}
+			if _, err = reader.bytes(padded(nameLength)); err != nil {
+				return nil, err
+			}
+		}
+
+		baseType := prop.Type &^ mapiTypeMultiValue
+		variableLength := baseType == mapiTypeString8 || baseType == mapiTypeUnicode || baseType == mapiTypeBinary || baseType == mapiTypeObject
+		valueCount := uint32(1)
+		if prop.Type&mapiTypeMultiValue != 0 || variableLength {
+			if valueCount, err = reader.uint32(); err != nil {
+				return nil, err
+			}
+		}
+		for valueIdx := uint32(0); valueIdx < valueCount; valueIdx++ {
+			if variableLength {
+				length, err := reader.uint32()
+				if err != nil {
+					return nil, err
+				}
+				value, err := reader.bytes(int(length))
+				if err != nil {
+					return nil, err
+				}
+				if _, err = reader.bytes(padded(length) - int(length)); err != nil {
+					return nil, err
+				}
+				prop.Values = append(prop.Values, value)
+				continue
+			}
+			size, err := getMapiValueSize(baseType)
+			if err != nil {
+				return nil, err
+			}
+			value, err := reader.bytes(size)
+			if err != nil {
+				return nil, err
+			}
+			prop.Values = append(prop.Values, value)
+		}
+		props = append(props, prop)
+	}
+	return props, nil
+}
+
+// strings are either windows-1252 or utf-16 and null terminated
+func getMapiString(prop *mapiProp) string {
+	if len(prop.Values) == 0 {
+		return ""
+	}
+	value := prop.Values[0]
+	if prop.Type&^mapiTypeMultiValue == mapiTypeUnicode {
+		runes := make([]uint16, 0, len(value)/2)
+		for idx := 0; idx+1 < len(value); idx += 2 {
+			runes = append(runes, binary.LittleEndian.Uint16(value[idx:]))
+		}
+		return strings.TrimRight(string(utf16.Decode(runes)), "\x00")
+	}
+	return decodeWindows1252(value)
+}
+
+func decodeWindows1252(value []byte) string {
+	decoded, err := charmap.Windows1252.NewDecoder().Bytes(value)
+	if err != nil {
+		decoded = value
+	}
+	return strings.TrimRight(string(decoded), "\x00")
+}
+
+type tnefAttachment struct {
+	Title        string
+	LongFilename string
+	Data         []byte
+}
+
+// everything of interest within a TNEF blob
+type tnefContent struct {
+	Files []glb.File
+	// plain text body, converted from rtf when there is no plain text
+	Body string
+}
+
+func isTNEF(part *enmime.Part) bool {
+	switch strings.ToLower(part.ContentType) {
+	case "application/ms-tnef", "application/vnd.ms-tnef":
+		return true
+	}
+	if strings.ToLower(part.FileName) == "winmail.dat" {
+		return true
+	}
+	return len(part.Content) >= 4 && binary.LittleEndian.Uint32(part.Content) == tnefSignature
+}
+
+func decodeTNEF(data []byte) (*tnefContent, error) {
+	reader := &tnefReader{data: data}
+	signature, err := reader.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if signature != tnefSignature {
+		return nil, errors.New("TNEF signature is missing")
+	}
+	// legacy key
+	if _, err = reader.uint16(); err != nil {
+		return nil, err
+	}
+
+	var attachments []*tnefAttachment
+	var body string
+	var rtf []byte
+	for reader.remaining() > 0 {
+		// level isn't needed, the attribute ids are unique
+		if _, err = reader.bytes(1); err != nil {
+			return nil, err
+		}
+		attributeId, err := reader.uint32()
+		if err != nil {
+			return nil, err
+		}
+		length, err := reader.uint32()
+		if err != nil {
+			return nil, err
+		}
+		value, err := reader.bytes(int(length))
+		if err != nil {
+			return nil, err
+		}
+		// checksum
+		if _, err = reader.uint16(); err != nil {
+			return nil, err
+		}
+
+		switch attributeId & 0xffff {
+		case tnefAttAttachRendData:
+			// starts every attachment
+			attachments = append(attachments, &tnefAttachment{})
+		case tnefAttAttachTitle:
+			if len(attachments) != 0 {
+				attachments[len(attachments)-1].Title = decodeWindows1252(value)
+			}
+		case tnefAttAttachData:
+			if len(attachments) != 0 {
+				attachments[len(attachments)-1].Data = value
+			}
+		case tnefAttBody:
+			body = decodeWindows1252(value)
+		case tnefAttAttachment, tnefAttMsgProps:
+			props, err := parseMapiProps(value)
+			if err != nil {
+				lg.Logf("Warning: failed to parse TNEF properties: %s", err)
+				continue
+			}
+			for idx := range props {
+				prop := &props[idx]
+				if attributeId&0xffff == tnefAttMsgProps {
+					switch prop.Id {
+					case mapiBody:
+						body = getMapiString(prop)
+					case mapiRTFCompressed:
+						if len(prop.Values) != 0 {
+							rtf = prop.Values[0]
+						}
+					}
+					continue
+				}
+				if len(attachments) == 0 {
+					continue
+				}
+				attachment := attachments[len(attachments)-1]
+				switch prop.Id {
+				case mapiAttachLongFilname:
+					attachment.LongFilename = getMapiString(prop)
+				case mapiAttachFilename:
+					if attachment.Title == "" {
+						attachment.Title = getMapiString(prop)
+					}
+				case mapiAttachDataBin:
+					// embedded messages are objects and not supported
+					if attachment.Data == nil && prop.Type == mapiTypeBinary && len(prop.Values) != 0 {
+						attachment.Data = prop.Values[0]
+					}
+				}
+			}
+		}
+	}
+
+	content := &tnefContent{Body: strings.TrimSpace(body)}
+	if content.Body == "" && len(rtf) != 0 {
+		decompressed, err := decompressRTF(rtf)
+		if err != nil {
+			lg.Logf("Warning: failed to decompress TNEF rtf body: %s", err)
+		} else {
+			content.Body = strings.TrimSpace(rtfToText(decompressed))
+		}
+	}
+	for idx, attachment := range attachments {
+		if attachment.Data == nil {
+			lg.Logf("skipping TNEF attachment without data, probably an embedded message")
+			continue
+		}
+		name := attachment.LongFilename
+		if name == "" {
+			name = attachment.Title
+		}
+		if name == "" {
+			name = fmt.Sprintf("winmail_attachment_%d", idx+1)
+		}
+		content.Files = append(content.Files, glb.File{Name: name, Bytes: attachment.Data})
+	}
+	return content, nil
+}
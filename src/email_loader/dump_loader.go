@@ -3,11 +3,13 @@ package email_loader
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.ibmgcloud.net/dth/inbound_parser/email"
 	"github.ibmgcloud.net/dth/inbound_parser/handler"
 
 	db "github.ibmgcloud.net/dth/inbound_parser/db"
@@ -15,7 +17,29 @@ import (
 	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
 )
 
-func LoadAllRequestDumps(cfg *glb.Config, noticedOutOfOffice *glb.NoticedOutOfOffice) {
+// events are dumped as event_<timestamp>.<source>.json, older dumps don't have a source
+func getEventSourceFromDump(dumpFile string) string {
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(dumpFile, "event_"), ".json"), ".")
+	if len(parts) != 2 {
+		return glb.LegacyEventSource
+	}
+	return parts[1]
+}
+
+// the dump's file extension defines the inbound provider that received it
+func handleDumpedEmail(cfg *glb.Config, dumpFile string, body []byte, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) (glb.EmailOutcome, error) {
+	provider := email.GetInboundProviderFromDump(dumpFile)
+	if provider == nil {
+		return glb.EmailFailed, fmt.Errorf("no inbound provider for dump %s", dumpFile)
+	}
+	envelope, err := provider.GetEnvelope(body, cfg)
+	if err != nil {
+		return glb.EmailFailed, err
+	}
+	return handler.HandleEmail(cfg, envelope, noticedOutOfOffice, idb)
+}
+
+func LoadAllRequestDumps(cfg *glb.Config, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) {
 	lg.Logf("Loading Email Dumps with send_emails=%t\n\n", cfg.SendEmails)
 	files, err := os.ReadDir(cfg.DumpDir)
 	if err != nil {
@@ -23,7 +47,7 @@ func LoadAllRequestDumps(cfg *glb.Config, noticedOutOfOffice *glb.NoticedOutOfOf
 		log.Fatalf("")
 	}
 	for _, file := range files {
-		if !strings.HasSuffix(file.Name(), ".dump") {
+		if !strings.HasPrefix(file.Name(), "email_") || email.GetInboundProviderFromDump(file.Name()) == nil {
 			continue
 		}
 
@@ -36,7 +60,7 @@ func LoadAllRequestDumps(cfg *glb.Config, noticedOutOfOffice *glb.NoticedOutOfOf
 			lg.LogeNoMail(err)
 			log.Fatalf("")
 		}
-		if err := handler.HandleEmail(cfg, body, noticedOutOfOffice); err != nil {
+		if _, err := handleDumpedEmail(cfg, file.Name(), body, noticedOutOfOffice, idb); err != nil {
 			lg.LogeNoMail(err)
 			log.Fatalf("")
 		}
@@ -59,7 +83,7 @@ func LoadUnhandledDumps(cfg *glb.Config, noticedOutOfOffice *glb.NoticedOutOfOff
 		if err != nil {
 			lg.Loge(cfg, err)
 		} else {
-			if err := handler.HandleEmail(cfg, body, noticedOutOfOffice); err != nil {
+			if _, err := handleDumpedEmail(cfg, dumpFile, body, noticedOutOfOffice, idb); err != nil {
 				lg.Loge(cfg, err)
 			} else {
 				db.UpdateEmailState(idb, dumpFile, true)
@@ -81,7 +105,7 @@ func LoadUnhandledDumps(cfg *glb.Config, noticedOutOfOffice *glb.NoticedOutOfOff
 		if err != nil {
 			lg.Loge(cfg, err)
 		} else {
-			if err := handler.HandleEvent(cfg, body); err != nil {
+			if err := handler.HandleEvent(cfg, getEventSourceFromDump(dumpFile), body); err != nil {
 				lg.Loge(cfg, err)
 				return
 			} else {
@@ -1,20 +1,29 @@
-// expose http endpoint for sendgrid, load email dumps, receive signals from docker_cron //
+// expose http endpoints for inbound providers, load email dumps, receive signals from docker_cron //
 package email_loader
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/subtle"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httputil"
+	"net/mail"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.ibmgcloud.net/dth/inbound_parser/config"
+	"github.ibmgcloud.net/dth/inbound_parser/email"
 	"github.ibmgcloud.net/dth/inbound_parser/handler"
 
 	db "github.ibmgcloud.net/dth/inbound_parser/db"
@@ -34,9 +43,9 @@ func getBody(request *http.Request) ([]byte, error) {
 	return bodyHead[len(head):], nil
 }
 
-func inboundHandler(response http.ResponseWriter, request *http.Request, cfg *glb.Config, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) {
+func inboundHandler(response http.ResponseWriter, request *http.Request, cfg *glb.Config, webhook *glb.InboundWebhook, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) {
 	token := request.URL.Query().Get("token")
-	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.SendgridToken)) != 1 {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(webhook.Token)) != 1 {
 		response.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -49,39 +58,126 @@ func inboundHandler(response http.ResponseWriter, request *http.Request, cfg *gl
 		return
 	}
 
-	// write file
-	timestamp := strconv.Itoa(int(time.Now().UnixMicro()))
-	dumpFile := "email_" + timestamp + ".dump"
-	dumpFullPath := filepath.Join(cfg.DumpDir, dumpFile)
-	if err := os.WriteFile(dumpFullPath, body, 0644); err != nil {
+	provider := email.GetInboundProvider(webhook.Provider)
+	if err := provider.Authenticate(webhook, request, body); err != nil {
+		lg.Logf("rejecting %s webhook request: %s", webhook.Provider, err)
+		response.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	body, err = provider.PrepareDump(webhook, body)
+	if err != nil {
+		lg.Loge(cfg, err)
+		response.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	dumpFile, err := dumpEmail(cfg, body, provider.DumpExtension(), idb)
+	if err != nil {
 		lg.Loge(cfg, err)
 		response.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	db.UpdateEmailState(idb, dumpFile, false)
-	lg.Logf("received e-mail, dumped at '%s'\n", dumpFullPath)
 	response.WriteHeader(http.StatusOK)
 
 	// immediately parse request?
-	if cfg.ParseRequests {
-		lg.Logf("\n\n\n")
-		if err := handler.HandleEmail(cfg, body, noticedOutOfOffice); err != nil {
-			lg.Loge(cfg, err)
-		} else {
-			db.UpdateEmailState(idb, dumpFile, true)
+	parseDumpedEmail(cfg, dumpFile, body, noticedOutOfOffice, idb)
+}
+
+// write received email into the dump dir and remember it as not yet handled
+// the file extension defines how the dump is to be parsed
+func dumpEmail(cfg *glb.Config, body []byte, fileExtension string, idb *sql.DB) (string, error) {
+	timestamp := strconv.Itoa(int(time.Now().UnixMicro()))
+	dumpFile := "email_" + timestamp + fileExtension
+	dumpFullPath := filepath.Join(cfg.DumpDir, dumpFile)
+	if err := os.WriteFile(dumpFullPath, body, 0644); err != nil {
+		return "", err
+	}
+	db.UpdateEmailState(idb, dumpFile, false)
+	lg.Logf("received e-mail, dumped at '%s'\n", dumpFullPath)
+	return dumpFile, nil
+}
+
+// wrap email taken from a mailbox into the internal envelope, address is the envelope recipient and may be empty
+// the return path set by the delivering MTA is the closest thing to an envelope from there is
+func wrapMailboxEmail(rawEmail []byte, address string) []byte {
+	envelopeFrom := ""
+	if msg, err := mail.ReadMessage(bytes.NewReader(rawEmail)); err == nil {
+		if returnPath, err := mail.ParseAddress(msg.Header.Get("Return-Path")); err == nil {
+			envelopeFrom = returnPath.Address
+		}
+	}
+	var envelopeTo []string
+	if address != "" {
+		envelopeTo = append(envelopeTo, address)
+	}
+	return email.AddEnvelopeHeaders(rawEmail, envelopeFrom, envelopeTo, "", 0)
+}
+
+// parse dumped email right away when parse_requests is set
+// return the outcome, failed when the email hasn't been parsed
+func parseDumpedEmail(cfg *glb.Config, dumpFile string, body []byte, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) glb.EmailOutcome {
+	if !cfg.ParseRequests {
+		return glb.EmailFailed
+	}
+	lg.Logf("\n\n\n")
+	outcome, err := handleDumpedEmail(cfg, dumpFile, body, noticedOutOfOffice, idb)
+	if err != nil {
+		lg.Loge(cfg, err)
+	} else {
+		db.UpdateEmailState(idb, dumpFile, true)
+	}
+	lg.Logf("\n\n\n")
+	return outcome
+}
+
+// named event sources sign the body with HMAC-SHA256, their token is only an optional fallback
+func authenticateEventSource(source *glb.EventSource, request *http.Request, body []byte) error {
+	signature := request.Header.Get(source.SignatureHeader)
+	if signature == "" {
+		if source.Token == "" {
+			return fmt.Errorf("missing %s header", source.SignatureHeader)
 		}
-		lg.Logf("\n\n\n")
+		token := request.URL.Query().Get("token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(source.Token)) != 1 {
+			return errors.New("wrong token")
+		}
+		lg.Logf("event source %s authenticated with legacy token", source.Name)
+		return nil
+	}
+	mac := hmac.New(sha256.New, []byte(source.Secret))
+	mac.Write(body)
+	expectedSignature := hex.EncodeToString(mac.Sum(nil))
+	signature = strings.ToLower(strings.TrimPrefix(signature, "sha256="))
+	if !hmac.Equal([]byte(expectedSignature), []byte(signature)) {
+		return errors.New("invalid signature")
 	}
+	return nil
 }
 
-func eventHandler(response http.ResponseWriter, request *http.Request, cfg *glb.Config, idb *sql.DB) {
+// return the name of the authenticated event source
+// source is nil for the /event endpoint
+// there signed sendgrid events are verified with the public key, everything else needs the token
+// with a public key configured the token is only accepted with event_token_fallback
+func authenticateEvent(cfg *glb.Config, source *glb.EventSource, request *http.Request, body []byte) (string, error) {
+	if source != nil {
+		return source.Name, authenticateEventSource(source, request, body)
+	}
+	if cfg.SendgridEventKey != nil {
+		if email.IsSignedSendgridEvent(request) {
+			return glb.SendgridEventSource, email.VerifySendgridEvent(cfg, request, body)
+		}
+		if !cfg.EventTokenFallback {
+			return "", errors.New("event isn't signed and event_token_fallback is disabled")
+		}
+	}
 	token := request.URL.Query().Get("token")
 	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.SendgridToken)) != 1 {
-		lg.Logf("wrong token")
-		response.WriteHeader(http.StatusBadRequest)
-		return
+		return "", errors.New("wrong token")
 	}
+	return glb.LegacyEventSource, nil
+}
 
+func eventHandler(response http.ResponseWriter, request *http.Request, cfg *glb.Config, source *glb.EventSource, idb *sql.DB) {
 	// dump body
 	body, err := getBody(request)
 	if err != nil {
@@ -90,9 +186,16 @@ func eventHandler(response http.ResponseWriter, request *http.Request, cfg *glb.
 		return
 	}
 
-	// write file
+	sourceName, err := authenticateEvent(cfg, source, request, body)
+	if err != nil {
+		lg.Logf("rejecting event on %s: %s", request.URL.Path, err)
+		response.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// write file, the source is remembered in the file name
 	timestamp := strconv.Itoa(int(time.Now().UnixMicro()))
-	dumpFile := "event_" + timestamp + ".json"
+	dumpFile := "event_" + timestamp + "." + sourceName + ".json"
 	dumpFullPath := filepath.Join(cfg.DumpDir, dumpFile)
 	if err := os.WriteFile(dumpFullPath, body, 0644); err != nil {
 		lg.Loge(cfg, err)
@@ -100,12 +203,12 @@ func eventHandler(response http.ResponseWriter, request *http.Request, cfg *glb.
 		return
 	}
 	db.UpdateEventState(idb, dumpFile, false)
-	lg.Logf("received event, dumped at '%s'\n", dumpFullPath)
+	lg.Logf("received event from %s, dumped at '%s'\n", sourceName, dumpFullPath)
 	response.WriteHeader(http.StatusOK)
 
 	lg.Logf("\n\n\n")
 	if cfg.ParseRequests {
-		if err := handler.HandleEvent(cfg, body); err != nil {
+		if err := handler.HandleEvent(cfg, sourceName, body); err != nil {
 			lg.Loge(cfg, err)
 			return
 		} else {
@@ -122,6 +225,15 @@ func StartEndlessRunner(cfg *glb.Config, noticedOutOfOffice *glb.NoticedOutOfOff
 	var maintenance_mutex sync.Mutex
 
 	go startDumper(cfg, &maintenance_mutex, noticedOutOfOffice, idb)
+	if cfg.SMTPServer {
+		go startSMTPServer(cfg, &maintenance_mutex, noticedOutOfOffice, idb)
+	}
+	for _, imapMailbox := range cfg.IMAPMailboxes {
+		go startIMAPPoller(cfg, imapMailbox, &maintenance_mutex, noticedOutOfOffice, idb)
+	}
+	for _, spoolDir := range cfg.SpoolDirs {
+		go startSpoolWatcher(cfg, spoolDir, &maintenance_mutex, noticedOutOfOffice, idb)
+	}
 	for {
 		<-sighup
 		lg.Logf("received SIGHUP, acquiring mutex lock")
@@ -138,17 +250,29 @@ func StartEndlessRunner(cfg *glb.Config, noticedOutOfOffice *glb.NoticedOutOfOff
 
 func startDumper(cfg *glb.Config, maintenance_mutex *sync.Mutex, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) {
 	router := http.NewServeMux()
-	router.HandleFunc("/inbound", func(w http.ResponseWriter, r *http.Request) {
-		maintenance_mutex.Lock()
-		inboundHandler(w, r, cfg, noticedOutOfOffice, idb)
-		maintenance_mutex.Unlock()
-	})
+	for _, webhook := range cfg.InboundWebhooks {
+		webhook := webhook
+		lg.Logf("receiving emails from %s on %s\n", webhook.Provider, webhook.Path)
+		router.HandleFunc(webhook.Path, func(w http.ResponseWriter, r *http.Request) {
+			maintenance_mutex.Lock()
+			inboundHandler(w, r, cfg, webhook, noticedOutOfOffice, idb)
+			maintenance_mutex.Unlock()
+		})
+	}
 	if cfg.HandleEvents {
 		router.HandleFunc("/event", func(w http.ResponseWriter, r *http.Request) {
 			maintenance_mutex.Lock()
-			eventHandler(w, r, cfg, idb)
+			eventHandler(w, r, cfg, nil, idb)
 			maintenance_mutex.Unlock()
 		})
+		for _, source := range cfg.EventSources {
+			source := source
+			router.HandleFunc("/event/"+source.Name, func(w http.ResponseWriter, r *http.Request) {
+				maintenance_mutex.Lock()
+				eventHandler(w, r, cfg, source, idb)
+				maintenance_mutex.Unlock()
+			})
+		}
 	}
 	srv := &http.Server{
 		Addr:    ":" + strconv.Itoa(cfg.Port),
@@ -0,0 +1,265 @@
+// minimal IMAP4rev1 client, just enough to poll a mailbox //
+package email_loader
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const imapTimeout = 2 * time.Minute
+
+// one untagged server response with all literals it contained
+type imapResponse struct {
+	text     string
+	literals [][]byte
+}
+
+type imapClient struct {
+	conn         net.Conn
+	reader       *bufio.Reader
+	tagCounter   int
+	capabilities map[string]struct{}
+}
+
+// security is one of tls, starttls or none
+func dialIMAP(host string, port int, security string) (*imapClient, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	var conn net.Conn
+	var err error
+	if security == "tls" {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: imapTimeout}, "tcp", address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = net.DialTimeout("tcp", address, imapTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	client := &imapClient{conn: conn, reader: bufio.NewReader(conn)}
+
+	client.conn.SetDeadline(time.Now().Add(imapTimeout))
+	greeting, err := client.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected IMAP greeting from %s: %s", address, greeting)
+	}
+
+	if security == "starttls" {
+		if _, err := client.command("STARTTLS"); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		client.conn = tlsConn
+		client.reader = bufio.NewReader(tlsConn)
+	}
+	return client, nil
+}
+
+func (client *imapClient) close() {
+	client.command("LOGOUT")
+	client.conn.Close()
+}
+
+func (client *imapClient) readLine() (string, error) {
+	line, err := client.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// read one response line, including all literals and the lines continuing after them
+func (client *imapClient) readResponse() (*imapResponse, error) {
+	response := &imapResponse{}
+	for {
+		line, err := client.readLine()
+		if err != nil {
+			return nil, err
+		}
+		response.text += line
+		// a line ending with {n} announces a literal of n bytes
+		if !strings.HasSuffix(line, "}") {
+			return response, nil
+		}
+		start := strings.LastIndex(line, "{")
+		if start == -1 {
+			return response, nil
+		}
+		size, err := strconv.Atoi(strings.TrimSuffix(line[start+1:len(line)-1], "+"))
+		if err != nil {
+			return response, nil
+		}
+		literal := make([]byte, size)
+		if _, err := io.ReadFull(client.reader, literal); err != nil {
+			return nil, err
+		}
+		response.literals = append(response.literals, literal)
+	}
+}
+
+// send command and return all untagged responses
+// an error is returned when the server doesn't answer with OK
+func (client *imapClient) command(format string, a ...any) ([]*imapResponse, error) {
+	client.tagCounter++
+	tag := fmt.Sprintf("A%04d", client.tagCounter)
+	client.conn.SetDeadline(time.Now().Add(imapTimeout))
+	if _, err := fmt.Fprintf(client.conn, "%s %s\r\n", tag, fmt.Sprintf(format, a...)); err != nil {
+		return nil, err
+	}
+
+	var untagged []*imapResponse
+	for {
+		response, err := client.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(response.text, "* ") {
+			untagged = append(untagged, response)
+			continue
+		}
+		if strings.HasPrefix(response.text, "+") {
+			// continuation requests aren't used by any command sent by this client
+			return nil, errors.New("unexpected IMAP continuation request")
+		}
+		if !strings.HasPrefix(response.text, tag+" ") {
+			continue
+		}
+		status := strings.TrimPrefix(response.text, tag+" ")
+		if !strings.HasPrefix(strings.ToUpper(status), "OK") {
+			verb, _, _ := strings.Cut(format, " ")
+			return nil, fmt.Errorf("IMAP %s failed: %s", verb, status)
+		}
+		return untagged, nil
+	}
+}
+
+func imapQuote(str string) string {
+	str = strings.ReplaceAll(str, `\`, `\\`)
+	str = strings.ReplaceAll(str, `"`, `\"`)
+	return `"` + str + `"`
+}
+
+func (client *imapClient) login(username string, password string) error {
+	if _, err := client.command("LOGIN %s %s", imapQuote(username), imapQuote(password)); err != nil {
+		return err
+	}
+	responses, err := client.command("CAPABILITY")
+	if err != nil {
+		return err
+	}
+	client.capabilities = make(map[string]struct{})
+	for _, response := range responses {
+		fields := strings.Fields(response.text)
+		if len(fields) < 2 || strings.ToUpper(fields[1]) != "CAPABILITY" {
+			continue
+		}
+		for _, capability := range fields[2:] {
+			client.capabilities[strings.ToUpper(capability)] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func (client *imapClient) hasCapability(capability string) bool {
+	_, found := client.capabilities[capability]
+	return found
+}
+
+// return the mailbox's UIDVALIDITY, uids are only unique together with it
+func (client *imapClient) selectMailbox(mailbox string) (uint32, error) {
+	responses, err := client.command("SELECT %s", imapQuote(mailbox))
+	if err != nil {
+		return 0, err
+	}
+	for _, response := range responses {
+		// * OK [UIDVALIDITY 3857529045] UIDs valid
+		_, rest, found := strings.Cut(strings.ToUpper(response.text), "[UIDVALIDITY ")
+		if !found {
+			continue
+		}
+		value, _, _ := strings.Cut(rest, "]")
+		uidValidity, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid UIDVALIDITY in IMAP select response: %s", value)
+		}
+		return uint32(uidValidity), nil
+	}
+	return 0, errors.New("IMAP server didn't send the mailbox's UIDVALIDITY")
+}
+
+// return uids of all unseen messages in the selected mailbox
+func (client *imapClient) searchUnseen() ([]uint32, error) {
+	responses, err := client.command("UID SEARCH UNSEEN")
+	if err != nil {
+		return nil, err
+	}
+	var uids []uint32
+	for _, response := range responses {
+		fields := strings.Fields(response.text)
+		if len(fields) < 2 || strings.ToUpper(fields[1]) != "SEARCH" {
+			continue
+		}
+		for _, field := range fields[2:] {
+			uid, err := strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid uid in IMAP search response: %s", field)
+			}
+			uids = append(uids, uint32(uid))
+		}
+	}
+	return uids, nil
+}
+
+// return the raw message without marking it as seen
+func (client *imapClient) fetchRaw(uid uint32) ([]byte, error) {
+	responses, err := client.command("UID FETCH %d (BODY.PEEK[])", uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, response := range responses {
+		if strings.Contains(strings.ToUpper(response.text), "FETCH") && len(response.literals) != 0 {
+			return response.literals[0], nil
+		}
+	}
+	return nil, fmt.Errorf("IMAP server didn't return message with uid %d", uid)
+}
+
+func (client *imapClient) addFlags(uid uint32, flags ...string) error {
+	_, err := client.command("UID STORE %d +FLAGS.SILENT (%s)", uid, strings.Join(flags, " "))
+	return err
+}
+
+// move message to other mailbox, falling back to copy and expunge for servers without MOVE
+func (client *imapClient) move(uid uint32, mailbox string) error {
+	if client.hasCapability("MOVE") {
+		_, err := client.command("UID MOVE %d %s", uid, imapQuote(mailbox))
+		return err
+	}
+	if _, err := client.command("UID COPY %d %s", uid, imapQuote(mailbox)); err != nil {
+		return err
+	}
+	if err := client.addFlags(uid, `\Deleted`); err != nil {
+		return err
+	}
+	if client.hasCapability("UIDPLUS") {
+		_, err := client.command("UID EXPUNGE %d", uid)
+		return err
+	}
+	_, err := client.command("EXPUNGE")
+	return err
+}
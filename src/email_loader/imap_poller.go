@@ -0,0 +1,137 @@
+// poll IMAP mailboxes for new emails //
+package email_loader
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	db "github.ibmgcloud.net/dth/inbound_parser/db"
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+// keywords set on messages that don't get moved to another mailbox
+const (
+	imapProcessedFlag = "$InboundParserProcessed"
+	imapIgnoredFlag   = "$InboundParserIgnored"
+	imapFailedFlag    = "$InboundParserFailed"
+)
+
+func imapMailboxName(imapMailbox *glb.IMAPMailbox) string {
+	return fmt.Sprintf("%s@%s/%s", imapMailbox.Username, imapMailbox.Host, imapMailbox.Mailbox)
+}
+
+// mark message as seen and move or flag it depending on how it was handled
+func finishIMAPMessage(client *imapClient, imapMailbox *glb.IMAPMailbox, uid uint32, outcome glb.EmailOutcome) error {
+	targetMailbox := ""
+	flag := ""
+	switch outcome {
+	case glb.EmailProcessed:
+		targetMailbox = imapMailbox.ProcessedMailbox
+		flag = imapProcessedFlag
+	case glb.EmailIgnored:
+		targetMailbox = imapMailbox.IgnoredMailbox
+		flag = imapIgnoredFlag
+	default:
+		targetMailbox = imapMailbox.FailedMailbox
+		flag = imapFailedFlag
+	}
+
+	// failed emails are retried from the dump on the next start, not from the mailbox
+	if err := client.addFlags(uid, `\Seen`, flag); err != nil {
+		return err
+	}
+	if targetMailbox == "" {
+		return nil
+	}
+	lg.Logf("moving message %d to %s\n", uid, targetMailbox)
+	return client.move(uid, targetMailbox)
+}
+
+// the message is recorded before it is handled, it is never handled twice even when finishing it fails
+// the maintenance mutex is only held while handling, not during IMAP network I/O
+func handleIMAPMessage(cfg *glb.Config, imapMailbox *glb.IMAPMailbox, uidValidity uint32, uid uint32, rawEmail []byte, maintenance_mutex *sync.Mutex, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) (glb.EmailOutcome, error) {
+	maintenance_mutex.Lock()
+	defer maintenance_mutex.Unlock()
+	mailboxName := imapMailboxName(imapMailbox)
+	if err := db.SetIMAPMessageOutcome(idb, mailboxName, uidValidity, uid, ""); err != nil {
+		return glb.EmailFailed, err
+	}
+	rawEmail = wrapMailboxEmail(rawEmail, imapMailbox.Address)
+
+	dumpFile, err := dumpEmail(cfg, rawEmail, ".eml", idb)
+	if err != nil {
+		return glb.EmailFailed, err
+	}
+	outcome := glb.EmailProcessed
+	// when the email doesn't get parsed right away it has been dumped successfully nonetheless
+	if cfg.ParseRequests {
+		outcome = parseDumpedEmail(cfg, dumpFile, rawEmail, noticedOutOfOffice, idb)
+	}
+	lg.Logf("message %d in %s %s\n", uid, mailboxName, outcome)
+	return outcome, db.SetIMAPMessageOutcome(idb, mailboxName, uidValidity, uid, string(outcome))
+}
+
+func pollIMAPMailbox(cfg *glb.Config, imapMailbox *glb.IMAPMailbox, maintenance_mutex *sync.Mutex, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) error {
+	client, err := dialIMAP(imapMailbox.Host, imapMailbox.Port, imapMailbox.Security)
+	if err != nil {
+		return err
+	}
+	defer client.close()
+	if err := client.login(imapMailbox.Username, imapMailbox.Password); err != nil {
+		return err
+	}
+	uidValidity, err := client.selectMailbox(imapMailbox.Mailbox)
+	if err != nil {
+		return err
+	}
+
+	uids, err := client.searchUnseen()
+	if err != nil {
+		return err
+	}
+	if len(uids) != 0 {
+		lg.Logf("found %d unseen messages in %s\n", len(uids), imapMailboxName(imapMailbox))
+	}
+	for _, uid := range uids {
+		recordedOutcome, handled, err := db.GetIMAPMessageOutcome(idb, imapMailboxName(imapMailbox), uidValidity, uid)
+		if err != nil {
+			return err
+		}
+		outcome := glb.EmailOutcome(recordedOutcome)
+		if handled {
+			lg.Logf("message %d in %s has already been handled, finishing it again\n", uid, imapMailboxName(imapMailbox))
+			if outcome == "" {
+				// handling got interrupted, the dump is retried on the next start
+				outcome = glb.EmailFailed
+			}
+		} else {
+			rawEmail, err := client.fetchRaw(uid)
+			if err != nil {
+				return err
+			}
+			// messages whose handling fails here are flagged as failed on the next poll
+			outcome, err = handleIMAPMessage(cfg, imapMailbox, uidValidity, uid, rawEmail, maintenance_mutex, noticedOutOfOffice, idb)
+			if err != nil {
+				return err
+			}
+		}
+		if err := finishIMAPMessage(client, imapMailbox, uid, outcome); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startIMAPPoller(cfg *glb.Config, imapMailbox *glb.IMAPMailbox, maintenance_mutex *sync.Mutex, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) {
+	lg.Logf("Polling IMAP mailbox %s every %d seconds with parse_requests=%t and send_emails=%t\n\n",
+		imapMailboxName(imapMailbox), cfg.IMAPPollIntervalSeconds, cfg.ParseRequests, cfg.SendEmails)
+	for {
+		if err := pollIMAPMailbox(cfg, imapMailbox, maintenance_mutex, noticedOutOfOffice, idb); err != nil {
+			lg.Loge(cfg, err)
+		}
+		time.Sleep(time.Duration(cfg.IMAPPollIntervalSeconds) * time.Second)
+	}
+}
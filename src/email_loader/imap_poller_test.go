@@ -0,0 +1,229 @@
+package email_loader
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	db "github.ibmgcloud.net/dth/inbound_parser/db"
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+)
+
+type fakeIMAPMessage struct {
+	raw     string
+	flags   []string
+	mailbox string
+}
+
+// local IMAP server supporting just the commands the poller sends
+type fakeIMAPServer struct {
+	listener  net.Listener
+	mutex     sync.Mutex
+	messages  map[uint32]*fakeIMAPMessage
+	failStore bool
+}
+
+func startFakeIMAPServer(t *testing.T, messages map[uint32]*fakeIMAPMessage) *fakeIMAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeIMAPServer{listener: listener, messages: messages}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *fakeIMAPServer) port() int {
+	return server.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (message *fakeIMAPMessage) hasFlag(flag string) bool {
+	for _, messageFlag := range message.flags {
+		if messageFlag == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (server *fakeIMAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "* OK fake IMAP server ready\r\n")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, command, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		fields := strings.Fields(command)
+		server.mutex.Lock()
+		response := server.respond(fields)
+		server.mutex.Unlock()
+		if response == "NO" {
+			fmt.Fprintf(conn, "%s NO failed\r\n", tag)
+			continue
+		}
+		fmt.Fprintf(conn, "%s%s OK done\r\n", response, tag)
+		if strings.ToUpper(fields[0]) == "LOGOUT" {
+			return
+		}
+	}
+}
+
+// return the untagged responses, NO makes the command fail
+func (server *fakeIMAPServer) respond(fields []string) string {
+	switch strings.ToUpper(fields[0]) {
+	case "CAPABILITY":
+		return "* CAPABILITY IMAP4rev1 MOVE\r\n"
+	case "SELECT":
+		return "* OK [UIDVALIDITY 42] UIDs valid\r\n"
+	case "LOGOUT":
+		return "* BYE\r\n"
+	case "UID":
+	default:
+		return ""
+	}
+	uid, _ := strconv.ParseUint(fields[2], 10, 32)
+	message := server.messages[uint32(uid)]
+	switch strings.ToUpper(fields[1]) {
+	case "SEARCH":
+		var uids []string
+		for uid, message := range server.messages {
+			if message.mailbox == "INBOX" && !message.hasFlag(`\Seen`) {
+				uids = append(uids, strconv.Itoa(int(uid)))
+			}
+		}
+		return fmt.Sprintf("* SEARCH %s\r\n", strings.Join(uids, " "))
+	case "FETCH":
+		return fmt.Sprintf("* 1 FETCH (UID %d BODY[] {%d}\r\n%s)\r\n", uid, len(message.raw), message.raw)
+	case "STORE":
+		if server.failStore {
+			return "NO"
+		}
+		for _, flag := range fields[4:] {
+			message.flags = append(message.flags, strings.Trim(flag, "()"))
+		}
+	case "MOVE":
+		message.mailbox = strings.Trim(fields[3], `"`)
+	}
+	return ""
+}
+
+func setupIMAPPollerTest(t *testing.T, messages map[uint32]*fakeIMAPMessage) (*fakeIMAPServer, *glb.Config, *glb.IMAPMailbox) {
+	dir := t.TempDir()
+	t.Setenv("DB_PATH", filepath.Join(dir, "test.sqlite"))
+	dumpDir := filepath.Join(dir, "dumps")
+	if err := os.Mkdir(dumpDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	server := startFakeIMAPServer(t, messages)
+	cfg := &glb.Config{DumpDir: dumpDir}
+	imapMailbox := &glb.IMAPMailbox{
+		Host:             "127.0.0.1",
+		Port:             server.port(),
+		Security:         "none",
+		Username:         "user",
+		Password:         "password",
+		Mailbox:          "INBOX",
+		ProcessedMailbox: "Processed",
+	}
+	return server, cfg, imapMailbox
+}
+
+func countDumps(t *testing.T, cfg *glb.Config) int {
+	entries, err := os.ReadDir(cfg.DumpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestPollIMAPMailbox(t *testing.T) {
+	messages := map[uint32]*fakeIMAPMessage{
+		1: {raw: "From: alice@example.com\r\nSubject: first\r\n\r\nhello\r\n", mailbox: "INBOX"},
+		2: {raw: "From: bob@example.com\r\nSubject: second\r\n\r\nhello\r\n", mailbox: "INBOX"},
+		3: {raw: "From: carol@example.com\r\nSubject: seen\r\n\r\nhello\r\n", mailbox: "INBOX", flags: []string{`\Seen`}},
+	}
+	_, cfg, imapMailbox := setupIMAPPollerTest(t, messages)
+	idb := db.GetDb()
+	defer idb.Close()
+
+	if err := pollIMAPMailbox(cfg, imapMailbox, &sync.Mutex{}, &glb.NoticedOutOfOffice{}, idb); err != nil {
+		t.Fatal(err)
+	}
+	if dumps := countDumps(t, cfg); dumps != 2 {
+		t.Fatalf("expected 2 dumps of the unseen messages, got %d", dumps)
+	}
+	for _, uid := range []uint32{1, 2} {
+		message := messages[uid]
+		if !message.hasFlag(`\Seen`) || !message.hasFlag(imapProcessedFlag) || message.mailbox != "Processed" {
+			t.Errorf("message %d wasn't finished: flags %v, mailbox %s", uid, message.flags, message.mailbox)
+		}
+	}
+	if messages[3].mailbox != "INBOX" {
+		t.Errorf("seen message has been moved to %s", messages[3].mailbox)
+	}
+}
+
+func TestPollIMAPMailboxFinishFails(t *testing.T) {
+	messages := map[uint32]*fakeIMAPMessage{
+		7: {raw: "From: alice@example.com\r\nSubject: urgent\r\n\r\nhello\r\n", mailbox: "INBOX"},
+	}
+	server, cfg, imapMailbox := setupIMAPPollerTest(t, messages)
+	idb := db.GetDb()
+	defer idb.Close()
+
+	server.failStore = true
+	if err := pollIMAPMailbox(cfg, imapMailbox, &sync.Mutex{}, &glb.NoticedOutOfOffice{}, idb); err == nil {
+		t.Fatal("expected the failing STORE to be reported")
+	}
+	if dumps := countDumps(t, cfg); dumps != 1 {
+		t.Fatalf("expected 1 dump, got %d", dumps)
+	}
+
+	// the message is still unseen, it must be finished without being handled again
+	server.mutex.Lock()
+	server.failStore = false
+	server.mutex.Unlock()
+	if err := pollIMAPMailbox(cfg, imapMailbox, &sync.Mutex{}, &glb.NoticedOutOfOffice{}, idb); err != nil {
+		t.Fatal(err)
+	}
+	if dumps := countDumps(t, cfg); dumps != 1 {
+		t.Fatalf("message has been handled again, got %d dumps", dumps)
+	}
+	if !messages[7].hasFlag(`\Seen`) || messages[7].mailbox != "Processed" {
+		t.Errorf("message wasn't finished: flags %v, mailbox %s", messages[7].flags, messages[7].mailbox)
+	}
+}
+
+func TestSelectMailboxUIDValidity(t *testing.T) {
+	server, _, imapMailbox := setupIMAPPollerTest(t, map[uint32]*fakeIMAPMessage{})
+	client, err := dialIMAP(imapMailbox.Host, server.port(), "none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.close()
+	uidValidity, err := client.selectMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uidValidity != 42 {
+		t.Errorf("expected UIDVALIDITY 42, got %d", uidValidity)
+	}
+}
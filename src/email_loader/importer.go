@@ -0,0 +1,282 @@
+// import backlogs of emails from mbox files and .eml files //
+package email_loader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.ibmgcloud.net/dth/inbound_parser/email"
+	"github.ibmgcloud.net/dth/inbound_parser/handler"
+
+	db "github.ibmgcloud.net/dth/inbound_parser/db"
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+// mboxrd escapes lines starting with From by prepending >
+var escapedMboxFromLine = regexp.MustCompile(`^>+From `)
+
+type archivedMessage struct {
+	// file and position in the archive, used for the summary
+	source   string
+	rawEmail []byte
+	// from the mbox From_ line, empty for .eml files
+	envelopeFrom string
+}
+
+// what happened to one imported message
+type ImportResult struct {
+	Source    string
+	MessageId string
+	Outcome   string
+	Detail    string
+}
+
+// split mbox into its messages, the From_ line separating them holds the envelope sender
+func splitMbox(path string, content []byte) []archivedMessage {
+	var messages []archivedMessage
+	var current *archivedMessage
+	var lines []string
+	finishMessage := func() {
+		if current == nil {
+			return
+		}
+		current.rawEmail = []byte(strings.TrimRight(strings.Join(lines, "\n"), "\n") + "\n")
+		messages = append(messages, *current)
+	}
+
+	previousBlank := true
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if previousBlank && strings.HasPrefix(line, "From ") {
+			finishMessage()
+			envelopeFrom := ""
+			if fields := strings.Fields(line); len(fields) > 1 && fields[1] != "MAILER-DAEMON" {
+				envelopeFrom = fields[1]
+			}
+			current = &archivedMessage{source: fmt.Sprintf("%s#%d", path, len(messages)+1), envelopeFrom: envelopeFrom}
+			lines = nil
+			previousBlank = false
+			continue
+		}
+		if escapedMboxFromLine.MatchString(line) {
+			line = line[1:]
+		}
+		lines = append(lines, line)
+		previousBlank = line == ""
+	}
+	finishMessage()
+	return messages
+}
+
+// an mbox starts with a From_ line, everything else is a single email
+func readArchive(path string) ([]archivedMessage, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(content, []byte("From ")) {
+		return splitMbox(path, content), nil
+	}
+	return []archivedMessage{{source: path, rawEmail: content}}, nil
+}
+
+// directories are searched recursively for .eml and .mbox files
+func collectArchives(paths []string) ([]string, error) {
+	var archives []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			archives = append(archives, path)
+			continue
+		}
+		err = filepath.WalkDir(path, func(filePath string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.IsDir() && (strings.HasSuffix(entry.Name(), ".eml") || strings.HasSuffix(entry.Name(), ".mbox")) {
+				archives = append(archives, filePath)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return archives, nil
+}
+
+// use the Message-ID or, when there is none, a hash of the entire email
+func getImportKey(header mail.Header, rawEmail []byte) string {
+	messageId := strings.TrimSpace(header.Get("Message-Id"))
+	if messageId != "" {
+		return messageId
+	}
+	hash := sha256.Sum256(rawEmail)
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+// synthesise the envelope from what the delivering MTA left in the headers
+// address is used as envelope recipient when not empty
+func wrapArchivedEmail(message archivedMessage, header mail.Header, address string) []byte {
+	envelopeFrom := message.envelopeFrom
+	if returnPath, err := mail.ParseAddress(header.Get("Return-Path")); err == nil {
+		envelopeFrom = returnPath.Address
+	}
+	envelopeTo := address
+	if envelopeTo == "" {
+		for _, headerName := range []string{"Delivered-To", "X-Original-To"} {
+			if deliveredTo, err := mail.ParseAddress(header.Get(headerName)); err == nil {
+				envelopeTo = deliveredTo.Address
+				break
+			}
+		}
+	}
+	var envelopeToList []string
+	if envelopeTo != "" {
+		envelopeToList = append(envelopeToList, envelopeTo)
+	}
+	return email.AddEnvelopeHeaders(message.rawEmail, envelopeFrom, envelopeToList, "", 0)
+}
+
+// only parse and route the email and tell where it would go, without touching jira
+func dryRunImport(cfg *glb.Config, rawEmail []byte) (string, error) {
+	envelope, err := email.GetInboundProvider("raw").GetEnvelope(rawEmail, cfg)
+	if err != nil {
+		return "", err
+	}
+	parsedEmail, err := email.GetParsedEmail(envelope, cfg)
+	if err != nil {
+		return "", err
+	}
+	result, _ := handler.RouteEmail(cfg, cfg.RoutingRules, parsedEmail)
+	switch {
+	case result.Drop:
+		return fmt.Sprintf("dropped by routing rules %s: %s", strings.Join(result.MatchedRules, ", "), parsedEmail.Subject), nil
+	case result.ServiceDesk != nil && result.RequestTypeId != "":
+		return fmt.Sprintf("to servicedesk %s with request type id %s: %s", result.ServiceDesk.ProjectKey, result.RequestTypeId, parsedEmail.Subject), nil
+	case result.ServiceDesk != nil:
+		return fmt.Sprintf("to servicedesk %s: %s", result.ServiceDesk.ProjectKey, parsedEmail.Subject), nil
+	case result.JiraInstall != nil:
+		return fmt.Sprintf("to jira install %s: %s", result.JiraInstall.URL, parsedEmail.Subject), nil
+	}
+	return fmt.Sprintf("not addressed to any servicedesk or jira install: %s", parsedEmail.Subject), nil
+}
+
+func importMessage(cfg *glb.Config, message archivedMessage, address string, dryRun bool, seen map[string]struct{}, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) ImportResult {
+	result := ImportResult{Source: message.source}
+	msg, err := mail.ReadMessage(bytes.NewReader(message.rawEmail))
+	if err != nil {
+		result.Outcome = string(glb.EmailFailed)
+		result.Detail = err.Error()
+		return result
+	}
+	result.MessageId = getImportKey(msg.Header, message.rawEmail)
+
+	// the same message might be in the archive multiple times
+	_, alreadySeen := seen[result.MessageId]
+	imported, err := db.IsImported(idb, result.MessageId)
+	if err != nil {
+		result.Outcome = string(glb.EmailFailed)
+		result.Detail = err.Error()
+		return result
+	}
+	if alreadySeen || imported {
+		result.Outcome = "skipped"
+		result.Detail = "already imported"
+		return result
+	}
+	seen[result.MessageId] = struct{}{}
+
+	rawEmail := wrapArchivedEmail(message, msg.Header, address)
+	if dryRun {
+		result.Outcome = "dry-run"
+		result.Detail, err = dryRunImport(cfg, rawEmail)
+		if err != nil {
+			result.Outcome = string(glb.EmailFailed)
+			result.Detail = err.Error()
+		}
+		return result
+	}
+
+	dumpFile, err := dumpEmail(cfg, rawEmail, ".eml", idb)
+	if err != nil {
+		result.Outcome = string(glb.EmailFailed)
+		result.Detail = err.Error()
+		return result
+	}
+	result.Detail = dumpFile
+	lg.Logf("\n\n\n")
+	outcome, err := handleDumpedEmail(cfg, dumpFile, rawEmail, noticedOutOfOffice, idb)
+	lg.Logf("\n\n\n")
+	result.Outcome = string(outcome)
+	if err != nil {
+		lg.LogeNoMail(err)
+		result.Detail = err.Error()
+	}
+	// failed emails might have been handled partially, neither LoadUnhandledDumps nor another import retries them
+	db.UpdateEmailState(idb, dumpFile, true)
+	if err := db.SetImported(idb, result.MessageId, dumpFile); err != nil {
+		lg.LogeNoMail(err)
+	}
+	return result
+}
+
+// import all emails in the mbox files, .eml files and directories
+// address is used as envelope recipient when not empty, otherwise the Delivered-To header is used
+// errors don't abort the import, they are part of the returned results
+func ImportArchives(cfg *glb.Config, paths []string, address string, dryRun bool, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) ([]ImportResult, error) {
+	lg.Logf("Importing archives with dry_run=%t and send_emails=%t\n\n", dryRun, cfg.SendEmails)
+	archives, err := collectArchives(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []ImportResult
+	seen := make(map[string]struct{})
+	for _, archive := range archives {
+		lg.Logf("reading archive '%s'\n", archive)
+		messages, err := readArchive(archive)
+		if err != nil {
+			results = append(results, ImportResult{Source: archive, Outcome: string(glb.EmailFailed), Detail: err.Error()})
+			continue
+		}
+		for _, message := range messages {
+			result := importMessage(cfg, message, address, dryRun, seen, noticedOutOfOffice, idb)
+			lg.Logf("%s %s %s %s\n", result.Source, result.MessageId, result.Outcome, result.Detail)
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+func PrintImportSummary(results []ImportResult) {
+	counts := make(map[string]int)
+	fmt.Printf("\n%-12s %-50s %s\n", "OUTCOME", "SOURCE", "MESSAGE-ID / DETAIL")
+	for _, result := range results {
+		counts[result.Outcome]++
+		fmt.Printf("%-12s %-50s %s\n", result.Outcome, result.Source, result.MessageId)
+		if result.Detail != "" {
+			fmt.Printf("%-12s %-50s %s\n", "", "", result.Detail)
+		}
+	}
+	fmt.Printf("\n%d messages:", len(results))
+	for _, outcome := range []string{string(glb.EmailProcessed), string(glb.EmailIgnored), string(glb.EmailFailed), "skipped", "dry-run"} {
+		if counts[outcome] != 0 {
+			fmt.Printf(" %d %s", counts[outcome], outcome)
+		}
+	}
+	fmt.Printf("\n")
+}
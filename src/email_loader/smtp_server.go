@@ -0,0 +1,329 @@
+// receive emails via SMTP or LMTP, e.g. relayed by an on-prem MTA //
+package email_loader
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.ibmgcloud.net/dth/inbound_parser/config"
+	"github.ibmgcloud.net/dth/inbound_parser/email"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+// how long a client may stay silent before the connection gets closed
+const smtpTimeout = 5 * time.Minute
+
+// state of one SMTP/LMTP connection
+type smtpSession struct {
+	cfg       *glb.Config
+	conn      net.Conn
+	text      *textproto.Conn
+	tlsConfig *tls.Config
+	senderIP  string
+	// true after HELO/EHLO/LHLO
+	greeted bool
+	// true after MAIL FROM
+	hasFrom      bool
+	envelopeFrom string
+	envelopeTo   []string
+}
+
+func (session *smtpSession) reply(code int, format string, a ...any) {
+	session.text.PrintfLine("%d %s", code, fmt.Sprintf(format, a...))
+}
+
+func (session *smtpSession) resetTransaction() {
+	session.hasFrom = false
+	session.envelopeFrom = ""
+	session.envelopeTo = nil
+}
+
+func smtpProtocolName(cfg *glb.Config) string {
+	if cfg.SMTPUseLMTP {
+		return "LMTP"
+	}
+	return "SMTP"
+}
+
+func smtpClientAllowed(cfg *glb.Config, senderIP string) bool {
+	ip := net.ParseIP(senderIP)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range cfg.SMTPAllowedIPNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parse the address in 'FROM:<address> PARAMS' or 'TO:<address> PARAMS'
+// parameters like SIZE or BODY are ignored
+func parseSMTPPath(arg string, prefix string) (string, error) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", errors.New("syntax error")
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", errors.New("syntax error")
+	}
+	end := strings.Index(arg, ">")
+	if end == -1 {
+		return "", errors.New("syntax error")
+	}
+	address := arg[1:end]
+	// strip obsolete source route
+	if colon := strings.LastIndex(address, ":"); colon != -1 {
+		address = address[colon+1:]
+	}
+	return address, nil
+}
+
+// only accept recipients that are assigned to a serviceDesk or jira install
+func smtpRecipientAccepted(cfg *glb.Config, address string) bool {
+	return config.GetServiceDeskFromMail(cfg, address) != nil || config.GetJiraInstallFromMail(cfg, address) != nil
+}
+
+func (session *smtpSession) handleHello(verb string, arg string) {
+	if arg == "" {
+		session.reply(501, "5.5.4 domain required")
+		return
+	}
+	if (verb == "LHLO") != session.cfg.SMTPUseLMTP {
+		session.reply(500, "5.5.1 %s not supported, this is an %s server", verb, smtpProtocolName(session.cfg))
+		return
+	}
+	session.greeted = true
+	session.resetTransaction()
+	if verb == "HELO" {
+		session.reply(250, "%s", session.cfg.Domain)
+		return
+	}
+	session.text.PrintfLine("250-%s", session.cfg.Domain)
+	session.text.PrintfLine("250-8BITMIME")
+	session.text.PrintfLine("250-SIZE %d", session.cfg.SMTPMaxMessageBytes)
+	if session.tlsConfig != nil {
+		if _, isTLS := session.conn.(*tls.Conn); !isTLS {
+			session.text.PrintfLine("250-STARTTLS")
+		}
+	}
+	session.text.PrintfLine("250 ENHANCEDSTATUSCODES")
+}
+
+// return false when the connection can't be used anymore
+func (session *smtpSession) handleStartTLS() bool {
+	if session.tlsConfig == nil {
+		session.reply(502, "5.5.1 STARTTLS not supported")
+		return true
+	}
+	if _, isTLS := session.conn.(*tls.Conn); isTLS {
+		session.reply(503, "5.5.1 already running TLS")
+		return true
+	}
+	session.reply(220, "2.0.0 ready to start TLS")
+	tlsConn := tls.Server(session.conn, session.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		lg.Logf("TLS handshake with %s failed: %s", session.senderIP, err)
+		return false
+	}
+	session.conn = tlsConn
+	session.text = textproto.NewConn(tlsConn)
+	// the client has to greet again after STARTTLS
+	session.greeted = false
+	session.resetTransaction()
+	return true
+}
+
+func (session *smtpSession) handleMail(arg string) {
+	if !session.greeted {
+		session.reply(503, "5.5.1 send HELO/EHLO/LHLO first")
+		return
+	}
+	if session.hasFrom {
+		session.reply(503, "5.5.1 nested MAIL command")
+		return
+	}
+	address, err := parseSMTPPath(arg, "FROM:")
+	if err != nil {
+		session.reply(501, "5.5.4 %s", err)
+		return
+	}
+	session.hasFrom = true
+	session.envelopeFrom = address
+	session.reply(250, "2.1.0 ok")
+}
+
+func (session *smtpSession) handleRcpt(arg string) {
+	if !session.hasFrom {
+		session.reply(503, "5.5.1 send MAIL first")
+		return
+	}
+	address, err := parseSMTPPath(arg, "TO:")
+	if err != nil {
+		session.reply(501, "5.5.4 %s", err)
+		return
+	}
+	if !smtpRecipientAccepted(session.cfg, address) {
+		lg.Logf("rejecting recipient %s from %s, address isn't assigned to any serviceDesk or jira install", address, session.senderIP)
+		session.reply(550, "5.1.1 mailbox unavailable")
+		return
+	}
+	session.envelopeTo = append(session.envelopeTo, address)
+	session.reply(250, "2.1.5 ok")
+}
+
+// return the raw email or nil when an error has been replied
+// return false when the connection can't be used anymore
+func (session *smtpSession) readData() ([]byte, bool) {
+	if !session.hasFrom {
+		session.reply(503, "5.5.1 send MAIL first")
+		return nil, true
+	}
+	if len(session.envelopeTo) == 0 {
+		session.reply(554, "5.5.1 no valid recipients")
+		return nil, true
+	}
+	session.reply(354, "end data with <CR><LF>.<CR><LF>")
+
+	dotReader := session.text.DotReader()
+	rawEmail, err := io.ReadAll(io.LimitReader(dotReader, int64(session.cfg.SMTPMaxMessageBytes)+1))
+	if err != nil {
+		lg.Logf("failed to read data from %s: %s", session.senderIP, err)
+		return nil, false
+	}
+	if len(rawEmail) > session.cfg.SMTPMaxMessageBytes {
+		// consume the rest of the message so the connection stays usable
+		if _, err := io.Copy(io.Discard, dotReader); err != nil {
+			return nil, false
+		}
+		lg.Logf("rejecting email from %s, it's bigger than smtp_max_message_bytes", session.senderIP)
+		session.reply(552, "5.3.4 message too big")
+		session.resetTransaction()
+		return nil, true
+	}
+	return rawEmail, true
+}
+
+// reply once for SMTP or once per recipient for LMTP
+func (session *smtpSession) replyData(code int, format string, a ...any) {
+	if !session.cfg.SMTPUseLMTP {
+		session.reply(code, format, a...)
+		return
+	}
+	for range session.envelopeTo {
+		session.reply(code, format, a...)
+	}
+}
+
+func handleSMTPConnection(cfg *glb.Config, conn net.Conn, tlsConfig *tls.Config, maintenance_mutex *sync.Mutex, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) {
+	defer conn.Close()
+	senderIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		senderIP = conn.RemoteAddr().String()
+	}
+	session := &smtpSession{
+		cfg:       cfg,
+		conn:      conn,
+		text:      textproto.NewConn(conn),
+		tlsConfig: tlsConfig,
+		senderIP:  senderIP,
+	}
+	if !smtpClientAllowed(cfg, senderIP) {
+		lg.Logf("rejecting %s connection from %s, not in smtp_allowed_networks", smtpProtocolName(cfg), senderIP)
+		session.reply(554, "5.7.1 access denied")
+		return
+	}
+	session.reply(220, "%s %s inbound_parser ready", cfg.Domain, smtpProtocolName(cfg))
+
+	for {
+		session.conn.SetDeadline(time.Now().Add(smtpTimeout))
+		line, err := session.text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		arg = strings.TrimSpace(arg)
+
+		switch verb {
+		case "HELO", "EHLO", "LHLO":
+			session.handleHello(verb, arg)
+		case "STARTTLS":
+			if !session.handleStartTLS() {
+				return
+			}
+		case "MAIL":
+			session.handleMail(arg)
+		case "RCPT":
+			session.handleRcpt(arg)
+		case "DATA":
+			rawEmail, usable := session.readData()
+			if !usable {
+				return
+			}
+			if rawEmail == nil {
+				continue
+			}
+			rawEmail = email.AddEnvelopeHeaders(rawEmail, session.envelopeFrom, session.envelopeTo, senderIP, email.GetSpamScoreFromHeaders(rawEmail))
+
+			maintenance_mutex.Lock()
+			dumpFile, err := dumpEmail(cfg, rawEmail, ".eml", idb)
+			if err != nil {
+				maintenance_mutex.Unlock()
+				lg.Loge(cfg, err)
+				session.replyData(451, "4.3.0 failed to store message")
+				session.resetTransaction()
+				continue
+			}
+			session.replyData(250, "2.0.0 ok, queued as %s", dumpFile)
+			session.resetTransaction()
+			// immediately parse request?
+			parseDumpedEmail(cfg, dumpFile, rawEmail, noticedOutOfOffice, idb)
+			maintenance_mutex.Unlock()
+		case "RSET":
+			session.resetTransaction()
+			session.reply(250, "2.0.0 ok")
+		case "NOOP":
+			session.reply(250, "2.0.0 ok")
+		case "VRFY":
+			session.reply(252, "2.5.0 cannot verify user")
+		case "QUIT":
+			session.reply(221, "2.0.0 bye")
+			return
+		default:
+			session.reply(502, "5.5.2 command not recognized")
+		}
+	}
+}
+
+func startSMTPServer(cfg *glb.Config, maintenance_mutex *sync.Mutex, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(cfg.SMTPPort))
+	if err != nil {
+		lg.Loge(cfg, err)
+		return
+	}
+	defer listener.Close()
+
+	lg.Logf("Running %s server on %s:%d with starttls=%t, parse_requests=%t and send_emails=%t\n\n",
+		smtpProtocolName(cfg), cfg.Domain, cfg.SMTPPort, cfg.SMTPStartTLS, cfg.ParseRequests, cfg.SendEmails)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			lg.LogeNoMail(err)
+			continue
+		}
+		go handleSMTPConnection(cfg, conn, cfg.SMTPTLSConfig, maintenance_mutex, noticedOutOfOffice, idb)
+	}
+}
@@ -0,0 +1,161 @@
+// pick up emails delivered into maildirs or spool directories //
+package email_loader
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+// eml files younger than this might still be written to
+const spoolMinFileAge = 5 * time.Second
+
+// return the paths of all emails waiting to be handled
+func getSpoolFiles(spoolDir *glb.SpoolDir) ([]string, error) {
+	dir := spoolDir.Path
+	if spoolDir.Format == "maildir" {
+		// messages are only moved into new/ once they have been written completely
+		dir = filepath.Join(spoolDir.Path, "new")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if spoolDir.Format == "eml" {
+			if !strings.HasSuffix(entry.Name(), ".eml") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) < spoolMinFileAge {
+				continue
+			}
+		}
+		paths = append(paths, filepath.Join(dir, entry.Name()))
+	}
+	return paths, nil
+}
+
+// rename doesn't work across filesystems, e.g. between docker volumes
+// copy the file then, it is only removed once the copy is on disk
+func moveFile(path string, target string) error {
+	err := os.Rename(path, target)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	// a partial copy never shows up under the target's name
+	tmpFile, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := io.Copy(tmpFile, source); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile.Name(), target); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// move handled file out of the way so it doesn't get picked up again
+func finishSpoolFile(spoolDir *glb.SpoolDir, path string, outcome glb.EmailOutcome) error {
+	fileName := filepath.Base(path)
+	target := ""
+	if spoolDir.ArchiveDir != "" {
+		target = filepath.Join(spoolDir.ArchiveDir, fileName)
+	} else {
+		// maildir info: seen when it has been handled, flagged for a human to look at when it failed
+		// failed emails are retried from the dump_dir on the next start, not from the maildir
+		flags := "S"
+		if outcome == glb.EmailFailed {
+			flags = "F"
+		}
+		target = filepath.Join(spoolDir.Path, "cur", fileName+":2,"+flags)
+	}
+	lg.Logf("moving %s to %s\n", path, target)
+	return moveFile(path, target)
+}
+
+// a broken file doesn't keep the others from being handled
+// handled maps the paths already handled to their outcome, they are only moved again when moving them failed
+func pollSpoolDir(cfg *glb.Config, spoolDir *glb.SpoolDir, handled map[string]glb.EmailOutcome, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) error {
+	paths, err := getSpoolFiles(spoolDir)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		outcome, alreadyHandled := handled[path]
+		if alreadyHandled {
+			lg.Logf("email delivered to '%s' has already been handled, moving it again\n", path)
+		} else {
+			lg.Logf("reading email delivered to '%s'\n", path)
+			rawEmail, err := os.ReadFile(path)
+			if err != nil {
+				lg.Loge(cfg, err)
+				continue
+			}
+			rawEmail = wrapMailboxEmail(rawEmail, spoolDir.Address)
+
+			dumpFile, err := dumpEmail(cfg, rawEmail, ".eml", idb)
+			if err != nil {
+				lg.Loge(cfg, err)
+				continue
+			}
+			outcome = glb.EmailProcessed
+			// when the email doesn't get parsed right away it has been dumped successfully nonetheless
+			if cfg.ParseRequests {
+				outcome = parseDumpedEmail(cfg, dumpFile, rawEmail, noticedOutOfOffice, idb)
+			}
+			lg.Logf("%s %s\n", path, outcome)
+			handled[path] = outcome
+		}
+		if err := finishSpoolFile(spoolDir, path, outcome); err != nil {
+			lg.Loge(cfg, err)
+			continue
+		}
+		delete(handled, path)
+	}
+	return nil
+}
+
+func startSpoolWatcher(cfg *glb.Config, spoolDir *glb.SpoolDir, maintenance_mutex *sync.Mutex, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) {
+	lg.Logf("Watching %s spool dir %s every %d seconds with parse_requests=%t and send_emails=%t\n\n",
+		spoolDir.Format, spoolDir.Path, cfg.SpoolPollIntervalSeconds, cfg.ParseRequests, cfg.SendEmails)
+	handled := make(map[string]glb.EmailOutcome)
+	for {
+		maintenance_mutex.Lock()
+		if err := pollSpoolDir(cfg, spoolDir, handled, noticedOutOfOffice, idb); err != nil {
+			lg.Loge(cfg, err)
+		}
+		maintenance_mutex.Unlock()
+		time.Sleep(time.Duration(cfg.SpoolPollIntervalSeconds) * time.Second)
+	}
+}
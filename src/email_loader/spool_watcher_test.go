@@ -0,0 +1,87 @@
+package email_loader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	db "github.ibmgcloud.net/dth/inbound_parser/db"
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+)
+
+func setupSpoolDirTest(t *testing.T) (*glb.Config, *glb.SpoolDir) {
+	dir := t.TempDir()
+	t.Setenv("DB_PATH", filepath.Join(dir, "test.sqlite"))
+	cfg := &glb.Config{DumpDir: filepath.Join(dir, "dumps")}
+	spoolDir := &glb.SpoolDir{Path: filepath.Join(dir, "maildir"), Format: "maildir"}
+	for _, path := range []string{cfg.DumpDir, filepath.Join(spoolDir.Path, "new"), filepath.Join(spoolDir.Path, "cur")} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cfg, spoolDir
+}
+
+func deliverToSpoolDir(t *testing.T, spoolDir *glb.SpoolDir, name string) string {
+	path := filepath.Join(spoolDir.Path, "new", name)
+	if err := os.WriteFile(path, []byte("From: alice@example.com\r\nSubject: "+name+"\r\n\r\nhello\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPollSpoolDirSkipsUnreadableFile(t *testing.T) {
+	cfg, spoolDir := setupSpoolDirTest(t)
+	idb := db.GetDb()
+	defer idb.Close()
+
+	// sorts before the readable email
+	if err := os.Symlink(filepath.Join(spoolDir.Path, "missing"), filepath.Join(spoolDir.Path, "new", "1.broken")); err != nil {
+		t.Fatal(err)
+	}
+	deliverToSpoolDir(t, spoolDir, "2.mail")
+
+	if err := pollSpoolDir(cfg, spoolDir, make(map[string]glb.EmailOutcome), &glb.NoticedOutOfOffice{}, idb); err != nil {
+		t.Fatal(err)
+	}
+	if dumps := countDumps(t, cfg); dumps != 1 {
+		t.Fatalf("expected 1 dump, got %d", dumps)
+	}
+	if _, err := os.Stat(filepath.Join(spoolDir.Path, "cur", "2.mail:2,S")); err != nil {
+		t.Errorf("readable email wasn't finished: %v", err)
+	}
+}
+
+func TestPollSpoolDirFinishFails(t *testing.T) {
+	cfg, spoolDir := setupSpoolDirTest(t)
+	idb := db.GetDb()
+	defer idb.Close()
+
+	path := deliverToSpoolDir(t, spoolDir, "1.mail")
+	archiveDir := filepath.Join(filepath.Dir(spoolDir.Path), "archive")
+	spoolDir.ArchiveDir = archiveDir
+	handled := make(map[string]glb.EmailOutcome)
+	if err := pollSpoolDir(cfg, spoolDir, handled, &glb.NoticedOutOfOffice{}, idb); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("email should still be in new/ when the archive dir is missing: %v", err)
+	}
+
+	// the email must be moved without being handled again
+	if err := os.Mkdir(archiveDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := pollSpoolDir(cfg, spoolDir, handled, &glb.NoticedOutOfOffice{}, idb); err != nil {
+		t.Fatal(err)
+	}
+	if dumps := countDumps(t, cfg); dumps != 1 {
+		t.Fatalf("email has been handled again, got %d dumps", dumps)
+	}
+	if _, err := os.Stat(filepath.Join(archiveDir, "1.mail")); err != nil {
+		t.Errorf("email wasn't moved to the archive dir: %v", err)
+	}
+	if len(handled) != 0 {
+		t.Errorf("moved email is still remembered: %v", handled)
+	}
+}
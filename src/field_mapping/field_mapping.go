@@ -0,0 +1,246 @@
+// fill jira fields of new requests from the email //
+package field_mapping
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"text/template/parse"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+// what templates can refer to
+type templateData struct {
+	email        *glb.Email
+	Subject      string
+	From         string
+	FromName     string
+	SenderDomain string
+	// capture groups of the mapping's body regex by name and number
+	Captures map[string]string
+}
+
+// first value of the header, empty when there is none
+func (data *templateData) Header(name string) string {
+	return strings.TrimSpace(data.email.Headers.Get(name))
+}
+
+func newTemplateData(email *glb.Email, bodyRegex *regexp.Regexp) *templateData {
+	data := &templateData{
+		email:    email,
+		Subject:  email.Subject,
+		Captures: make(map[string]string),
+	}
+	if email.From != nil {
+		data.From = strings.ToLower(email.From.Address)
+		data.FromName = email.From.Name
+		data.SenderDomain = data.From[strings.LastIndex(data.From, "@")+1:]
+	}
+	if bodyRegex == nil {
+		return data
+	}
+	match := bodyRegex.FindStringSubmatch(email.TextBody)
+	for idx, name := range bodyRegex.SubexpNames() {
+		if idx == 0 || idx >= len(match) {
+			continue
+		}
+		data.Captures[strconv.Itoa(idx)] = strings.TrimSpace(match[idx])
+		if name != "" {
+			data.Captures[name] = strings.TrimSpace(match[idx])
+		}
+	}
+	return data
+}
+
+// leading and trailing whitespace is trimmed
+func Render(mapping *glb.FieldMapping, email *glb.Email) (string, error) {
+	var out bytes.Buffer
+	err := mapping.CompiledTemplate.Execute(&out, newTemplateData(email, mapping.CompiledBodyRegex))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// the template renders the same for every email
+func IsStatic(tmpl *texttemplate.Template) bool {
+	if tmpl.Tree == nil {
+		return true
+	}
+	for _, node := range tmpl.Tree.Root.Nodes {
+		if _, ok := node.(*parse.TextNode); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// id of the valid value with this label or value, the value itself when any value is allowed
+func findValidValue(field *glb.RequestTypeField, value string) (string, bool) {
+	if len(field.ValidValues) == 0 {
+		return value, true
+	}
+	for _, validValue := range field.ValidValues {
+		if strings.EqualFold(validValue.Label, value) || validValue.Value == value {
+			return validValue.Value, true
+		}
+	}
+	return "", false
+}
+
+// convert to what jira expects for the field, false when the field doesn't allow the value
+// field is nil when the request type's fields are unknown
+func ConvertValue(field *glb.RequestTypeField, value string) (interface{}, bool) {
+	if field == nil {
+		return value, true
+	}
+	switch field.Type {
+	case "array":
+		var values []interface{}
+		for _, element := range strings.Split(value, ",") {
+			element = strings.TrimSpace(element)
+			if element == "" {
+				continue
+			}
+			switch field.ItemsType {
+			case "option":
+				id, found := findValidValue(field, element)
+				if !found {
+					return nil, false
+				}
+				if len(field.ValidValues) == 0 {
+					values = append(values, map[string]string{"value": id})
+				} else {
+					values = append(values, map[string]string{"id": id})
+				}
+			case "component", "version", "user":
+				values = append(values, map[string]string{"name": element})
+			default:
+				values = append(values, element)
+			}
+		}
+		return values, len(values) != 0
+	case "number":
+		number, err := strconv.ParseFloat(value, 64)
+		return number, err == nil
+	}
+	id, found := findValidValue(field, value)
+	if !found {
+		return nil, false
+	}
+	switch field.Type {
+	case "option", "priority":
+		if len(field.ValidValues) == 0 {
+			if field.Type == "priority" {
+				return map[string]string{"name": value}, true
+			}
+			return map[string]string{"value": value}, true
+		}
+		return map[string]string{"id": id}, true
+	case "user":
+		return map[string]string{"name": value}, true
+	}
+	return id, true
+}
+
+// routing rules set values like the config has them, lists are handled like comma separated values
+// maps and lists of maps are already in jira's format and sent as is
+func ConvertRoutingValue(field *glb.RequestTypeField, value interface{}) (interface{}, bool) {
+	var elements []string
+	switch value := value.(type) {
+	case map[string]interface{}, map[string]string:
+		return value, true
+	case []string:
+		elements = value
+	case []interface{}:
+		for _, element := range value {
+			if _, ok := element.(map[string]interface{}); ok {
+				return value, true
+			}
+			elements = append(elements, fmt.Sprint(element))
+		}
+	default:
+		elements = []string{fmt.Sprint(value)}
+	}
+	return ConvertValue(field, strings.Join(elements, ","))
+}
+
+func getValue(mapping *glb.FieldMapping, field *glb.RequestTypeField, email *glb.Email) (interface{}, bool) {
+	rendered, err := Render(mapping, email)
+	if err != nil {
+		lg.Logf("failed to render the template of field %s: %s\n", mapping.Field, err)
+	}
+	if rendered != "" {
+		if value, ok := ConvertValue(field, rendered); ok {
+			return value, true
+		}
+		lg.Logf("field %s doesn't allow '%s'\n", mapping.Field, rendered)
+	}
+	if mapping.Default == "" {
+		return nil, false
+	}
+	return ConvertValue(field, mapping.Default)
+}
+
+// values of the servicedesk's mapped fields the request type has
+// fieldValues set by routing rules take precedence
+func GetFieldValues(srd *glb.ServiceDesk, requestTypeId string, email *glb.Email, fieldValues map[string]interface{}) map[string]interface{} {
+	fields := srd.RequestTypeFields[requestTypeId]
+	values := make(map[string]interface{})
+	for _, mapping := range srd.FieldMappings {
+		field, found := fields[mapping.Field]
+		if fields != nil && !found {
+			lg.Logf("request type %s has no field %s\n", requestTypeId, mapping.Field)
+			continue
+		}
+		if value, ok := getValue(mapping, field, email); ok {
+			values[mapping.Field] = value
+		}
+	}
+	for fieldId, value := range fieldValues {
+		field, found := fields[fieldId]
+		if fields != nil && !found {
+			lg.Logf("request type %s has no field %s set by routing rules\n", requestTypeId, fieldId)
+			continue
+		}
+		converted, ok := ConvertRoutingValue(field, value)
+		if !ok {
+			lg.Logf("field %s doesn't allow '%v' set by routing rules\n", fieldId, value)
+			continue
+		}
+		values[fieldId] = converted
+	}
+	return values
+}
+
+// request type and field values the request is created with, routing may change the request type and add further fields
+// the returned priority can't be set on creation and has to be set right after it, it is empty otherwise
+func GetRequestFields(srd *glb.ServiceDesk, email *glb.Email, routing *glb.RoutingResult) (string, map[string]interface{}, string) {
+	requestTypeId := srd.RequestTypeId
+	if routing.RequestTypeId != "" {
+		requestTypeId = routing.RequestTypeId
+	}
+	fieldValues := GetFieldValues(srd, requestTypeId, email, routing.FieldValues)
+	// routing rules and field mappings setting the priority take precedence
+	priority := ""
+	if _, found := fieldValues["priority"]; !found {
+		priority = GetPriority(srd.PriorityMapping, email)
+		// GetFieldValues drops the priority of routing rules when the request type has no priority field
+		if routingPriority, _ := routing.FieldValues["priority"].(string); routingPriority != "" {
+			if _, found := srd.RequestTypeFields[requestTypeId]["priority"]; !found {
+				priority = routingPriority
+			}
+		}
+	}
+	// the priority can only be set on creation when it is a field of the request type
+	if _, found := srd.RequestTypeFields[requestTypeId]["priority"]; found && priority != "" {
+		fieldValues["priority"] = map[string]string{"name": priority}
+		priority = ""
+	}
+	return requestTypeId, fieldValues, priority
+}
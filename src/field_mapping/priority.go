@@ -0,0 +1,89 @@
+// tell how urgent an email is from its headers and keywords //
+package field_mapping
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.ibmgcloud.net/dth/inbound_parser/email"
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+)
+
+// high, low or empty when the headers don't mark the email
+// X-Priority is 1 (highest) to 5 (lowest), Importance high, normal or low and Priority urgent, normal or non-urgent
+func getHeaderPriority(email *glb.Email) string {
+	xPriority := strings.TrimSpace(email.Headers.Get("X-Priority"))
+	msPriority := strings.ToLower(strings.TrimSpace(email.Headers.Get("X-MSMail-Priority")))
+	importance := strings.ToLower(strings.TrimSpace(email.Headers.Get("Importance")))
+	priority := strings.ToLower(strings.TrimSpace(email.Headers.Get("Priority")))
+	switch {
+	case strings.HasPrefix(xPriority, "1") || strings.HasPrefix(xPriority, "2") || msPriority == "high" || importance == "high" || priority == "urgent":
+		return "high"
+	case strings.HasPrefix(xPriority, "4") || strings.HasPrefix(xPriority, "5") || msPriority == "low" || importance == "low" || priority == "non-urgent":
+		return "low"
+	}
+	return ""
+}
+
+// unknown priorities are lower than all others
+func IsHigherPriority(mapping *glb.PriorityMapping, priority string, current string) bool {
+	rank, found := mapping.PriorityRanks[priority]
+	if !found {
+		return false
+	}
+	currentRank, found := mapping.PriorityRanks[current]
+	return !found || rank < currentRank
+}
+
+// hyphens join words, "urgent" isn't part of "non-urgent"
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_'
+}
+
+// true when the keyword occurs in text as whole words, both need to be lower case
+func containsWord(text string, keyword string) bool {
+	if keyword == "" {
+		return false
+	}
+	for offset := 0; offset < len(text); {
+		idx := strings.Index(text[offset:], keyword)
+		if idx == -1 {
+			return false
+		}
+		start := offset + idx
+		end := start + len(keyword)
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if (start == 0 || !isWordRune(before)) && (end == len(text) || !isWordRune(after)) {
+			return true
+		}
+		_, size := utf8.DecodeRuneInString(text[start:])
+		offset = start + size
+	}
+	return false
+}
+
+// jira priority of the email, the highest of the headers and all keywords found in the subject and the reply
+// empty when there is no mapping or the email isn't marked
+func GetPriority(mapping *glb.PriorityMapping, mail *glb.Email) string {
+	if mapping == nil {
+		return ""
+	}
+	priority := ""
+	switch getHeaderPriority(mail) {
+	case "high":
+		priority = mapping.High
+	case "low":
+		priority = mapping.Low
+	}
+	// quoted replies and signatures might mention keywords of earlier emails
+	reply, _ := email.StripQuotedReply(mail.TextBody)
+	text := strings.ToLower(mail.Subject + "\n" + reply)
+	for keyword, keywordPriority := range mapping.Keywords {
+		if containsWord(text, strings.ToLower(strings.TrimSpace(keyword))) && (priority == "" || IsHigherPriority(mapping, keywordPriority, priority)) {
+			priority = keywordPriority
+		}
+	}
+	return priority
+}
@@ -2,10 +2,18 @@
 package global_structs
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
 	"html/template"
+	"net"
 	"net/mail"
+	"regexp"
+	texttemplate "text/template"
 
 	jira "github.com/andygrunwald/go-jira"
+	"golang.org/x/crypto/openpgp"
 )
 
 type ServiceDesk struct {
@@ -19,15 +27,20 @@ type ServiceDesk struct {
 	CreateEventRequests bool `yaml:"create_event_requests"`
 	// defined later
 	OnlyCreateEventRequests bool
-	Emails                  []string `yaml:"emails"`
-	ReplyEmailName          string   `yaml:"reply_email_name"`
+	// like the jira install's emails
+	Emails         []string `yaml:"emails"`
+	ReplyEmailName string   `yaml:"reply_email_name"`
 	// defined later
 	ReplyAddress *mail.Address
 
 	RequestType string `yaml:"request_type"`
 	// defined later
-	RequestTypeId  string
-	RequestPostfix string `yaml:"request_postfix"`
+	RequestTypeId string
+	// optional: request types of new requests sent to subaddresses, e.g. bug for ilc+bug@example.com
+	SubaddressRequestTypes map[string]string `yaml:"subaddress_request_types"`
+	// defined later on, the tags are lower case
+	SubaddressRequestTypeIds map[string]string
+	RequestPostfix           string `yaml:"request_postfix"`
 	// only when SendEmails
 	RequestCreationEmailTextPlainPath string `yaml:"request_creation_email_text_plain_path"`
 	// defined later on
@@ -36,6 +49,106 @@ type ServiceDesk struct {
 	DontCommentRequestStatus []string `yaml:"dont_comment_request_status"`
 
 	ReplyAboveThis string `yaml:"reply_above_this"`
+	// cut quoted replies and signatures from descriptions and comments
+	StripQuotedReplies bool `yaml:"strip_quoted_replies"`
+	// only when StripQuotedReplies, upload the cut text as attachment
+	AttachStrippedReplies bool `yaml:"attach_stripped_replies"`
+
+	// optional: decrypt S/MIME emails, both or neither need to be defined
+	SMIMECertPath string `yaml:"smime_cert_path"`
+	SMIMEKeyPath  string `yaml:"smime_key_path"`
+	// defined later on
+	SMIMECert *x509.Certificate
+	SMIMEKey  crypto.PrivateKey
+	// optional: decrypt PGP emails with this armored private key
+	PGPKeyPath string `yaml:"pgp_key_path"`
+	// only when PGPKeyPath, may be left blank
+	PGPKeyPassphrase string `yaml:"pgp_key_passphrase"`
+	// defined later on
+	PGPKey *openpgp.Entity
+
+	// optional: what happens when the sender isn't authenticated by SPF, DKIM or DMARC
+	// anonymous, reject or warn, nothing happens when left blank
+	// requires trusted_authserv_ids or verify_dkim
+	SenderAuthFailure string `yaml:"sender_auth_failure"`
+
+	// optional: all files are uploaded when left blank
+	AttachmentPolicy *AttachmentPolicy `yaml:"attachment_policy"`
+
+	// optional: ignore small inline images like signature logos and social media icons
+	InlineImageFilter *InlineImageFilter `yaml:"inline_image_filter"`
+	// optional: skip files already uploaded to the request, inline or all, nothing is skipped when left blank
+	DeduplicateAttachments string `yaml:"deduplicate_attachments"`
+	// optional: upload the email as received as original_email.eml, public or internal, it isn't uploaded when left blank
+	// only internal with an AttachmentPolicy
+	AttachOriginalEmail string `yaml:"attach_original_email"`
+
+	// optional: fill further fields of new requests from the email
+	FieldMappings []*FieldMapping `yaml:"field_mappings"`
+	// defined later on, the fields of every request type the servicedesk creates requests with by their id
+	RequestTypeFields map[string]map[string]*RequestTypeField
+
+	// optional: set the priority of requests from headers and keywords of the email
+	PriorityMapping *PriorityMapping `yaml:"priority_mapping"`
+}
+
+// jira priorities of emails marked as urgent, unmarked emails get jira's default priority
+type PriorityMapping struct {
+	// optional: for emails marked as high or low priority by X-Priority, X-MSMail-Priority, Importance or Priority
+	High string `yaml:"high"`
+	Low  string `yaml:"low"`
+	// optional: keyword to priority, for emails containing the keyword as whole words in their subject or reply, case-insensitive
+	Keywords map[string]string `yaml:"keywords"`
+	// optional: raise the priority of existing requests when commenting on them, it is never lowered
+	RaiseOnComment bool `yaml:"raise_on_comment"`
+	// defined later on, position of every priority of the jira install, the highest first
+	PriorityRanks map[string]int
+}
+
+// one field of new requests filled from the email
+type FieldMapping struct {
+	// jira field id, e.g. customfield_10010
+	Field string `yaml:"field"`
+	// text/template, e.g. {{.Header "X-Customer-Id"}}, {{.SenderDomain}}, {{.Captures.system}} or a static value
+	Template string `yaml:"template"`
+	// optional: regex over the text body, its capture groups are available as .Captures by name and number
+	BodyRegex string `yaml:"body_regex"`
+	// optional: used when the template renders empty or to a value the field doesn't allow
+	Default string `yaml:"default"`
+	// defined later on
+	CompiledTemplate  *texttemplate.Template
+	CompiledBodyRegex *regexp.Regexp
+}
+
+// inline images smaller than any of these limits aren't uploaded, 0 means no limit
+type InlineImageFilter struct {
+	// only for png, jpeg and gif, the dimensions of other images are unknown
+	MinWidth  int   `yaml:"min_width"`
+	MinHeight int   `yaml:"min_height"`
+	MinBytes  int64 `yaml:"min_bytes"`
+}
+
+// which files of an email get uploaded to jira
+type AttachmentPolicy struct {
+	// optional: 0 means unlimited
+	MaxFileBytes  int64 `yaml:"max_file_bytes"`
+	MaxTotalBytes int64 `yaml:"max_total_bytes"`
+	// optional: types detected from the content, either the extension (pdf) or the mime type (application/pdf)
+	// files of unknown type are of type unknown, only one of both may be defined
+	AllowedTypes []string `yaml:"allowed_types"`
+	DeniedTypes  []string `yaml:"denied_types"`
+	// optional: drop Office files containing VBA macros
+	BlockMacros bool `yaml:"block_macros"`
+	// optional: apply the policy to the content of zip, 7z and tar archives and list it in the description
+	InspectArchives bool `yaml:"inspect_archives"`
+	// only when InspectArchives, defaults to 3
+	MaxArchiveDepth int `yaml:"max_archive_depth"`
+	// only when InspectArchives, archives exceeding these are dropped as zip bombs
+	// default to 10000 entries and 100 MiB
+	MaxArchiveEntries       int   `yaml:"max_archive_entries"`
+	MaxArchiveUnpackedBytes int64 `yaml:"max_archive_unpacked_bytes"`
+	// only when InspectArchives, drop encrypted archives and those that can't be read
+	DropUninspectableArchives bool `yaml:"drop_uninspectable_archives"`
 }
 
 type JiraInstall struct {
@@ -48,6 +161,7 @@ type JiraInstall struct {
 	Token      string `yaml:"token"`
 	AdminToken string `yaml:"admin_token"`
 
+	// addresses, catch-alls like *@example.com or /regexes/, the first one needs to be an address
 	Emails []string `yaml:"emails"`
 	// only when emails are defined
 	// may be left blank
@@ -60,6 +174,146 @@ type JiraInstall struct {
 	ReplyAddress         *mail.Address
 
 	ServiceDesks []*ServiceDesk `yaml:"servicedesks"`
+
+	// optional: patterns finding issue keys, the first capture group or the entire match is the key
+	// defaults to `[A-Z][A-Z0-9_]+-\d+`
+	IssueKeyPatterns []string `yaml:"issue_key_patterns"`
+	// defined later on
+	IssueKeyRegexes []*regexp.Regexp
+	// optional: where to search for issue keys, in this order
+	// subject, body or the name of a header, defaults to subject
+	IssueKeyLocations []string `yaml:"issue_key_locations"`
+	// defined later on, only keys of these projects are used
+	IssueKeyProjects map[string]struct{}
+}
+
+type IMAPMailbox struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+	// tls, starttls or none
+	Security string `yaml:"security"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Mailbox  string `yaml:"mailbox"`
+	// optional, used as envelope recipient
+	Address string `yaml:"address"`
+	// optional, messages only get flagged when left blank
+	ProcessedMailbox string `yaml:"processed_mailbox"`
+	IgnoredMailbox   string `yaml:"ignored_mailbox"`
+	FailedMailbox    string `yaml:"failed_mailbox"`
+}
+
+type SpoolDir struct {
+	Path string `yaml:"path"`
+	// maildir or eml
+	Format string `yaml:"format"`
+	// optional, used as envelope recipient
+	Address string `yaml:"address"`
+	// optional for maildir, handled maildir messages are moved to cur/ when left blank
+	ArchiveDir string `yaml:"archive_dir"`
+}
+
+// http endpoint for one email vendor's inbound webhook
+type InboundWebhook struct {
+	// sendgrid, mailgun or postmark
+	Provider string `yaml:"provider"`
+	Path     string `yaml:"path"`
+	// the token in the `?token=...` query parameter
+	Token string `yaml:"token"`
+	// optional, only for mailgun
+	SigningKey string `yaml:"signing_key"`
+	// optional, only for mailgun's store and notify, requires SigningKey
+	APIKey string `yaml:"api_key"`
+}
+
+// producer of json events with its own endpoint /event/<name>
+type EventSource struct {
+	// logged with every event
+	Name string `yaml:"name"`
+	// key for the HMAC-SHA256 signature of the body
+	Secret string `yaml:"secret"`
+	// optional, defaults to X-Inbound-Parser-Signature
+	SignatureHeader string `yaml:"signature_header"`
+	// optional: also accept unsigned events with the `?token=...` query parameter
+	Token string `yaml:"token"`
+	// optional: sendgrid, github_monitor, jira_cve or sysdig, the event type is detected when left blank
+	Parser string `yaml:"parser"`
+}
+
+// the servicedesk or jira install an address belongs to
+type AddressOwner struct {
+	// nil for addresses of jira installs
+	ServiceDesk *ServiceDesk
+	JiraInstall *JiraInstall
+}
+
+type AddressRegex struct {
+	Regex *regexp.Regexp
+	Owner *AddressOwner
+}
+
+// lower case emails of all servicedesks and jira installs
+// exact addresses take precedence over regexes, regexes over catch-alls
+type AddressIndex struct {
+	Exact map[string]*AddressOwner
+	// in the order of the config, the first match wins
+	Regexes []*AddressRegex
+	// by domain
+	CatchAll map[string]*AddressOwner
+}
+
+// all conditions need to match, a rule without conditions matches every email
+type RoutingMatch struct {
+	// optional: sender addresses or domains, a domain matches its subdomains as well
+	From []string `yaml:"from"`
+	// optional: addresses or domains of the recipients in To, Cc, Bcc and the envelope
+	To []string `yaml:"to"`
+	// optional: regexes
+	Subject string `yaml:"subject"`
+	Body    string `yaml:"body"`
+	// defined later on
+	SubjectRegex *regexp.Regexp
+	BodyRegex    *regexp.Regexp
+	// optional: true only matches emails with attachments, false only those without, inline images aren't attachments
+	HasAttachments *bool `yaml:"has_attachments"`
+	// optional: both inclusive
+	MinSpamScore *float64 `yaml:"min_spam_score"`
+	MaxSpamScore *float64 `yaml:"max_spam_score"`
+	// optional: ISO 639-1 codes of the languages detected from subject and body, e.g. en or de
+	Languages []string `yaml:"languages"`
+}
+
+// what happens to emails matching a routing rule
+type RoutingActions struct {
+	// optional: project key of the servicedesk new requests are created in
+	ServiceDesk string `yaml:"servicedesk"`
+	// only when ServiceDesk
+	RequestType string `yaml:"request_type"`
+	// defined later on
+	Srd           *ServiceDesk
+	RequestTypeId string
+	// optional: name of the jira priority
+	Priority   string   `yaml:"priority"`
+	Labels     []string `yaml:"labels"`
+	Components []string `yaml:"components"`
+	// optional: field id to value, e.g. customfield_10010, converted like field mappings unless it is a map
+	CustomFields map[string]interface{} `yaml:"custom_fields"`
+	// optional: ignore the email
+	Drop bool `yaml:"drop"`
+	// optional: handle the email as if it had been sent to this address of a servicedesk or jira install
+	ForwardTo string `yaml:"forward_to"`
+	// defined later on
+	ForwardServiceDesk *ServiceDesk
+	ForwardJiraInstall *JiraInstall
+}
+
+type RoutingRule struct {
+	// logged when the rule matches
+	Name    string         `yaml:"name"`
+	Match   RoutingMatch   `yaml:"match"`
+	Actions RoutingActions `yaml:"actions"`
+	// optional: evaluate the following rules as well, otherwise the first matching rule is the last
+	Continue bool `yaml:"continue"`
 }
 
 type Config struct {
@@ -74,7 +328,19 @@ type Config struct {
 	HandleEventsUsername string `yaml:"handle_events_username"`
 	// defined later on
 	HandleEventsSrd *ServiceDesk
-	PrintLicenses   bool `yaml:"print_licenses"`
+	// only when HandleEvents, optional
+	// public key of sendgrid's signed event webhook, base64 encoded DER or PEM
+	SendgridEventPublicKey string `yaml:"sendgrid_event_public_key"`
+	// defined later on
+	SendgridEventKey *ecdsa.PublicKey
+	// only when SendgridEventPublicKey, defaults to 300
+	SendgridEventMaxAgeSeconds int `yaml:"sendgrid_event_max_age_seconds"`
+	// only when SendgridEventPublicKey
+	// accept unsigned events from other sources with the token
+	EventTokenFallback bool `yaml:"event_token_fallback"`
+	// only when HandleEvents, optional
+	EventSources  []*EventSource `yaml:"event_sources"`
+	PrintLicenses bool           `yaml:"print_licenses"`
 
 	CheckMalware  bool   `yaml:"check_malware"`
 	ClamAVScandir string `yaml:"clamav_scandir"`
@@ -83,6 +349,8 @@ type Config struct {
 	EmailKeepDays int    `yaml:"email_keep_days"`
 	// needs to be bigger than 0
 	MaxSpamScore float64 `yaml:"max_spam_score"`
+	// optional
+	MaxForwardDepth int `yaml:"max_forward_depth"`
 
 	// only when DumpRequests
 	Port          int    `yaml:"port"`
@@ -90,11 +358,55 @@ type Config struct {
 	SSLCert       string `yaml:"ssl_cert"`
 	SSLKey        string `yaml:"ssl_key"`
 	SendgridToken string `yaml:"sendgrid_token"`
+	// defaults to sendgrid on /inbound with SendgridToken
+	InboundWebhooks []*InboundWebhook `yaml:"inbound_webhooks"`
+
+	// only when DumpRequests
+	SMTPServer bool `yaml:"smtp_server"`
+	// only when SMTPServer
+	SMTPPort            int      `yaml:"smtp_port"`
+	SMTPUseLMTP         bool     `yaml:"smtp_use_lmtp"`
+	SMTPStartTLS        bool     `yaml:"smtp_starttls"`
+	SMTPMaxMessageBytes int      `yaml:"smtp_max_message_bytes"`
+	SMTPAllowedNetworks []string `yaml:"smtp_allowed_networks"`
+	// defined later on
+	SMTPAllowedIPNets []*net.IPNet
+	// only when SMTPStartTLS
+	SMTPTLSConfig *tls.Config
+
+	// only when DumpRequests
+	IMAPMailboxes []*IMAPMailbox `yaml:"imap_mailboxes"`
+	// only when IMAPMailboxes
+	IMAPPollIntervalSeconds int `yaml:"imap_poll_interval_seconds"`
+
+	// only when DumpRequests
+	SpoolDirs []*SpoolDir `yaml:"spool_dirs"`
+	// only when SpoolDirs
+	SpoolPollIntervalSeconds int `yaml:"spool_poll_interval_seconds"`
 
 	// only when ParseRequests
 	JiraInstalls    []*JiraInstall `yaml:"jira_installs"`
 	EmailWhitelist  []string       `yaml:"email_whitelist"`
 	MaxParticipants uint           `yaml:"max_participants"`
+	// defined later on, the emails of all servicedesks and jira installs
+	AddressIndex *AddressIndex
+	// optional: evaluated in order before the email is handled
+	RoutingRules []*RoutingRule `yaml:"routing_rules"`
+	// optional: PEM file with the CAs S/MIME signatures are verified against
+	// defaults to the system's CAs
+	SMIMECAPath string `yaml:"smime_ca_path"`
+	// optional: armored public keys PGP signatures are verified against
+	PGPKeyringPath string `yaml:"pgp_keyring_path"`
+	// defined later on
+	SMIMECAs   *x509.CertPool
+	PGPKeyring openpgp.EntityList
+	// optional: authserv-ids of the own mail servers whose Authentication-Results are trusted
+	// no Authentication-Results header is trusted when left blank, only verify_dkim authenticates senders then
+	TrustedAuthservIds []string `yaml:"trusted_authserv_ids"`
+	// optional: authserv-ids of forwarders whose ARC-Authentication-Results are trusted
+	TrustedARCAuthservIds []string `yaml:"trusted_arc_authserv_ids"`
+	// optional: verify DKIM signatures instead of only relying on Authentication-Results
+	VerifyDKIM bool `yaml:"verify_dkim"`
 
 	// only when SendEmails
 	SendEMailHost     string   `yaml:"send_email_host"`
@@ -3,12 +3,15 @@ package global_structs
 
 import (
 	"net/mail"
+	"strings"
 	"time"
 )
 
 type File struct {
 	Name  string
 	Bytes []byte
+	// embedded into the body, e.g. images in an html email
+	Inline bool
 }
 
 type Request struct {
@@ -18,6 +21,38 @@ type Request struct {
 	Status        string
 	Reporter      string
 	Assignee      string
+	// empty when the request has none
+	Priority string
+}
+
+// field of a request type as told by the servicedesk api
+type RequestTypeField struct {
+	FieldId  string
+	Name     string
+	Required bool
+	// jira schema type, e.g. string, number, option or array
+	Type string
+	// type of the elements when Type is array
+	ItemsType string
+	// empty when any value is allowed
+	ValidValues []RequestTypeFieldValue
+}
+
+type RequestTypeFieldValue struct {
+	Value string
+	Label string
+}
+
+// what any inbound provider knows about a received email before it gets parsed
+type InboundEnvelope struct {
+	// the entire MIME email
+	RawEmail []byte
+	// smtp envelope, may be empty when the provider doesn't know it
+	From string
+	To   []string
+	// may be empty when the provider doesn't know it
+	SenderIP  string
+	SpamScore float64
 }
 
 // everything you need to decide what to do with an incoming email
@@ -25,7 +60,7 @@ type EmailHandlingParam struct {
 	Email *Email
 	// true iff in Cfg.DontReplyTo
 	DontReplyTo bool
-	// true iff in Cfg.EmailWhitelist
+	// true iff in Cfg.EmailWhitelist and the sender is authenticated
 	Whitelisted bool
 	// the jira install this email went to, nil if invalid
 	// (always defined when ServiceDesk is defined)
@@ -41,6 +76,28 @@ type EmailHandlingParam struct {
 	DontComment bool
 	// the serviceDesk the request belongs to
 	RequestServiceDesk *ServiceDesk
+	// sender_auth_failure of the serviceDesk handling the email
+	// empty when the sender is authenticated
+	SenderAuthFailure string
+	// outcome of the routing rules
+	Routing *RoutingResult
+	// tag of the subaddress the email went to, e.g. bug for ilc+bug@example.com
+	Subaddress string
+}
+
+// the combined actions of all matching routing rules
+type RoutingResult struct {
+	// names of the matching rules in order
+	MatchedRules []string
+	Drop         bool
+	// where the email goes after the rules have been applied, nil like in EmailHandlingParam
+	ServiceDesk *ServiceDesk
+	JiraInstall *JiraInstall
+	// empty when the servicedesk's request_type is used
+	// set by the routing rules or the servicedesk's subaddress_request_types
+	RequestTypeId string
+	// jira field id to value like in the config, converted for the request type and sent with new requests
+	FieldValues map[string]interface{}
 }
 
 type Email struct {
@@ -55,12 +112,174 @@ type Email struct {
 	Cc               []*mail.Address
 	Bcc              []*mail.Address
 	Subject          string
-	SenderIP         string
-	SpamScore        float64
-	TextBody         string
-	Files            []File
-	IsAutoReply      bool
-	IsMalware        bool
+	// all headers of the email
+	Headers mail.Header
+	// empty when the email has none
+	MessageId string
+	// message ids of the emails this one replies to, oldest first
+	InReplyTo  []string
+	References []string
+	SenderIP   string
+	SpamScore  float64
+	TextBody   string
+	// jira wiki markup converted from the html body, empty when there is none
+	WikiBody string
+	// emails attached as message/rfc822, nested ones follow the email they were attached to
+	Forwarded   []ForwardedEmail
+	Files       []File
+	IsAutoReply bool
+	IsMalware   bool
+	// nil unless the email is a delivery status notification
+	DeliveryStatus *DeliveryStatus
+	// nil unless the email is signed
+	Signature *SignatureStatus
+	// nil unless the email is encrypted
+	Encryption *EncryptionStatus
+	// SPF, DKIM and DMARC results for the header from address
+	SenderAuth *SenderAuthentication
+	// nil unless the email contains a meeting invitation
+	CalendarEvent *CalendarEvent
+	// the email as received, before anything got decrypted or unpacked
+	// without the envelope headers added by the inbound_parser
+	RawEmail []byte
+}
+
+// VEVENT of a text/calendar part
+type CalendarEvent struct {
+	// REQUEST, CANCEL, REPLY, ...; PUBLISH when the calendar doesn't say
+	Method string
+	// identifies the meeting across invitations, updates and cancellations
+	UID     string
+	Summary string
+	// formatted addresses, attendees include their response when known
+	Organizer string
+	Attendees []string
+	// in the sender's timezone, zero when not defined
+	Start time.Time
+	End   time.Time
+	// Start and End are dates, End is exclusive
+	AllDay      bool
+	Location    string
+	Description string
+}
+
+// what the trusted Authentication-Results headers and local DKIM verification say about the sender
+type SenderAuthentication struct {
+	// pass, fail, softfail, none, ...; empty when not reported
+	SPF   string
+	DKIM  string
+	DMARC string
+	// domain of the envelope sender checked by SPF
+	SPFDomain string
+	// domains of all valid DKIM signatures
+	DKIMDomains []string
+	// the results are taken from the ARC-Authentication-Results of a trusted forwarder
+	ViaARC bool
+	// true iff DMARC passed or a passing SPF or DKIM domain is aligned with the header from domain
+	Aligned bool
+}
+
+// result of verifying an S/MIME or PGP signature
+type SignatureStatus struct {
+	// S/MIME or PGP
+	Method   string
+	Verified bool
+	// name or subject of the signing key or certificate
+	Signer          string
+	SignerAddresses []string
+	// only when not Verified
+	Error string
+}
+
+type EncryptionStatus struct {
+	// S/MIME or PGP
+	Method    string
+	Decrypted bool
+	// only when not Decrypted
+	Error string
+}
+
+// file not uploaded because of the attachment policy
+type DroppedFile struct {
+	Name   string
+	Reason string
+}
+
+// one file within an inspected archive
+type ArchiveEntry struct {
+	// path within the archive, nested archives are separated by /
+	Path string
+	Size int64
+}
+
+// content of an uploaded archive
+type ArchiveListing struct {
+	Name    string
+	Entries []ArchiveEntry
+}
+
+// what remains of the files after applying the attachment policy
+type AttachmentPolicyResult struct {
+	Files    []File
+	Dropped  []DroppedFile
+	Archives []ArchiveListing
+}
+
+// email attached to another one as message/rfc822
+type ForwardedEmail struct {
+	// 1 when attached to the received email, 2 when attached to a forwarded email, ...
+	Depth   int
+	From    string
+	To      string
+	Cc      string
+	Date    string
+	Subject string
+	Body    string
+}
+
+// one recipient reported in a delivery status notification
+type DeliveryStatusRecipient struct {
+	Address string
+	// failed, delayed, delivered, relayed or expanded
+	Action string
+	// e.g. 5.1.1
+	Status         string
+	DiagnosticCode string
+	RemoteMTA      string
+}
+
+// parsed multipart/report with a message/delivery-status part
+type DeliveryStatus struct {
+	ReportingMTA string
+	Recipients   []DeliveryStatusRecipient
+	// taken from the returned original email, may be empty
+	OriginalMessageId string
+	OriginalSubject   string
+}
+
+// true iff the email could never be delivered to the recipient
+func (recipient *DeliveryStatusRecipient) PermanentFailure() bool {
+	return recipient.Action == "failed" || strings.HasPrefix(recipient.Status, "5.")
 }
 
 type NoticedOutOfOffice map[string]struct{}
+
+// what became of a handled email
+type EmailOutcome string
+
+const (
+	// a request or comment has been created
+	EmailProcessed EmailOutcome = "processed"
+	// the email has deliberately not been put into jira
+	EmailIgnored EmailOutcome = "ignored"
+	// an error occurred
+	EmailFailed EmailOutcome = "failed"
+)
+
+// names of the event sources on the /event endpoint, they can't be used in event_sources
+const (
+	// events signed by sendgrid's event webhook
+	SendgridEventSource = "sendgrid"
+	// events authenticated with the ?token= query parameter
+	LegacyEventSource = "legacy"
+)
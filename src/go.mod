@@ -1,12 +1,17 @@
 module github.ibmgcloud.net/dth/inbound_parser
 
-go 1.19
+go 1.20
 
 require (
 	github.com/andygrunwald/go-jira v1.16.0
 	github.com/h2non/filetype v1.1.3
 	github.com/jhillyerd/enmime/v2 v2.0.0
 	github.com/mattn/go-sqlite3 v1.14.24
+	github.com/ulikunitz/xz v0.5.12
+	go.mozilla.org/pkcs7 v0.9.0
+	golang.org/x/crypto v0.33.0
+	golang.org/x/net v0.34.0
+	golang.org/x/text v0.22.0
 	gopkg.in/gomail.v2 v2.0.0-20160411212932-81ebce5c23df
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -24,7 +29,5 @@ require (
 	github.com/rivo/uniseg v0.4.7 // indirect
 	github.com/ssor/bom v0.0.0-20170718123548-6386211fdfcf // indirect
 	github.com/trivago/tgo v1.0.7 // indirect
-	golang.org/x/net v0.34.0 // indirect
-	golang.org/x/text v0.21.0 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 )
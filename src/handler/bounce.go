@@ -0,0 +1,122 @@
+// turn delivery status notifications into internal comments and suppress bouncing addresses //
+package handler
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	db "github.ibmgcloud.net/dth/inbound_parser/db"
+	"github.ibmgcloud.net/dth/inbound_parser/email"
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	"github.ibmgcloud.net/dth/inbound_parser/jira_actor"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+// find the request the bounced email belonged to by the message ids sent by the inbound_parser or jira
+// issue keys in the subject are only logged, anyone could send a bounce mentioning them
+func getBouncedRequest(jiraInstall *glb.JiraInstall, mail *glb.Email, idb *sql.DB) (*glb.Request, error) {
+	var messageIds []string
+	if mail.DeliveryStatus.OriginalMessageId != "" {
+		messageIds = append(messageIds, mail.DeliveryStatus.OriginalMessageId)
+	}
+	messageIds = append(messageIds, mail.InReplyTo...)
+	messageIds = append(messageIds, mail.References...)
+	for _, messageId := range messageIds {
+		issueKey, err := db.GetMessageIssueKey(idb, messageId, jiraInstall.URL)
+		if err != nil {
+			return nil, err
+		}
+		if issueKey == "" {
+			continue
+		}
+		lg.Logf("bounced email %s belongs to request %s\n", messageId, issueKey)
+		request, _, err := getRequestFromIssueKey(jiraInstall, issueKey)
+		if err != nil || request != nil {
+			return request, err
+		}
+	}
+
+	for _, subject := range []string{mail.DeliveryStatus.OriginalSubject, mail.Subject} {
+		for _, issueKey := range findIssueKeys(jiraInstall, subject) {
+			lg.Logf("bounce mentions %s in its subject but doesn't refer to an email sent for it\n", issueKey)
+		}
+	}
+	return nil, nil
+}
+
+// only addresses of the request may be suppressed, the bounce might be forged otherwise
+func getSuppressibleAddresses(jiraInstall *glb.JiraInstall, request *glb.Request) (map[string]struct{}, error) {
+	addresses := make(map[string]struct{})
+	requestAddresses, err := jira_actor.GetRequestAddresses(request.IssueKey, jiraInstall.Client)
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range requestAddresses {
+		addresses[address] = struct{}{}
+	}
+	return addresses, nil
+}
+
+func createBounceComment(deliveryStatus *glb.DeliveryStatus, suppressible map[string]struct{}) string {
+	var comment strings.Builder
+	comment.WriteString("Received delivery status notification")
+	if deliveryStatus.ReportingMTA != "" {
+		comment.WriteString(" from " + email.EscapeWiki(deliveryStatus.ReportingMTA))
+	}
+	comment.WriteString("\n")
+	for _, recipient := range deliveryStatus.Recipients {
+		comment.WriteString(fmt.Sprintf("\n* %s: %s %s", email.EscapeWiki(recipient.Address), email.EscapeWiki(recipient.Action), email.EscapeWiki(recipient.Status)))
+		if recipient.DiagnosticCode != "" {
+			comment.WriteString(fmt.Sprintf(" {{%s}}", strings.ReplaceAll(recipient.DiagnosticCode, "}", "")))
+		}
+		if _, found := suppressible[strings.ToLower(recipient.Address)]; found && recipient.PermanentFailure() {
+			comment.WriteString(" -> no more emails are sent to this address")
+		}
+	}
+	return comment.String()
+}
+
+// bounces are only trusted when they refer to an email sent for a known request
+// addresses are only suppressed when they are the request's reporter or participants
+// otherwise anyone could get an address suppressed
+func handleBounce(ehp *glb.EmailHandlingParam, idb *sql.DB) (glb.EmailOutcome, error) {
+	deliveryStatus := ehp.Email.DeliveryStatus
+	lg.Logf("email is a delivery status notification for %d recipients\n", len(deliveryStatus.Recipients))
+
+	jiraInstall := ehp.JiraInstall
+	request, err := getBouncedRequest(jiraInstall, ehp.Email, idb)
+	if err != nil {
+		return glb.EmailFailed, err
+	}
+	if request == nil {
+		lg.Logf("bounce doesn't belong to any known request")
+		lg.Logf("ignore")
+		return glb.EmailIgnored, nil
+	}
+	suppressible, err := getSuppressibleAddresses(jiraInstall, request)
+	if err != nil {
+		return glb.EmailFailed, err
+	}
+
+	err = jira_actor.CreateInternalComment(createBounceComment(deliveryStatus, suppressible), request.IssueKey, jiraInstall.Client)
+	if err != nil {
+		return glb.EmailFailed, err
+	}
+	lg.Logf("created internal comment for %s\n", request.IssueKey)
+	for _, recipient := range deliveryStatus.Recipients {
+		if !recipient.PermanentFailure() || recipient.Address == "" {
+			continue
+		}
+		if _, found := suppressible[strings.ToLower(recipient.Address)]; !found {
+			lg.Logf("not suppressing %s, it doesn't belong to %s\n", recipient.Address, request.IssueKey)
+			continue
+		}
+		lg.Logf("suppressing %s\n", recipient.Address)
+		reason := strings.TrimSpace(fmt.Sprintf("%s %s", recipient.Status, recipient.DiagnosticCode))
+		if err := db.SuppressAddress(idb, recipient.Address, reason, request.IssueKey); err != nil {
+			return glb.EmailFailed, err
+		}
+	}
+	return glb.EmailProcessed, nil
+}
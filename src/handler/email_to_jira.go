@@ -2,18 +2,25 @@
 package handler
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"net/mail"
 	"strings"
 
+	"github.ibmgcloud.net/dth/inbound_parser/attachment_policy"
 	"github.ibmgcloud.net/dth/inbound_parser/config"
+	db "github.ibmgcloud.net/dth/inbound_parser/db"
 	"github.ibmgcloud.net/dth/inbound_parser/email"
+	"github.ibmgcloud.net/dth/inbound_parser/field_mapping"
 	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
 	"github.ibmgcloud.net/dth/inbound_parser/jira_actor"
 	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
 )
 
+// jira rejects longer descriptions and comments
+const maxDescriptionLength = 32767
+
 func createSummary(srd *glb.ServiceDesk, mail *glb.Email) string {
 	summary := mail.Subject
 	if srd.RequestPostfix != "" {
@@ -24,16 +31,161 @@ func createSummary(srd *glb.ServiceDesk, mail *glb.Email) string {
 	return summary
 }
 
-func createDescription(srd *glb.ServiceDesk, mail *glb.Email, knownUser bool) string {
+// return the description and all files to be uploaded with it
+func createDescription(srd *glb.ServiceDesk, mail *glb.Email, knownUser bool) (string, []glb.File) {
+	// keep the customer's formatting when there is an html body
 	message := mail.TextBody
+	if mail.WikiBody != "" {
+		message = mail.WikiBody
+	}
 	if srd.ReplyAboveThis != "" {
-		message = strings.Split(message, srd.ReplyAboveThis)[0]
+		replyAboveThis := srd.ReplyAboveThis
+		// the marker is escaped and its whitespace collapsed like any other text of an html body
+		if mail.WikiBody != "" {
+			replyAboveThis = email.EscapeWiki(strings.Join(strings.Fields(replyAboveThis), " "))
+		}
+		message = strings.Split(message, replyAboveThis)[0]
+	}
+
+	policyResult := attachment_policy.ApplyPolicy(srd.AttachmentPolicy, attachment_policy.FilterInlineImages(srd.InlineImageFilter, mail.Files))
+	files := policyResult.Files
+	if srd.StripQuotedReplies && email.IsForwardSubject(mail.Subject) {
+		lg.Logf("not stripping quoted replies of a forwarded email")
+	} else if srd.StripQuotedReplies {
+		var stripped string
+		message, stripped = email.StripQuotedReply(message)
+		if stripped != "" {
+			lg.Logf("stripped quoted reply and signature, %d characters\n", len(stripped))
+			if srd.AttachStrippedReplies {
+				files = append(append([]glb.File{}, files...), glb.File{Name: "quoted_reply.txt", Bytes: []byte(stripped)})
+			}
+		}
+	}
+
+	if srd.AttachOriginalEmail == "public" && len(mail.RawEmail) != 0 {
+		files = append(append([]glb.File{}, files...), getOriginalEmailFile(mail))
+	}
+
+	warning := ""
+	if srd.SenderAuthFailure == "warn" && !mail.SenderAuth.Aligned {
+		warning = "Warning: the sender couldn't be authenticated by SPF, DKIM or DMARC, the email might be forged\n\n"
+	}
+	description := fmt.Sprintf("%sReceived via mail\n\n%s\n\n%s%s%s%s", warning, email.GetEmailStatsStr(mail), message, email.GetCalendarEventStr(mail), email.GetForwardedEmailsStr(mail), attachment_policy.GetAttachmentPolicyStr(policyResult))
+	return capDescription(description, files)
+}
+
+// cut the description to jira's limit, the full text is attached instead of being lost
+func capDescription(description string, files []glb.File) (string, []glb.File) {
+	if len(description) <= maxDescriptionLength {
+		return description, files
+	}
+	lg.Logf("description is %d characters long, attaching the full text\n", len(description))
+	note := "\n\n----\nThe text is too long for jira, it is attached in full as full_text.txt"
+	// don't leave half a character at the end
+	cut := strings.ToValidUTF8(description[:maxDescriptionLength-len(note)], "")
+	return cut + note, append(append([]glb.File{}, files...), glb.File{Name: "full_text.txt", Bytes: []byte(description)})
+}
+
+func getOriginalEmailFile(mail *glb.Email) glb.File {
+	return glb.File{Name: "original_email.eml", Bytes: mail.RawEmail}
+}
+
+// upload the email as received in an internal comment, only agents can see it
+func attachOriginalEmailInternally(srd *glb.ServiceDesk, mail *glb.Email, issueKey string) {
+	if srd.AttachOriginalEmail != "internal" || len(mail.RawEmail) == 0 {
+		return
+	}
+	lg.Logf("uploading original email internally")
+	err := jira_actor.CreateInternalCommentWithFiles("Original email", []glb.File{getOriginalEmailFile(mail)}, issueKey, srd.Id, srd.JiraInstall.Client)
+	if err != nil {
+		lg.LogeNoMail(err)
+	}
+}
+
+// only when the servicedesk's priority mapping raises the priority on comments
+func raisePriority(srd *glb.ServiceDesk, request *glb.Request, mail *glb.Email) {
+	if srd.PriorityMapping == nil || !srd.PriorityMapping.RaiseOnComment {
+		return
+	}
+	priority := field_mapping.GetPriority(srd.PriorityMapping, mail)
+	if priority == "" {
+		return
+	}
+	if !field_mapping.IsHigherPriority(srd.PriorityMapping, priority, request.Priority) {
+		lg.Logf("priority %s of %s is already at least %s\n", request.Priority, request.IssueKey, priority)
+		return
+	}
+	lg.Logf("raising priority of %s from %s\n", request.IssueKey, request.Priority)
+	if err := jira_actor.SetPriority(request.IssueKey, priority, srd.JiraInstall.Client); err != nil {
+		lg.LogeNoMail(err)
+	}
+}
+
+func isDeduplicated(srd *glb.ServiceDesk, file glb.File) bool {
+	return srd.DeduplicateAttachments == "all" || (srd.DeduplicateAttachments == "inline" && file.Inline)
+}
+
+// drop files already uploaded to the request and duplicates within the email, issueKey is empty for new requests
+func deduplicateFiles(srd *glb.ServiceDesk, files []glb.File, issueKey string, idb *sql.DB) []glb.File {
+	if srd.DeduplicateAttachments == "" {
+		return files
+	}
+	seen := make(map[string]struct{})
+	var kept []glb.File
+	for _, file := range files {
+		if !isDeduplicated(srd, file) {
+			kept = append(kept, file)
+			continue
+		}
+		hash := attachment_policy.GetFileHash(file)
+		if _, found := seen[hash]; found {
+			lg.Logf("not uploading %s, it is contained in the email twice\n", file.Name)
+			continue
+		}
+		seen[hash] = struct{}{}
+		if issueKey != "" {
+			uploaded, err := db.IsAttachmentUploaded(idb, hash, srd.JiraInstall.URL, issueKey)
+			if err != nil {
+				lg.LogeNoMail(err)
+			} else if uploaded {
+				lg.Logf("not uploading %s, it has been uploaded to %s before\n", file.Name, issueKey)
+				continue
+			}
+		}
+		kept = append(kept, file)
+	}
+	return kept
+}
+
+// remember the uploaded files so they aren't uploaded to the request again
+func rememberAttachments(srd *glb.ServiceDesk, files []glb.File, issueKey string, idb *sql.DB) {
+	if srd.DeduplicateAttachments == "" {
+		return
 	}
+	for _, file := range files {
+		if !isDeduplicated(srd, file) {
+			continue
+		}
+		if err := db.SetAttachmentUploaded(idb, attachment_policy.GetFileHash(file), srd.JiraInstall.URL, issueKey); err != nil {
+			lg.LogeNoMail(err)
+		}
+	}
+}
 
-	return fmt.Sprintf("Received via mail\n\n%s\n\n%s", email.GetEmailStatsStr(mail), message)
+// return true when the address bounced before, jira would send emails to participants
+func suppressed(address string, idb *sql.DB) bool {
+	isSuppressed, err := db.IsSuppressed(idb, address)
+	if err != nil {
+		lg.LogeNoMail(err)
+		return false
+	}
+	if isSuppressed {
+		lg.Logf("%s is suppressed as it bounced before\n", address)
+	}
+	return isSuppressed
 }
 
-func addAddresseesAsParticipants(srd *glb.ServiceDesk, requestKey string, mail *glb.Email, dontReplyTo bool, requestReporter string, requestAssignee string) error {
+func addAddresseesAsParticipants(srd *glb.ServiceDesk, requestKey string, mail *glb.Email, dontReplyTo bool, requestReporter string, requestAssignee string, idb *sql.DB) error {
 	addedParticipants := uint(0)
 	for _, address := range append(append(mail.Cc, mail.To[:]...), mail.Bcc[:]...) {
 		if addedParticipants >= srd.JiraInstall.Cfg.MaxParticipants {
@@ -41,11 +193,14 @@ func addAddresseesAsParticipants(srd *glb.ServiceDesk, requestKey string, mail *
 			break
 		}
 		// skip when to address refers to jira servicedesk
-		if config.GetServiceDeskFromMail(srd.JiraInstall.Cfg, address.Address) != nil {
+		if config.GetServiceDeskFromExactMail(srd.JiraInstall.Cfg, address.Address) != nil {
 			continue
 		}
 		// skip when to address refers to jira install
-		if config.GetJiraInstallFromMail(srd.JiraInstall.Cfg, address.Address) != nil {
+		if config.GetJiraInstallFromExactMail(srd.JiraInstall.Cfg, address.Address) != nil {
+			continue
+		}
+		if suppressed(address.Address, idb) {
 			continue
 		}
 		user, err := createAndGetJiraUsername(address, srd.JiraInstall)
@@ -70,23 +225,34 @@ func addAddresseesAsParticipants(srd *glb.ServiceDesk, requestKey string, mail *
 	return nil
 }
 
-func createRequestFromEmail(srd *glb.ServiceDesk, reporterUsername string, tryAnonymous bool, mail *glb.Email, dontReplyTo bool) (*glb.Request, error) {
+// routing may change the request type and add further fields, the servicedesk's field mappings add the rest
+func createRequestFromEmail(srd *glb.ServiceDesk, reporterUsername string, tryAnonymous bool, mail *glb.Email, dontReplyTo bool, routing *glb.RoutingResult, idb *sql.DB) (*glb.Request, error) {
 	knownUser := reporterUsername != ""
 	lg.Logf("create request, known user: %t\n", knownUser)
 	summary := createSummary(srd, mail)
-	description := createDescription(srd, mail, knownUser)
-	requestKey, err := jira_actor.CreateRequest(summary, description, reporterUsername, srd.RequestTypeId, srd.Id, tryAnonymous, srd.JiraInstall.Client)
+	description, files := createDescription(srd, mail, knownUser)
+	files = deduplicateFiles(srd, files, "", idb)
+	requestTypeId, fieldValues, priority := field_mapping.GetRequestFields(srd, mail, routing)
+	requestKey, err := jira_actor.CreateRequest(summary, description, reporterUsername, requestTypeId, srd.Id, tryAnonymous, fieldValues, srd.JiraInstall.Client)
 	if err != nil {
 		return nil, err
 	}
 	lg.Logf("created new request: %s\n", requestKey)
-	if len(mail.Files) != 0 {
+	if priority != "" {
+		if err := jira_actor.SetPriority(requestKey, priority, srd.JiraInstall.Client); err != nil {
+			lg.LogeNoMail(err)
+		}
+	}
+	if len(files) != 0 {
 		lg.Logf("uploading attachments")
-		jira_actor.CreateComment("", mail.Files, requestKey, srd.Id, srd.JiraInstall.Client)
+		if jira_actor.CreateComment("", files, requestKey, srd.Id, srd.JiraInstall.Client) == nil {
+			rememberAttachments(srd, files, requestKey, idb)
+		}
 	}
+	attachOriginalEmailInternally(srd, mail, requestKey)
 
 	// assignee is never set right after creation
-	err = addAddresseesAsParticipants(srd, requestKey, mail, dontReplyTo, reporterUsername, "")
+	err = addAddresseesAsParticipants(srd, requestKey, mail, dontReplyTo, reporterUsername, "", idb)
 	if err != nil {
 		return nil, err
 	}
@@ -102,6 +268,7 @@ func createRequestFromEvent(cfg *glb.Config, summary string, description string,
 		cfg.HandleEventsSrd.RequestTypeId,
 		cfg.HandleEventsSrd.Id,
 		false,
+		nil,
 		cfg.HandleEventsSrd.JiraInstall.Client,
 	)
 	if err != nil {
@@ -115,21 +282,27 @@ func createRequestFromEvent(cfg *glb.Config, summary string, description string,
 	return jira_actor.GetRequest(requestKey, cfg.HandleEventsSrd.JiraInstall.Client)
 }
 
-func createCommentFromEmail(srd *glb.ServiceDesk, request *glb.Request, commenterUsername string, mail *glb.Email, dontReplyTo bool) error {
+func createCommentFromEmail(srd *glb.ServiceDesk, request *glb.Request, commenterUsername string, mail *glb.Email, dontReplyTo bool, idb *sql.DB) error {
 	knownUser := commenterUsername != ""
 	lg.Logf("create comment, known user: %t\n", knownUser)
-	description := createDescription(srd, mail, knownUser)
-	err := jira_actor.CreateComment(description, mail.Files, request.IssueKey, srd.Id, srd.JiraInstall.Client)
+	description, files := createDescription(srd, mail, knownUser)
+	files = deduplicateFiles(srd, files, request.IssueKey, idb)
+	err := jira_actor.CreateComment(description, files, request.IssueKey, srd.Id, srd.JiraInstall.Client)
 	if err != nil {
 		return err
 	}
 	lg.Logf("created new comment for %s\n", request.IssueKey)
+	rememberAttachments(srd, files, request.IssueKey, idb)
+	attachOriginalEmailInternally(srd, mail, request.IssueKey)
+	raisePriority(srd, request, mail)
 
 	if commenterUsername != "" {
 		if commenterUsername == request.Reporter {
 			lg.Logf("don't add reporter of request as participant")
 		} else if commenterUsername == request.Assignee {
 			lg.Logf("don't add assignee of request as participant")
+		} else if suppressed(mail.From.Address, idb) {
+			lg.Logf("don't add suppressed commenter as participant")
 		} else {
 			lg.Logf("adding commenter as participant")
 			err := jira_actor.AddParticipant(request.IssueKey, commenterUsername, srd.JiraInstall.Client)
@@ -138,7 +311,7 @@ func createCommentFromEmail(srd *glb.ServiceDesk, request *glb.Request, commente
 			}
 		}
 	}
-	return addAddresseesAsParticipants(srd, request.IssueKey, mail, dontReplyTo, request.Reporter, request.Assignee)
+	return addAddresseesAsParticipants(srd, request.IssueKey, mail, dontReplyTo, request.Reporter, request.Assignee, idb)
 }
 
 func createAndGetJiraUsername(address *mail.Address, jiraInstall *glb.JiraInstall) (string, error) {
@@ -3,21 +3,54 @@
 package handler
 
 import (
+	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"log"
 
 	"github.ibmgcloud.net/dth/inbound_parser/config"
+	db "github.ibmgcloud.net/dth/inbound_parser/db"
 	"github.ibmgcloud.net/dth/inbound_parser/email"
 	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
 	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
 )
 
-func HandleEmail(cfg *glb.Config, emailBody []byte, noticedOutOfOffice *glb.NoticedOutOfOffice) error {
-	ehp, err := prepareEmailHandling(cfg, emailBody)
+// handle email received from any inbound provider
+func HandleEmail(cfg *glb.Config, envelope *glb.InboundEnvelope, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) (glb.EmailOutcome, error) {
+	parsedEmail, err := email.GetParsedEmail(envelope, cfg)
 	if err != nil {
-		return err
+		return glb.EmailFailed, err
+	}
+	return handleParsedEmail(cfg, parsedEmail, noticedOutOfOffice, idb)
+}
+
+// remember the request so replies are assigned to it even when the subject gets changed
+// a message id already belonging to another request isn't taken over
+func rememberMessageId(jiraInstall *glb.JiraInstall, mail *glb.Email, request *glb.Request, idb *sql.DB) {
+	if mail.MessageId == "" {
+		return
+	}
+	if err := db.AddMessageIssueKey(idb, mail.MessageId, jiraInstall.URL, request.IssueKey); err != nil {
+		lg.LogeNoMail(err)
+	}
+}
+
+// remember the request so updates and cancellations of the meeting are assigned to it
+// the sender chooses the uid, the first request keeps it
+func rememberCalendarEvent(jiraInstall *glb.JiraInstall, mail *glb.Email, request *glb.Request, idb *sql.DB) {
+	if mail.CalendarEvent == nil || mail.CalendarEvent.UID == "" {
+		return
+	}
+	if err := db.SetCalendarEventIssueKey(idb, mail.CalendarEvent.UID, jiraInstall.URL, request.IssueKey); err != nil {
+		lg.LogeNoMail(err)
+	}
+}
+
+func handleParsedEmail(cfg *glb.Config, parsedEmail *glb.Email, noticedOutOfOffice *glb.NoticedOutOfOffice, idb *sql.DB) (glb.EmailOutcome, error) {
+	ehp, err := prepareEmailHandling(cfg, parsedEmail, idb)
+	if err != nil {
+		return glb.EmailFailed, err
 	}
 
 	if cfg.DebugParseOnly {
@@ -25,40 +58,62 @@ func HandleEmail(cfg *glb.Config, emailBody []byte, noticedOutOfOffice *glb.Noti
 		// this flag is never to be used in production
 		jsonString, err := json.MarshalIndent(ehp.Email, "", "  ")
 		if err != nil {
-			return err
+			return glb.EmailFailed, err
 		}
 		log.Printf("%s\n\n\n\n", jsonString)
-		return nil
+		return glb.EmailIgnored, nil
 	}
 
 	if ehp.Email.IsMalware {
 		lg.Logf("this is malware")
 		lg.Logf("ignore")
-		return nil
+		return glb.EmailIgnored, nil
+	}
+
+	if !ehp.Whitelisted && ehp.Email.SpamScore >= cfg.MaxSpamScore {
+		lg.Logf("sender address is not whitelisted and the spam score is too high")
+		lg.Logf("ignore")
+		return glb.EmailIgnored, nil
 	}
 
-	if config.GetServiceDeskFromMail(cfg, ehp.Email.From.Address) != nil {
+	if ehp.Routing.Drop {
+		lg.Logf("dropped by routing rule '%s'\n", ehp.Routing.MatchedRules[len(ehp.Routing.MatchedRules)-1])
+		lg.Logf("ignore")
+		return glb.EmailIgnored, nil
+	}
+
+	if config.GetServiceDeskFromExactMail(cfg, ehp.Email.From.Address) != nil {
 		lg.Logf("email is from an address assigned to a serviceDesk")
 		lg.Logf("aborting to prevent endless loop")
-		return nil
+		return glb.EmailIgnored, nil
 	}
 
-	if config.GetJiraInstallFromMail(cfg, ehp.Email.From.Address) != nil {
+	if config.GetJiraInstallFromExactMail(cfg, ehp.Email.From.Address) != nil {
 		lg.Logf("email is from an address assigned to a jira install")
 		lg.Logf("aborting to prevent endless loop")
-		return nil
+		return glb.EmailIgnored, nil
 	}
 
-	if ehp.Whitelisted {
-		lg.Logf("sender address is whitelisted, ignore spam score and auto reply status")
-	} else {
-		lg.Logf("sender address is not whitelisted")
+	if ehp.SenderAuthFailure == "reject" {
+		lg.Logf("sender isn't authenticated by SPF, DKIM or DMARC")
+		lg.Logf("ignore")
+		return glb.EmailIgnored, nil
+	}
 
-		if ehp.Email.SpamScore >= cfg.MaxSpamScore {
-			lg.Logf("spam score is too high")
+	// bounces would otherwise be dropped as auto replies or create new requests
+	if ehp.Email.DeliveryStatus != nil {
+		if ehp.JiraInstall == nil {
+			lg.Logf("bounce isn't addressed to any serviceDesk or jira install")
 			lg.Logf("ignore")
-			return nil
+			return glb.EmailIgnored, nil
 		}
+		return handleBounce(ehp, idb)
+	}
+
+	if ehp.Whitelisted {
+		lg.Logf("sender address is whitelisted, ignore auto reply status")
+	} else {
+		lg.Logf("sender address is not whitelisted")
 
 		if ehp.Email.IsAutoReply {
 			lg.Logf("email is an auto reply")
@@ -66,12 +121,12 @@ func HandleEmail(cfg *glb.Config, emailBody []byte, noticedOutOfOffice *glb.Noti
 			if found {
 				lg.Logf("%s has already been handled\n", email.FormatAddr(ehp.Email.From))
 				lg.Logf("ignore")
-				return nil
+				return glb.EmailIgnored, nil
 			}
 			if ehp.Request == nil {
 				lg.Logf("auto-replies don't get used to create new requests")
 				lg.Logf("ignore")
-				return nil
+				return glb.EmailIgnored, nil
 			}
 			lg.Logf("%s has not already been handled\n", email.FormatAddr(ehp.Email.From))
 			(*noticedOutOfOffice)[ehp.Email.From.Address] = struct{}{}
@@ -81,7 +136,7 @@ func HandleEmail(cfg *glb.Config, emailBody []byte, noticedOutOfOffice *glb.Noti
 	if ehp.JiraInstall == nil {
 		lg.Logf("addressee isn't assigned to any serviceDesk or jira install")
 		lg.Logf("ignore")
-		return nil
+		return glb.EmailIgnored, nil
 	}
 
 	lg.Logf("addressee, a Cc or Bcc refers to serviceDesk email or jira install")
@@ -90,13 +145,20 @@ func HandleEmail(cfg *glb.Config, emailBody []byte, noticedOutOfOffice *glb.Noti
 		if ehp.ServiceDesk == nil {
 			lg.Logf("the email went to a jira install, not a serviceDesk; the inbound_parser doesn't know where to create the new request")
 			lg.Logf("send error mail to customer")
-			email.SendWrongAddressErrorEmail(ehp.JiraInstall, ehp.Email)
-			return nil
+			email.SendWrongAddressErrorEmail(ehp.JiraInstall, ehp.Email, idb)
+			return glb.EmailIgnored, nil
 		}
-		createdRequest, err := createRequestFromEmail(ehp.ServiceDesk, ehp.SenderJiraUsername, true, ehp.Email, ehp.DontReplyTo)
+		if ehp.Email.CalendarEvent != nil && ehp.Email.CalendarEvent.Method == "CANCEL" {
+			lg.Logf("cancellation of a meeting that doesn't belong to any request")
+			lg.Logf("ignore")
+			return glb.EmailIgnored, nil
+		}
+		createdRequest, err := createRequestFromEmail(ehp.ServiceDesk, ehp.SenderJiraUsername, true, ehp.Email, ehp.DontReplyTo, ehp.Routing, idb)
 		if err != nil {
-			return err
+			return glb.EmailFailed, err
 		}
+		rememberMessageId(ehp.JiraInstall, ehp.Email, createdRequest, idb)
+		rememberCalendarEvent(ehp.JiraInstall, ehp.Email, createdRequest, idb)
 		// jira already sends request creation reply email when user is known or got created
 		if ehp.SenderJiraUsername == "" {
 			lg.Logf("user without jira account")
@@ -104,9 +166,9 @@ func HandleEmail(cfg *glb.Config, emailBody []byte, noticedOutOfOffice *glb.Noti
 				lg.Logf("email sender is in don't reply list")
 			} else {
 				lg.Logf("email sender is not in don't reply list")
-				err = email.SendRequestCreatedEmail(ehp.ServiceDesk, ehp.Email, createdRequest)
+				err = email.SendRequestCreatedEmail(ehp.ServiceDesk, ehp.Email, createdRequest, idb)
 				if err != nil {
-					return err
+					return glb.EmailFailed, err
 				}
 			}
 		}
@@ -115,28 +177,33 @@ func HandleEmail(cfg *glb.Config, emailBody []byte, noticedOutOfOffice *glb.Noti
 		if ehp.DontComment {
 			lg.Logf("the status '%s' is not to be commented", ehp.Request.Status)
 			lg.Logf("ignore")
-			return nil
+			return glb.EmailIgnored, nil
 		}
 		// always create the request as the request id is valid
-		err := createCommentFromEmail(ehp.RequestServiceDesk, ehp.Request, ehp.SenderJiraUsername, ehp.Email, ehp.DontReplyTo)
+		err := createCommentFromEmail(ehp.RequestServiceDesk, ehp.Request, ehp.SenderJiraUsername, ehp.Email, ehp.DontReplyTo, idb)
 		if err != nil {
-			return err
+			return glb.EmailFailed, err
 		}
+		rememberMessageId(ehp.JiraInstall, ehp.Email, ehp.Request, idb)
+		rememberCalendarEvent(ehp.JiraInstall, ehp.Email, ehp.Request, idb)
 		// don't send reply email <- jira already does as this is probably a reply to a mail from jira
 	}
 
-	return nil
+	return glb.EmailProcessed, nil
 }
 
-func HandleEvent(cfg *glb.Config, eventBody []byte) error {
-	lg.Logf("handling event")
+// sourceName is the authenticated event source, its parser decides how the events are read
+func HandleEvent(cfg *glb.Config, sourceName string, eventBody []byte) error {
+	lg.Logf("handling event from %s", sourceName)
 	events, err := getEvents(cfg, eventBody)
 	if err != nil {
 		return err
 	}
 
+	parser := getEventParser(cfg, sourceName)
 	for _, event := range events {
-		summary, description, files := getEvent(event)
+		summary, description, files := getEvent(event, parser)
+		description += fmt.Sprintf("\n\nEvent source: %s", sourceName)
 		lg.Logf(string(event))
 		lg.Logf(summary)
 		lg.Logf(description)
@@ -149,7 +216,36 @@ func HandleEvent(cfg *glb.Config, eventBody []byte) error {
 	return nil
 }
 
-func getEvent(eventJson []byte) (string, string, []glb.File) {
+// return the parser configured for the event source, empty when the event type should be detected
+func getEventParser(cfg *glb.Config, sourceName string) string {
+	if sourceName == glb.SendgridEventSource {
+		return "sendgrid"
+	}
+	for _, source := range cfg.EventSources {
+		if source.Name == sourceName {
+			return source.Parser
+		}
+	}
+	return ""
+}
+
+// parser selects one event type, all are tried in turn when empty
+func getEvent(eventJson []byte, parser string) (string, string, []glb.File) {
+	eventParsers := map[string]func([]byte) (string, string, []glb.File, bool){
+		"sendgrid":       getSendgridEvent,
+		"github_monitor": getGitHubMonitorEvent,
+		"jira_cve":       getJiraCveEvent,
+		"sysdig":         getSysdigEvent,
+	}
+	if parser != "" {
+		summary, description, files, isEvent := eventParsers[parser](eventJson)
+		if isEvent {
+			lg.Logf("is %s event", parser)
+			return summary, description, files
+		}
+		lg.Logf("event doesn't match parser %s", parser)
+		return "Unknown Event Type", string(eventJson), make([]glb.File, 0)
+	}
 	sendgridSummary, sendgridDescription, sendgridFiles, isSendgridEvent := getSendgridEvent(eventJson)
 	if isSendgridEvent {
 		lg.Logf("is Sendgrid event")
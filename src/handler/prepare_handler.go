@@ -2,37 +2,156 @@
 package handler
 
 import (
+	"database/sql"
 	"encoding/json"
-	"regexp"
+	"net/mail"
+	"net/textproto"
 	"strings"
 
 	"github.ibmgcloud.net/dth/inbound_parser/config"
+	db "github.ibmgcloud.net/dth/inbound_parser/db"
 	"github.ibmgcloud.net/dth/inbound_parser/email"
 	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
 	"github.ibmgcloud.net/dth/inbound_parser/jira_actor"
 	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+	"github.ibmgcloud.net/dth/inbound_parser/routing"
 )
 
-func getRequestFromEmail(jiraInstall *glb.JiraInstall, emailSubject string) (*glb.Request, *glb.ServiceDesk, error) {
-	re := regexp.MustCompile(`[A-Z]+-\d+`)
-	matches := re.FindAllString(emailSubject, -1)
+// return nil when the issue key doesn't refer to a request of a registered serviceDesk
+func getRequestFromIssueKey(jiraInstall *glb.JiraInstall, issueKey string) (*glb.Request, *glb.ServiceDesk, error) {
+	request, err := jira_actor.GetRequest(issueKey, jiraInstall.Client)
+	if err != nil {
+		return nil, nil, err
+	}
+	if request == nil {
+		lg.Logf("attemting to comment request %s that doesn't exist in jira install %s or is an issue\n", issueKey, jiraInstall.URL)
+		return nil, nil, nil
+	}
+	srd := config.GetServiceDeskFromId(jiraInstall.Cfg, request.ServiceDeskId)
+	if srd == nil {
+		lg.Logf("attemting to comment request %s of serviceDesk that hasn't been registered for jira install %s\n", issueKey, jiraInstall.URL)
+		return nil, nil, nil
+	}
+	return request, srd, nil
+}
 
-	for _, match := range matches {
-		request, err := jira_actor.GetRequest(match, jiraInstall.Client)
+// find the request via the message ids of the emails this one replies to, newest first
+func getRequestFromThread(jiraInstall *glb.JiraInstall, mail *glb.Email, idb *sql.DB) (*glb.Request, *glb.ServiceDesk, error) {
+	var messageIds []string
+	messageIds = append(messageIds, mail.InReplyTo...)
+	for idx := len(mail.References) - 1; idx >= 0; idx-- {
+		messageIds = append(messageIds, mail.References[idx])
+	}
+	for _, messageId := range messageIds {
+		issueKey, err := db.GetMessageIssueKey(idb, messageId, jiraInstall.URL)
 		if err != nil {
 			return nil, nil, err
 		}
-		if request == nil {
-			lg.Logf("attemting to comment request %s that doesn't exist in jira install %s or is an issue\n", match, jiraInstall.URL)
+		if issueKey == "" {
 			continue
 		}
-		srd := config.GetServiceDeskFromId(jiraInstall.Cfg, request.ServiceDeskId)
-		if srd == nil {
-			lg.Logf("attemting to comment request %s of serviceDesk that hasn't been registered for jira install %s\n", match, jiraInstall.URL)
-			continue
+		lg.Logf("%s replies to %s of request %s\n", mail.MessageId, messageId, issueKey)
+		request, srd, err := getRequestFromIssueKey(jiraInstall, issueKey)
+		if err != nil || request != nil {
+			return request, srd, err
+		}
+	}
+	return nil, nil, nil
+}
+
+// find the request an earlier invitation to the same meeting created or commented
+func getRequestFromCalendarEvent(jiraInstall *glb.JiraInstall, mail *glb.Email, idb *sql.DB) (*glb.Request, *glb.ServiceDesk, error) {
+	if mail.CalendarEvent == nil || mail.CalendarEvent.UID == "" {
+		return nil, nil, nil
+	}
+	issueKey, err := db.GetCalendarEventIssueKey(idb, mail.CalendarEvent.UID, jiraInstall.URL)
+	if err != nil || issueKey == "" {
+		return nil, nil, err
+	}
+	lg.Logf("meeting %s belongs to request %s\n", mail.CalendarEvent.UID, issueKey)
+	return getRequestFromIssueKey(jiraInstall, issueKey)
+}
+
+// return the text of an issue_key_locations entry
+func getIssueKeyLocation(mail *glb.Email, location string) string {
+	switch strings.ToLower(location) {
+	case "subject":
+		return mail.Subject
+	case "body":
+		return mail.TextBody
+	default:
+		return strings.Join(mail.Headers[textproto.CanonicalMIMEHeaderKey(location)], "\n")
+	}
+}
+
+// return all issue keys in the order of the patterns, then in the order of appearance
+func findIssueKeys(jiraInstall *glb.JiraInstall, text string) []string {
+	var issueKeys []string
+	for _, re := range jiraInstall.IssueKeyRegexes {
+		for _, match := range re.FindAllStringSubmatch(text, -1) {
+			if len(match) > 1 {
+				issueKeys = append(issueKeys, match[1])
+			} else {
+				issueKeys = append(issueKeys, match[0])
+			}
+		}
+	}
+	return issueKeys
+}
+
+// mail servers might lower case the tag, so it is tried upper case as well
+func getRequestFromSubaddress(jiraInstall *glb.JiraInstall, subaddress string) (*glb.Request, *glb.ServiceDesk, error) {
+	if subaddress == "" {
+		return nil, nil, nil
+	}
+	for _, tag := range []string{subaddress, strings.ToUpper(subaddress)} {
+		for _, issueKey := range findIssueKeys(jiraInstall, tag) {
+			// ilc+bug-2@ isn't meant to be an issue key
+			if issueKey != tag {
+				continue
+			}
+			projectKey := issueKey[:strings.LastIndex(issueKey, "-")]
+			if _, found := jiraInstall.IssueKeyProjects[projectKey]; !found {
+				continue
+			}
+			request, srd, err := getRequestFromIssueKey(jiraInstall, issueKey)
+			if err != nil || request != nil {
+				if request != nil {
+					lg.Logf("using request %s of subaddress %s\n", issueKey, subaddress)
+				}
+				return request, srd, err
+			}
+		}
+	}
+	return nil, nil, nil
+}
+
+// search the jira install's issue_key_locations in order, the first key referring to a request wins
+func getRequestFromEmail(jiraInstall *glb.JiraInstall, mail *glb.Email) (*glb.Request, *glb.ServiceDesk, error) {
+	checked := make(map[string]struct{})
+	for _, location := range jiraInstall.IssueKeyLocations {
+		for _, issueKey := range findIssueKeys(jiraInstall, getIssueKeyLocation(mail, location)) {
+			if _, found := checked[issueKey]; found {
+				continue
+			}
+			checked[issueKey] = struct{}{}
+			projectKey := issueKey[:strings.LastIndex(issueKey+"-", "-")]
+			if _, found := jiraInstall.IssueKeyProjects[projectKey]; !found {
+				lg.Logf("ignoring %s found in %s, project %s has no serviceDesk in jira install %s\n", issueKey, location, projectKey, jiraInstall.URL)
+				continue
+			}
+			lg.Logf("checking %s found in %s\n", issueKey, location)
+			request, srd, err := getRequestFromIssueKey(jiraInstall, issueKey)
+			if err != nil {
+				return nil, nil, err
+			}
+			if request != nil {
+				lg.Logf("using request %s found in %s\n", issueKey, location)
+				return request, srd, nil
+			}
 		}
-		return request, srd, nil
 	}
+	lg.Logf("no issue key of a request found in %s\n", strings.Join(jiraInstall.IssueKeyLocations, ", "))
 	return nil, nil, nil
 }
 
@@ -54,55 +173,81 @@ func whitelisted(cfg *glb.Config, address string) bool {
 	return false
 }
 
-func prepareEmailHandling(cfg *glb.Config, emailBody []byte) (*glb.EmailHandlingParam, error) {
+// is email.To or an email.Cc or an email.Bcc referring to a serviceDesk or jira install?
+// the routing rules might send the email somewhere else
+// also return the subaddress tag of the address the email went to
+func RouteEmail(cfg *glb.Config, rules []*glb.RoutingRule, parsedEmail *glb.Email) (*glb.RoutingResult, string) {
+	addresses := append(append(append([]*mail.Address{}, parsedEmail.To...), parsedEmail.Cc...), parsedEmail.Bcc...)
+	srd, jiraInstall, subaddress := config.GetAddressee(cfg, addresses)
+	return routing.Route(rules, parsedEmail, srd, jiraInstall, subaddress), subaddress
+}
+
+func prepareEmailHandling(cfg *glb.Config, parsedEmail *glb.Email, idb *sql.DB) (*glb.EmailHandlingParam, error) {
 	lg.Logf("loading email handling params")
 	ehp := glb.EmailHandlingParam{}
 	var err error
 
-	ehp.Email, err = email.GetParsedEmail(emailBody, cfg)
-	if err != nil {
-		return nil, err
-	}
+	ehp.Email = parsedEmail
 	lg.Logf(email.GetEmailStatsStr(ehp.Email))
 
 	ehp.DontReplyTo = notToReplyTo(cfg, ehp.Email.From.Address)
 	ehp.Whitelisted = whitelisted(cfg, ehp.Email.From.Address)
+	// without sender authentication the whitelist applies like it always did
+	if ehp.Whitelisted && config.SenderAuthConfigured(cfg) && !ehp.Email.SenderAuth.Aligned {
+		lg.Logf("sender address is whitelisted but not authenticated, ignoring the whitelist")
+		ehp.Whitelisted = false
+	}
 
-	// you could optimize these two loops into a single on
-	// but like this the behavior is defined: when there is a serviceDesk addressed, use that
-	// otherwise check if jira installs are addressed
-	// is email.To or an email.Cc or an email.Bcc referring to a serviceDesk?
-	for _, to := range append(append(ehp.Email.To, ehp.Email.Cc[:]...), ehp.Email.Bcc[:]...) {
-		ehp.ServiceDesk = config.GetServiceDeskFromMail(cfg, to.Address)
-		if ehp.ServiceDesk != nil {
-			break
+	ehp.Routing, ehp.Subaddress = RouteEmail(cfg, cfg.RoutingRules, ehp.Email)
+	ehp.ServiceDesk, ehp.JiraInstall = ehp.Routing.ServiceDesk, ehp.Routing.JiraInstall
+	if ehp.JiraInstall == nil || ehp.Routing.Drop {
+		// email went to address not specified anywhere, probably to be ignored
+		return &ehp, nil
+	}
+
+	// does the email reply to one belonging to a request
+	ehp.Request, ehp.RequestServiceDesk, err = getRequestFromThread(ehp.JiraInstall, ehp.Email, idb)
+	if err != nil {
+		return nil, err
+	}
+	// is the email an update or cancellation of a meeting belonging to a request
+	if ehp.Request == nil {
+		ehp.Request, ehp.RequestServiceDesk, err = getRequestFromCalendarEvent(ehp.JiraInstall, ehp.Email, idb)
+		if err != nil {
+			return nil, err
 		}
 	}
-	if ehp.ServiceDesk != nil {
-		ehp.JiraInstall = ehp.ServiceDesk.JiraInstall
-	} else {
-		// is email.To or an email.Cc or an email.Bcc referring to a jira install?
-		for _, to := range append(append(ehp.Email.To, ehp.Email.Cc[:]...), ehp.Email.Bcc[:]...) {
-			ehp.JiraInstall = config.GetJiraInstallFromMail(cfg, to.Address)
-			if ehp.JiraInstall != nil {
-				break
-			}
+	// was the email sent to a subaddress like ilc+ILC-123@example.com
+	if ehp.Request == nil {
+		ehp.Request, ehp.RequestServiceDesk, err = getRequestFromSubaddress(ehp.JiraInstall, ehp.Subaddress)
+		if err != nil {
+			return nil, err
 		}
-		if ehp.JiraInstall == nil {
-			// email went to address not specified anywhere, probably to be ignored
-			return &ehp, nil
+	}
+	// is a request referenced in the email's subject or other issue_key_locations
+	if ehp.Request == nil {
+		ehp.Request, ehp.RequestServiceDesk, err = getRequestFromEmail(ehp.JiraInstall, ehp.Email)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	ehp.SenderJiraUsername, err = createAndGetJiraUsername(ehp.Email.From, ehp.JiraInstall)
-	if err != nil {
-		return nil, err
+	// the policy of the serviceDesk the request or comment is created in
+	policyServiceDesk := ehp.ServiceDesk
+	if ehp.Request != nil {
+		policyServiceDesk = ehp.RequestServiceDesk
+	}
+	if policyServiceDesk != nil && !ehp.Email.SenderAuth.Aligned {
+		ehp.SenderAuthFailure = policyServiceDesk.SenderAuthFailure
 	}
 
-	// is a request referenced in the email's subject
-	ehp.Request, ehp.RequestServiceDesk, err = getRequestFromEmail(ehp.JiraInstall, ehp.Email.Subject)
-	if err != nil {
-		return nil, err
+	if ehp.SenderAuthFailure == "anonymous" {
+		lg.Logf("sender isn't authenticated, handling the email anonymously")
+	} else {
+		ehp.SenderJiraUsername, err = createAndGetJiraUsername(ehp.Email.From, ehp.JiraInstall)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	ehp.DontComment = false
@@ -40,30 +40,41 @@ func capLength(str string, length int, emptyAllowed bool) string {
 }
 
 // return id of request
-func CreateRequest(summary string, description string, reporterUsername string, requestTypeId string, serviceDeskId string, tryAnonymous bool, client *jira.Client) (string, error) {
+// fieldValues holds further fields by their id, e.g. priority or labels, may be nil
+func CreateRequest(summary string, description string, reporterUsername string, requestTypeId string, serviceDeskId string, tryAnonymous bool, fieldValues map[string]interface{}, client *jira.Client) (string, error) {
 	summary = capLength(summary, 255, false)
 	description = capLength(description, 32767, false)
 	lg.Logf("creating request with summary '%s' from '%s'\n", summary, reporterUsername)
-	newRequest := &jira.Request{
-		ServiceDeskID: serviceDeskId,
-		TypeID:        requestTypeId,
-		FieldValues: []jira.RequestFieldValue{
-			{
-				FieldID: "summary",
-				Value:   summary,
-			},
-			{
-				FieldID: "description",
-				Value:   description,
-			},
+	// go-jira only supports string field values
+	type NewRequest struct {
+		ServiceDeskId   string                 `json:"serviceDeskId"`
+		RequestTypeId   string                 `json:"requestTypeId"`
+		FieldValues     map[string]interface{} `json:"requestFieldValues"`
+		RaiseOnBehalfOf string                 `json:"raiseOnBehalfOf,omitempty"`
+	}
+	newRequest := NewRequest{
+		ServiceDeskId: serviceDeskId,
+		RequestTypeId: requestTypeId,
+		FieldValues: map[string]interface{}{
+			"summary":     summary,
+			"description": description,
 		},
+		RaiseOnBehalfOf: reporterUsername,
+	}
+	for fieldId, value := range fieldValues {
+		newRequest.FieldValues[fieldId] = value
+	}
+	req, err := client.NewRequestWithContext(context.Background(), "POST", "rest/servicedeskapi/request", newRequest)
+	if err != nil {
+		return "", err
 	}
-	request, resp, err := client.Request.Create(reporterUsername, []string{}, newRequest)
+	var request jira.Request
+	resp, err := client.Do(req, &request)
 	if err != nil {
 		lg.Logf("failed to create request on behalf of '%s'\n", reporterUsername)
 		if reporterUsername != "" && tryAnonymous {
 			lg.Logf("trying again anonymously")
-			return CreateRequest(summary, description, "", requestTypeId, serviceDeskId, false, client)
+			return CreateRequest(summary, description, "", requestTypeId, serviceDeskId, false, fieldValues, client)
 		}
 		printJiraResponse(resp)
 		return "", err
@@ -73,6 +84,16 @@ func CreateRequest(summary string, description string, reporterUsername string,
 
 func CreateComment(commentBody string, files []glb.File, IssueKey string, serviceDeskId string, client *jira.Client) error {
 	lg.Logf("creating comment\n")
+	return createCommentWithFiles(commentBody, files, IssueKey, serviceDeskId, true, client)
+}
+
+// the comment and its files are only visible to agents
+func CreateInternalCommentWithFiles(commentBody string, files []glb.File, issueKey string, serviceDeskId string, client *jira.Client) error {
+	lg.Logf("creating internal comment with files\n")
+	return createCommentWithFiles(commentBody, files, issueKey, serviceDeskId, false, client)
+}
+
+func createCommentWithFiles(commentBody string, files []glb.File, IssueKey string, serviceDeskId string, public bool, client *jira.Client) error {
 	var tempFiles []string
 	for _, file := range files {
 		tempFile, err := createTempFile(file, serviceDeskId, client)
@@ -81,7 +102,7 @@ func CreateComment(commentBody string, files []glb.File, IssueKey string, servic
 		}
 		tempFiles = append(tempFiles, tempFile)
 	}
-	err := createCommentFromTempFiles(commentBody, tempFiles, IssueKey, client)
+	err := createCommentFromTempFiles(commentBody, tempFiles, IssueKey, public, client)
 	if err != nil {
 		return err
 	}
@@ -137,7 +158,7 @@ func createTempFile(file glb.File, serviceDeskId string, client *jira.Client) (s
 	return tempFiles.TemporaryAttachments[0].TemporaryAttachmentId, nil
 }
 
-func createCommentFromTempFiles(commentBody string, tempFiles []string, issueKey string, client *jira.Client) error {
+func createCommentFromTempFiles(commentBody string, tempFiles []string, issueKey string, public bool, client *jira.Client) error {
 	commentBody = capLength(commentBody, 32767, true)
 	lg.Logf("creating comment from temp files\n")
 	endpoint := fmt.Sprintf("/rest/servicedeskapi/request/%s/attachment", issueKey)
@@ -151,7 +172,7 @@ func createCommentFromTempFiles(commentBody string, tempFiles []string, issueKey
 	}
 	data := AttachmentComment{
 		TemporaryAttachmentIds: tempFiles,
-		Public:                 true,
+		Public:                 public,
 		AdditionalComment: AdditionalComment{
 			Body: commentBody,
 		},
@@ -170,6 +191,44 @@ func createCommentFromTempFiles(commentBody string, tempFiles []string, issueKey
 	return nil
 }
 
+// internal comments are only visible to agents
+func CreateInternalComment(commentBody string, issueKey string, client *jira.Client) error {
+	commentBody = capLength(commentBody, 32767, false)
+	lg.Logf("creating internal comment\n")
+	endpoint := fmt.Sprintf("/rest/servicedeskapi/request/%s/comment", issueKey)
+	type Comment struct {
+		Body   string `json:"body"`
+		Public bool   `json:"public"`
+	}
+	req, err := client.NewRequestWithContext(context.Background(), "POST", endpoint, Comment{Body: commentBody, Public: false})
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req, nil)
+	if err != nil {
+		printJiraResponse(resp)
+		return err
+	}
+	return nil
+}
+
+// for requests whose request type doesn't have the priority field
+func SetPriority(issueKey string, priority string, client *jira.Client) error {
+	lg.Logf("setting priority of %s to %s\n", issueKey, priority)
+	data := map[string]interface{}{
+		"fields": map[string]interface{}{
+			"priority": map[string]string{"name": priority},
+		},
+	}
+	resp, err := client.Issue.UpdateIssue(issueKey, data)
+	if err != nil {
+		printJiraResponse(resp)
+		return err
+	}
+	return nil
+}
+
 func AddParticipant(issueKey string, username string, client *jira.Client) error {
 	lg.Logf("adding participant %s to %s\n", username, issueKey)
 	apiEndpoint := fmt.Sprintf("/rest/servicedeskapi/request/%s/participant", issueKey)
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/url"
 	"strconv"
+	"strings"
 
 	jira "github.com/andygrunwald/go-jira"
 
@@ -61,6 +62,10 @@ func GetRequest(issueKey string, client *jira.Client) (*glb.Request, error) {
 	if issue.Fields.Assignee != nil {
 		assignee = issue.Fields.Assignee.Name
 	}
+	priority := ""
+	if issue.Fields.Priority != nil {
+		priority = issue.Fields.Priority.Name
+	}
 
 	lg.Logf("getting request %s\n", issueKey)
 	endpoint := fmt.Sprintf("/rest/servicedeskapi/request/%s", issueKey)
@@ -98,9 +103,64 @@ func GetRequest(issueKey string, client *jira.Client) (*glb.Request, error) {
 		Status:        returnedRequest.CurrentStatus.Status,
 		Reporter:      returnedRequest.Reporter.Name,
 		Assignee:      assignee,
+		Priority:      priority,
 	}, nil
 }
 
+// email addresses of the request's reporter and participants, lower case
+func GetRequestAddresses(issueKey string, client *jira.Client) ([]string, error) {
+	lg.Logf("getting reporter and participants of %s\n", issueKey)
+	type User struct {
+		EmailAddress string `json:"emailAddress"`
+	}
+	type ReturnedRequest struct {
+		Reporter User `json:"reporter"`
+	}
+	req, err := client.NewRequestWithContext(context.Background(), "GET", fmt.Sprintf("/rest/servicedeskapi/request/%s", issueKey), nil)
+	if err != nil {
+		return nil, err
+	}
+	var returnedRequest ReturnedRequest
+	resp, err := client.Do(req, &returnedRequest)
+	if err != nil {
+		printJiraResponse(resp)
+		return nil, err
+	}
+	var addresses []string
+	if returnedRequest.Reporter.EmailAddress != "" {
+		addresses = append(addresses, strings.ToLower(returnedRequest.Reporter.EmailAddress))
+	}
+
+	type ParticipantsResponse struct {
+		Size       int    `json:"size"`
+		IsLastPage bool   `json:"isLastPage"`
+		Values     []User `json:"values"`
+	}
+	start := 0
+	for {
+		endpoint := fmt.Sprintf("/rest/servicedeskapi/request/%s/participant?start=%d", issueKey, start)
+		req, err := client.NewRequestWithContext(context.Background(), "GET", endpoint, nil)
+		if err != nil {
+			return nil, err
+		}
+		var participantsResponse ParticipantsResponse
+		resp, err := client.Do(req, &participantsResponse)
+		if err != nil {
+			printJiraResponse(resp)
+			return nil, err
+		}
+		for _, participant := range participantsResponse.Values {
+			if participant.EmailAddress != "" {
+				addresses = append(addresses, strings.ToLower(participant.EmailAddress))
+			}
+		}
+		if participantsResponse.IsLastPage || len(participantsResponse.Values) == 0 {
+			return addresses, nil
+		}
+		start += len(participantsResponse.Values)
+	}
+}
+
 func GetRequestTypeId(typeName string, serviceDeskId string, client *jira.Client) (string, error) {
 	lg.Logf("getting request type for %s\n", typeName)
 	apiEndpoint := fmt.Sprintf("/rest/servicedeskapi/servicedesk/%s/requesttype", serviceDeskId)
@@ -135,6 +195,70 @@ func GetRequestTypeId(typeName string, serviceDeskId string, client *jira.Client
 		typeName, serviceDeskId, apiEndpoint))
 }
 
+// fields of a request type by their id
+func GetRequestTypeFields(serviceDeskId string, requestTypeId string, client *jira.Client) (map[string]*glb.RequestTypeField, error) {
+	lg.Logf("getting fields of request type %s\n", requestTypeId)
+	apiEndpoint := fmt.Sprintf("/rest/servicedeskapi/servicedesk/%s/requesttype/%s/field", serviceDeskId, requestTypeId)
+	req, err := client.NewRequestWithContext(context.Background(), "GET", apiEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	type ValidValue struct {
+		Value string `json:"value"`
+		Label string `json:"label"`
+	}
+	type JiraSchema struct {
+		Type  string `json:"type"`
+		Items string `json:"items"`
+	}
+	type RequestTypeFieldResponse struct {
+		FieldId     string       `json:"fieldId"`
+		Name        string       `json:"name"`
+		Required    bool         `json:"required"`
+		ValidValues []ValidValue `json:"validValues"`
+		JiraSchema  JiraSchema   `json:"jiraSchema"`
+	}
+	type RequestTypeFieldsResponse struct {
+		RequestTypeFields []RequestTypeFieldResponse `json:"requestTypeFields"`
+	}
+	var requestTypeFieldsResponse RequestTypeFieldsResponse
+	resp, err := client.Do(req, &requestTypeFieldsResponse)
+	if err != nil {
+		printJiraResponse(resp)
+		return nil, err
+	}
+	fields := make(map[string]*glb.RequestTypeField)
+	for _, fieldResponse := range requestTypeFieldsResponse.RequestTypeFields {
+		field := &glb.RequestTypeField{
+			FieldId:   fieldResponse.FieldId,
+			Name:      fieldResponse.Name,
+			Required:  fieldResponse.Required,
+			Type:      fieldResponse.JiraSchema.Type,
+			ItemsType: fieldResponse.JiraSchema.Items,
+		}
+		for _, validValue := range fieldResponse.ValidValues {
+			field.ValidValues = append(field.ValidValues, glb.RequestTypeFieldValue{Value: validValue.Value, Label: validValue.Label})
+		}
+		fields[field.FieldId] = field
+	}
+	return fields, nil
+}
+
+// names of all priorities, the highest first
+func GetPriorities(client *jira.Client) ([]string, error) {
+	lg.Logf("getting priorities")
+	priorities, resp, err := client.Priority.GetList()
+	if err != nil {
+		printJiraResponse(resp)
+		return nil, err
+	}
+	var names []string
+	for _, priority := range priorities {
+		names = append(names, priority.Name)
+	}
+	return names, nil
+}
+
 // TODO: cache for multiple projects, don't run same request multiple times
 func GetServiceDeskId(projectKey string, client *jira.Client) (string, error) {
 	lg.Logf("getting serviceDesk id for project %s\n", projectKey)
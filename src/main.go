@@ -61,6 +61,12 @@ func main() {
 	// when don't reply to email is received to a request, create a comment only once
 	noticedOutOfOffice := glb.NoticedOutOfOffice{}
 
+	if exitCode := runCommand(cfg, os.Args[1:], &noticedOutOfOffice, idb); exitCode != -1 {
+		lg.CloseLogger()
+		idb.Close()
+		os.Exit(exitCode)
+	}
+
 	// immediately parsing requests gets performed in startDumper if required
 	if cfg.DumpRequests {
 		email_loader.LoadUnhandledDumps(cfg, &noticedOutOfOffice, idb)
@@ -68,7 +74,7 @@ func main() {
 		os.Exit(0)
 	}
 	if cfg.ParseRequests {
-		email_loader.LoadAllRequestDumps(cfg, &noticedOutOfOffice)
+		email_loader.LoadAllRequestDumps(cfg, &noticedOutOfOffice, idb)
 		os.Exit(0)
 	}
 }
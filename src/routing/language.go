@@ -0,0 +1,58 @@
+// guess the language of an email from its most common words //
+package routing
+
+import (
+	"strings"
+	"unicode"
+)
+
+// words that are frequent in one language but rare in the others
+var stopWords = map[string][]string{
+	"en": {"the", "and", "is", "are", "was", "you", "with", "have", "this", "that", "not", "for", "please", "thanks", "from", "would", "could", "our", "your", "been"},
+	"de": {"der", "die", "das", "und", "ist", "sind", "nicht", "mit", "ich", "wir", "sie", "ein", "eine", "bitte", "danke", "auf", "für", "auch", "wird", "haben", "ihr", "uns"},
+	"fr": {"le", "la", "les", "et", "est", "sont", "pas", "avec", "je", "nous", "vous", "une", "merci", "pour", "dans", "sur", "des", "du", "qui", "avons", "votre"},
+	"es": {"el", "los", "las", "y", "es", "son", "no", "con", "yo", "nosotros", "usted", "una", "gracias", "para", "por", "que", "del", "muy", "hemos", "su", "está"},
+	"it": {"il", "lo", "gli", "e", "è", "sono", "non", "con", "io", "noi", "voi", "una", "grazie", "per", "che", "della", "del", "abbiamo", "questo", "suo"},
+	"nl": {"de", "het", "een", "en", "is", "zijn", "niet", "met", "ik", "wij", "jij", "u", "bedankt", "voor", "van", "dat", "ook", "wordt", "hebben", "onze"},
+	"pt": {"o", "os", "as", "e", "é", "são", "não", "com", "eu", "nós", "você", "uma", "obrigado", "para", "por", "que", "do", "da", "temos", "seu"},
+}
+
+// least number of stop words before a language is assumed
+const minStopWords = 3
+
+var stopWordLanguages = func() map[string][]string {
+	languages := make(map[string][]string)
+	for language, words := range stopWords {
+		for _, word := range words {
+			languages[word] = append(languages[word], language)
+		}
+	}
+	return languages
+}()
+
+// return the ISO 639-1 code, empty when the language can't be told
+func DetectLanguage(text string) string {
+	counts := make(map[string]int)
+	words := strings.FieldsFunc(strings.ToLower(text), func(char rune) bool {
+		return !unicode.IsLetter(char)
+	})
+	for _, word := range words {
+		for _, language := range stopWordLanguages[word] {
+			counts[language]++
+		}
+	}
+	bestLanguage := ""
+	bestCount := minStopWords - 1
+	tie := false
+	for language, count := range counts {
+		if count > bestCount {
+			bestLanguage, bestCount, tie = language, count, false
+		} else if count == bestCount && bestLanguage != "" {
+			tie = true
+		}
+	}
+	if tie {
+		return ""
+	}
+	return bestLanguage
+}
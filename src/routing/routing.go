@@ -0,0 +1,151 @@
+// decide where an email goes and what the request looks like with the configured rules //
+package routing
+
+import (
+	"net/mail"
+	"strings"
+
+	glb "github.ibmgcloud.net/dth/inbound_parser/global_structs"
+	lg "github.ibmgcloud.net/dth/inbound_parser/logging"
+)
+
+// pattern is an address or a domain, a domain matches its subdomains as well
+func addressMatches(patterns []string, address string) bool {
+	address = strings.ToLower(address)
+	domain := address[strings.LastIndex(address, "@")+1:]
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if strings.Contains(pattern, "@") {
+			if pattern == address {
+				return true
+			}
+		} else if domain == pattern || strings.HasSuffix(domain, "."+pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyAddressMatches(patterns []string, addresses []*mail.Address) bool {
+	for _, address := range addresses {
+		if addressMatches(patterns, address.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAttachments(email *glb.Email) bool {
+	for _, file := range email.Files {
+		if !file.Inline {
+			return true
+		}
+	}
+	return false
+}
+
+// language is only detected when a rule needs it
+func ruleMatches(match *glb.RoutingMatch, email *glb.Email, language *string) bool {
+	if len(match.From) != 0 && !addressMatches(match.From, email.From.Address) {
+		return false
+	}
+	if len(match.To) != 0 && !anyAddressMatches(match.To, append(append(append([]*mail.Address{}, email.To...), email.Cc...), email.Bcc...)) {
+		return false
+	}
+	if match.SubjectRegex != nil && !match.SubjectRegex.MatchString(email.Subject) {
+		return false
+	}
+	if match.BodyRegex != nil && !match.BodyRegex.MatchString(email.TextBody) {
+		return false
+	}
+	if match.HasAttachments != nil && *match.HasAttachments != hasAttachments(email) {
+		return false
+	}
+	if match.MinSpamScore != nil && email.SpamScore < *match.MinSpamScore {
+		return false
+	}
+	if match.MaxSpamScore != nil && email.SpamScore > *match.MaxSpamScore {
+		return false
+	}
+	if len(match.Languages) != 0 {
+		if *language == "" {
+			*language = DetectLanguage(email.Subject + "\n" + email.TextBody)
+			if *language == "" {
+				// don't detect it again for the next rule
+				*language = "unknown"
+			}
+			lg.Logf("detected language: %s\n", *language)
+		}
+		found := false
+		for _, ruleLanguage := range match.Languages {
+			if strings.EqualFold(ruleLanguage, *language) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func applyActions(actions *glb.RoutingActions, result *glb.RoutingResult) {
+	if actions.Drop {
+		result.Drop = true
+	}
+	if actions.ForwardServiceDesk != nil || actions.ForwardJiraInstall != nil {
+		result.ServiceDesk, result.JiraInstall = actions.ForwardServiceDesk, actions.ForwardJiraInstall
+		result.RequestTypeId = ""
+	}
+	if actions.Srd != nil {
+		result.ServiceDesk, result.JiraInstall = actions.Srd, actions.Srd.JiraInstall
+		result.RequestTypeId = actions.RequestTypeId
+	}
+	// converted for the request type by field_mapping.GetFieldValues
+	if actions.Priority != "" {
+		result.FieldValues["priority"] = actions.Priority
+	}
+	if len(actions.Labels) != 0 {
+		labels, _ := result.FieldValues["labels"].([]string)
+		result.FieldValues["labels"] = append(labels, actions.Labels...)
+	}
+	if len(actions.Components) != 0 {
+		components, _ := result.FieldValues["components"].([]string)
+		result.FieldValues["components"] = append(components, actions.Components...)
+	}
+	for fieldId, value := range actions.CustomFields {
+		result.FieldValues[fieldId] = value
+	}
+}
+
+// evaluate the rules in order, srd and jiraInstall are the addressees of the email
+// subaddress is the tag of the address the email went to, it selects the request type unless a rule does
+func Route(rules []*glb.RoutingRule, email *glb.Email, srd *glb.ServiceDesk, jiraInstall *glb.JiraInstall, subaddress string) *glb.RoutingResult {
+	result := &glb.RoutingResult{ServiceDesk: srd, JiraInstall: jiraInstall, FieldValues: make(map[string]interface{})}
+	language := ""
+	for _, rule := range rules {
+		if !ruleMatches(&rule.Match, email, &language) {
+			continue
+		}
+		lg.Logf("routing rule '%s' matches\n", rule.Name)
+		result.MatchedRules = append(result.MatchedRules, rule.Name)
+		applyActions(&rule.Actions, result)
+		if result.Drop {
+			lg.Logf("routing rule '%s' drops the email\n", rule.Name)
+			break
+		}
+		if !rule.Continue {
+			break
+		}
+	}
+	if len(rules) != 0 && len(result.MatchedRules) == 0 {
+		lg.Logf("no routing rule matches")
+	}
+	if result.RequestTypeId == "" && result.ServiceDesk != nil && subaddress != "" {
+		if requestTypeId, found := result.ServiceDesk.SubaddressRequestTypeIds[strings.ToLower(subaddress)]; found {
+			lg.Logf("using the request type of subaddress %s\n", subaddress)
+			result.RequestTypeId = requestTypeId
+		}
+	}
+	return result
+}